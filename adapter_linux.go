@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// HCI device ioctls from <bluetooth/hci.h>.
+const (
+	hciDevUp   = 0x400448c9 // HCIDEVUP
+	hciDevDown = 0x400448ca // HCIDEVDOWN
+)
+
+// resetAdapter power-cycles an HCI adapter by bringing it down and up again,
+// which makes the kernel reset the controller. A negative id resets hci0.
+// This requires CAP_NET_ADMIN and affects all users of the adapter.
+func resetAdapter(id int) error {
+	if id < 0 {
+		id = 0
+	}
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return fmt.Errorf("creating HCI socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), hciDevDown, uintptr(id)); errno != 0 {
+		return fmt.Errorf("bringing hci%d down: %w", id, errno)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), hciDevUp, uintptr(id)); errno != 0 && errno != unix.EALREADY {
+		return fmt.Errorf("bringing hci%d up: %w", id, errno)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// resetAdapter is only supported on Linux.
+func resetAdapter(id int) error {
+	return errors.New("adapter reset is only supported on Linux")
+}
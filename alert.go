@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+)
+
+// webhookClient sends alert webhooks.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// alert fires a webhook when a value crosses a threshold, and again once it
+// is back past the threshold by more than the hysteresis. Only crossings fire,
+// so that a value staying past the threshold doesn't fire on every reading.
+type alert struct {
+	// field is the payload field holding the value, and the prefix of
+	// event names.
+	field   string
+	webhook string
+
+	threshold, hysteresis float64
+
+	// below is whether the alert fires when the value drops below the
+	// threshold, rather than when it rises above it.
+	below bool
+
+	// oneShot is whether the alert clears without a webhook, only re-arming
+	// it for the next crossing.
+	oneShot bool
+
+	// firing is whether the value crossed the threshold and has not
+	// cleared since. It is only accessed from refresh.
+	firing bool
+}
+
+// next returns whether the alert is firing after a reading of v.
+func (a *alert) next(v float64) bool {
+	if a.below {
+		if a.firing {
+			return v <= a.threshold+a.hysteresis
+		}
+		return v < a.threshold
+	}
+	if a.firing {
+		return v >= a.threshold-a.hysteresis
+	}
+	return v > a.threshold
+}
+
+// event returns the name of the event sent when the alert starts or stops
+// firing.
+func (a *alert) event(firing bool) string {
+	switch {
+	case firing && a.below:
+		return a.field + "_low"
+	case firing:
+		return a.field + "_high"
+	}
+	return a.field + "_cleared"
+}
+
+// evaluate posts a webhook if a reading of v at ts makes the alert start or
+// stop firing. The state only changes once the webhook was posted, so that a
+// failed webhook is retried with the next reading.
+func (a *alert) evaluate(ctx context.Context, addr string, ts time.Time, v float64) error {
+	firing := a.next(v)
+	if firing == a.firing {
+		return nil
+	}
+	if !firing && a.oneShot {
+		slog.Info("alert re-armed", "alert", a.event(true), "device-addr", addr, a.field, v, "threshold", a.threshold)
+		a.firing = false
+		return nil
+	}
+	event := a.event(firing)
+	payload, err := json.Marshal(map[string]any{
+		"event":       event,
+		"device_addr": addr,
+		a.field:       v,
+		"threshold":   a.threshold,
+		"timestamp":   ts,
+	})
+	if err != nil {
+		return err
+	}
+	if err := postWebhook(ctx, a.webhook, payload); err != nil {
+		return fmt.Errorf("posting %s webhook: %w", event, err)
+	}
+	slog.Info("alert webhook posted", "event", event, "device-addr", addr, a.field, v, "threshold", a.threshold)
+	a.firing = firing
+	return nil
+}
+
+// evaluateAlerts posts alert webhooks for the latest reading as needed.
+// Alerting is best effort, and doesn't fail the refresh.
+func (c *collector) evaluateAlerts(ctx context.Context, latest *aranet4.Data) {
+	if c.co2Alert != nil && latest.CO2 > 0 {
+		co2 := corrections.apply("co2_ppm", float64(latest.CO2))
+		if err := c.co2Alert.evaluate(ctx, c.addr, latest.Time, co2); err != nil {
+			slog.Warn("failed to send CO2 alert", "error", err)
+		}
+	}
+	if c.batteryAlert != nil && latest.Battery > -1 {
+		if err := c.batteryAlert.evaluate(ctx, c.addr, latest.Time, float64(latest.Battery)); err != nil {
+			slog.Warn("failed to send battery alert", "error", err)
+		}
+	}
+}
+
+// postWebhook posts a JSON payload to a webhook URL.
+func postWebhook(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
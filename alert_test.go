@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordWebhooks returns a server recording the payloads posted to it, and
+// a pointer to the status it responds with.
+func recordWebhooks(t *testing.T) (*httptest.Server, *[]map[string]any, *int) {
+	t.Helper()
+	var payloads []map[string]any
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var p map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		payloads = append(payloads, p)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &payloads, &status
+}
+
+func TestAlert_Evaluate(t *testing.T) {
+	server, payloads, _ := recordWebhooks(t)
+	a := &alert{field: "co2", webhook: server.URL, threshold: 1000, hysteresis: 100}
+	ctx := context.Background()
+	ts := time.Now().Truncate(time.Second)
+
+	var events []string
+	for _, v := range []float64{800, 1000, 1200, 1300, 950, 900, 899, 850, 1001} {
+		n := len(*payloads)
+		require.NoError(t, a.evaluate(ctx, "AA:BB", ts, v))
+		if len(*payloads) > n {
+			events = append(events, (*payloads)[n]["event"].(string))
+		}
+	}
+	// Only crossings fire: staying above the threshold or within the
+	// hysteresis band doesn't.
+	assert.Equal(t, []string{"co2_high", "co2_cleared", "co2_high"}, events)
+	assert.Equal(t, map[string]any{
+		"event":       "co2_high",
+		"device_addr": "AA:BB",
+		"co2":         1200.0,
+		"threshold":   1000.0,
+		"timestamp":   ts.Format(time.RFC3339Nano),
+	}, (*payloads)[0])
+}
+
+func TestAlert_EvaluateRetries(t *testing.T) {
+	server, payloads, status := recordWebhooks(t)
+	a := &alert{field: "co2", webhook: server.URL, threshold: 1000}
+	ctx := context.Background()
+
+	*status = http.StatusInternalServerError
+	require.ErrorContains(t, a.evaluate(ctx, "AA:BB", time.Now(), 1200), "500")
+	assert.False(t, a.firing)
+
+	// The failed webhook is posted again with the next reading.
+	*status = http.StatusOK
+	require.NoError(t, a.evaluate(ctx, "AA:BB", time.Now(), 1200))
+	require.NoError(t, a.evaluate(ctx, "AA:BB", time.Now(), 1200))
+	assert.True(t, a.firing)
+	assert.Len(t, *payloads, 2)
+}
+
+func TestRefresh_CO2Alert(t *testing.T) {
+	server, payloads, status := recordWebhooks(t)
+	corrections["co2_ppm"] = correction{scale: 1, offset: 100}
+	t.Cleanup(func() { delete(corrections, "co2_ppm") })
+
+	latest := record(time.Now().Truncate(time.Minute), 950)
+	c, _ := newTestCollector(t, latest, nil)
+	c.co2Alert = &alert{field: "co2", webhook: server.URL, threshold: 1000, hysteresis: 100}
+
+	// A failed webhook doesn't fail the refresh.
+	*status = http.StatusServiceUnavailable
+	require.NoError(t, c.refresh())
+	*status = http.StatusOK
+	require.NoError(t, c.refresh())
+	require.Len(t, *payloads, 2)
+	// The alert is evaluated on the corrected value.
+	assert.Equal(t, 1050.0, (*payloads)[1]["co2"])
+}
+
+// errorSink is a sink failing every write.
+type errorSink struct{}
+
+func (errorSink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	return errors.New("sink is down")
+}
+
+func TestRefresh_AlertWithFailingSink(t *testing.T) {
+	server, payloads, _ := recordWebhooks(t)
+	c := newCollectorWithRegistry(errorSink{}, prometheus.NewRegistry())
+	latest := record(time.Now().Truncate(time.Minute), 1200)
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &latest, nil, nil
+	}
+	c.co2Alert = &alert{field: "co2", webhook: server.URL, threshold: 1000, hysteresis: 100}
+
+	require.ErrorContains(t, c.refresh(), "sink is down")
+	require.Len(t, *payloads, 1)
+	assert.Equal(t, "co2_high", (*payloads)[0]["event"])
+}
+
+func TestRefresh_BatteryAlert(t *testing.T) {
+	server, payloads, _ := recordWebhooks(t)
+	latest := record(time.Now().Truncate(time.Minute), 600)
+	c, _ := newTestCollector(t, latest, nil)
+	c.addr = "AA:BB:CC:DD:EE:FF"
+	c.batteryAlert = &alert{field: "battery", webhook: server.URL, threshold: 15, hysteresis: 5, below: true, oneShot: true}
+
+	// An unknown battery level is not alerted on.
+	require.NoError(t, c.refresh())
+	assert.Empty(t, *payloads)
+
+	latest.Battery = 10
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &latest, nil, nil
+	}
+	require.NoError(t, c.refresh())
+	require.NoError(t, c.refresh())
+	require.Len(t, *payloads, 1)
+	assert.Equal(t, "AA:BB:CC:DD:EE:FF", (*payloads)[0]["device_addr"])
+}
+
+func TestAlert_EvaluateBattery(t *testing.T) {
+	server, payloads, _ := recordWebhooks(t)
+	a := &alert{field: "battery", webhook: server.URL, threshold: 15, hysteresis: 5, below: true, oneShot: true}
+	ctx := context.Background()
+
+	var events []string
+	for _, v := range []float64{40, 15, 14, 10, 18, 20, 21, 100, 14} {
+		n := len(*payloads)
+		require.NoError(t, a.evaluate(ctx, "AA:BB", time.Now(), v))
+		if len(*payloads) > n {
+			events = append(events, (*payloads)[n]["event"].(string))
+		}
+	}
+	// Recovering above the hysteresis band, e.g. after a battery swap,
+	// re-arms the alert without a webhook.
+	assert.Equal(t, []string{"battery_low", "battery_low"}, events)
+	assert.Equal(t, 14.0, (*payloads)[0]["battery"])
+}
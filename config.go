@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the YAML configuration file set with -config. Every option
+// maps onto the flag in its flag tag, and values are parsed like the flag.
+// Flags set on the command line or in the environment take precedence over
+// the file.
+type fileConfig struct {
+	Listen   string            `yaml:"listen" flag:"listen"`
+	Devices  []string          `yaml:"devices" flag:"addr"`
+	Interval string            `yaml:"interval" flag:"interval"`
+	Timeout  string            `yaml:"timeout" flag:"timeout"`
+	Sink     string            `yaml:"sink" flag:"sink"`
+	Prefix   string            `yaml:"prefix" flag:"prefix"`
+	Job      string            `yaml:"job" flag:"job"`
+	Instance string            `yaml:"instance" flag:"instance"`
+	Labels   map[string]string `yaml:"labels" flag:"label"`
+
+	// Corrections map metric names to corrections like "scale:1.0,offset:-50".
+	Corrections map[string]string `yaml:"corrections" flag:"correct"`
+
+	Prometheus struct {
+		URL            string `yaml:"url" flag:"prometheus-url"`
+		RemoteWriteURL string `yaml:"remote_write_url" flag:"remote-write-url"`
+		Tenant         string `yaml:"tenant" flag:"prometheus-tenant"`
+
+		Auth struct {
+			User            string `yaml:"user" flag:"prometheus-user"`
+			PasswordFile    string `yaml:"password_file" flag:"prometheus-password-file"`
+			BearerTokenFile string `yaml:"bearer_token_file" flag:"prometheus-bearer-token-file"`
+		} `yaml:"auth"`
+
+		TLS struct {
+			CAFile             string `yaml:"ca_file" flag:"prometheus-ca-file"`
+			CertFile           string `yaml:"cert_file" flag:"prometheus-cert-file"`
+			KeyFile            string `yaml:"key_file" flag:"prometheus-key-file"`
+			InsecureSkipVerify string `yaml:"insecure_skip_verify" flag:"prometheus-insecure-skip-verify"`
+		} `yaml:"tls"`
+	} `yaml:"prometheus"`
+
+	Units struct {
+		Temperature string `yaml:"temperature" flag:"temperature-unit"`
+		Pressure    string `yaml:"pressure" flag:"pressure-unit"`
+	} `yaml:"units"`
+}
+
+// loadConfig sets the flags not set on the command line from the YAML
+// configuration file at path.
+func loadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return applyConfig(flag.CommandLine, f)
+}
+
+// applyConfig sets the flags of fs that were not set explicitly from a YAML
+// configuration. Unknown keys are an error.
+func applyConfig(fs *flag.FlagSet, r io.Reader) error {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var config fileConfig
+	if err := dec.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return setFlags(fs, reflect.ValueOf(config), set)
+}
+
+// envPrefix is the prefix of environment variables setting flags.
+const envPrefix = "ARANET4_"
+
+// envName returns the environment variable for a flag, e.g. ARANET4_PROMETHEUS_URL
+// for -prometheus-url.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets the flags of fs that were not set explicitly from their
+// environment variables, as returned by lookup.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookup(envName(f.Name))
+		if !ok || set[f.Name] {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s (-%s): %w", value, envName(f.Name), f.Name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// setFlags sets the flags in the flag tags of the fields of struct v that
+// have a value, unless they are in skip. Lists set the flag once per item,
+// and maps once per key, as key=value.
+func setFlags(fs *flag.FlagSet, v reflect.Value, skip map[string]bool) error {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		name, ok := v.Type().Field(i).Tag.Lookup("flag")
+		if !ok {
+			if field.Kind() == reflect.Struct {
+				if err := setFlags(fs, field, skip); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if skip[name] {
+			continue
+		}
+		var values []string
+		switch field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				values = []string{field.String()}
+			}
+		case reflect.Slice:
+			values = field.Interface().([]string)
+		case reflect.Map:
+			m := field.Interface().(map[string]string)
+			for _, key := range slices.Sorted(maps.Keys(m)) {
+				values = append(values, key+"="+m[key])
+			}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value %q for %s (-%s): %w", value, v.Type().Field(i).Tag.Get("yaml"), name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConfig_FlagsExist(t *testing.T) {
+	var check func(typ reflect.Type)
+	check = func(typ reflect.Type) {
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			name, ok := field.Tag.Lookup("flag")
+			if !ok {
+				check(field.Type)
+				continue
+			}
+			assert.NotNil(t, flag.Lookup(name), "flag -%s of %s", name, field.Name)
+		}
+	}
+	check(reflect.TypeFor[fileConfig]())
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		config       string
+		wantListen   string
+		wantAddrs    addrsFlag
+		wantLabels   labelsFlag
+		wantInterval time.Duration
+		wantErr      string
+	}{
+		{
+			name:         "empty",
+			wantListen:   "localhost:8000",
+			wantLabels:   labelsFlag{},
+			wantInterval: time.Hour,
+		},
+		{
+			name: "all options",
+			config: `
+listen: ":9000"
+devices: ["AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02"]
+interval: 30m
+labels:
+  room: office
+  floor: "2"
+`,
+			wantListen:   ":9000",
+			wantAddrs:    addrsFlag{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02"},
+			wantLabels:   labelsFlag{"room": "office", "floor": "2"},
+			wantInterval: 30 * time.Minute,
+		},
+		{
+			name:         "flags take precedence",
+			args:         []string{"-listen=:7000", "-label=room=kitchen"},
+			config:       "listen: \":9000\"\ninterval: 30m\nlabels: {room: office, floor: \"2\"}\n",
+			wantListen:   ":7000",
+			wantLabels:   labelsFlag{"room": "kitchen"},
+			wantInterval: 30 * time.Minute,
+		},
+		{name: "unknown key", config: "listen: \":9000\"\nlisten_addr: \":9000\"\n", wantErr: "field listen_addr not found"},
+		{name: "unknown nested key", config: "prometheus:\n  uri: http://localhost:9090/\n", wantErr: "field uri not found"},
+		{name: "invalid duration", config: "interval: often\n", wantErr: `invalid value "often" for interval (-interval)`},
+		{name: "invalid label", config: "labels: {\"\": x}\n", wantErr: "expected name=value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			listen := fs.String("listen", "localhost:8000", "")
+			interval := fs.Duration("interval", time.Hour, "")
+			var addrs addrsFlag
+			fs.Var(&addrs, "addr", "")
+			labels := labelsFlag{}
+			fs.Var(labels, "label", "")
+			require.NoError(t, fs.Parse(tt.args))
+
+			err := applyConfig(fs, strings.NewReader(tt.config))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantListen, *listen)
+			assert.Equal(t, tt.wantAddrs, addrs)
+			assert.Equal(t, tt.wantLabels, labels)
+			assert.Equal(t, tt.wantInterval, *interval)
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantListen   string
+		wantInterval time.Duration
+		wantAddrs    addrsFlag
+		wantErr      []string
+	}{
+		{name: "defaults", wantListen: "localhost:8000", wantInterval: time.Hour},
+		{
+			name:         "from environment",
+			env:          map[string]string{"ARANET4_LISTEN": ":9000", "ARANET4_INTERVAL": "30m", "ARANET4_ADDR": "AA:BB:CC:DD:EE:01,AA:BB:CC:DD:EE:02"},
+			wantListen:   ":9000",
+			wantInterval: 30 * time.Minute,
+			wantAddrs:    addrsFlag{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02"},
+		},
+		{
+			name:         "flags take precedence",
+			args:         []string{"-listen=:7000"},
+			env:          map[string]string{"ARANET4_LISTEN": ":9000", "ARANET4_INTERVAL": "30m"},
+			wantListen:   ":7000",
+			wantInterval: 30 * time.Minute,
+		},
+		{
+			name:    "invalid values",
+			env:     map[string]string{"ARANET4_INTERVAL": "often", "ARANET4_MAX_FAILS": "many"},
+			wantErr: []string{`invalid value "often" for ARANET4_INTERVAL (-interval)`, `invalid value "many" for ARANET4_MAX_FAILS (-max-fails)`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			listen := fs.String("listen", "localhost:8000", "")
+			interval := fs.Duration("interval", time.Hour, "")
+			fs.Int("max-fails", 0, "")
+			var addrs addrsFlag
+			fs.Var(&addrs, "addr", "")
+			require.NoError(t, fs.Parse(tt.args))
+
+			err := applyEnv(fs, func(name string) (string, bool) {
+				v, ok := tt.env[name]
+				return v, ok
+			})
+			if tt.wantErr != nil {
+				for _, want := range tt.wantErr {
+					require.ErrorContains(t, err, want)
+				}
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantListen, *listen)
+			assert.Equal(t, tt.wantInterval, *interval)
+			assert.Equal(t, tt.wantAddrs, addrs)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// dashboardPanel describes how a metric is shown in the generated dashboard.
+type dashboardPanel struct {
+	title string
+	unit  string
+}
+
+// dashboardPanels are the panels for metrics written by the collector, by
+// metric name. Metrics without an entry are shown with their name as title.
+var dashboardPanels = map[string]dashboardPanel{
+	"co2_ppm":                                 {title: "CO2", unit: "ppm"},
+	"temperature_celsius":                     {title: "Temperature", unit: "celsius"},
+	"temperature_fahrenheit":                  {title: "Temperature (°F)", unit: "fahrenheit"},
+	"humidity_percent":                        {title: "Humidity", unit: "humidity"},
+	"dew_point_celsius":                       {title: "Dew point", unit: "celsius"},
+	"dew_point_fahrenheit":                    {title: "Dew point (°F)", unit: "fahrenheit"},
+	"absolute_humidity_grams_per_cubic_meter": {title: "Absolute humidity", unit: "congm3"},
+	"pressure_hpa":                            {title: "Pressure", unit: "pressurehpa"},
+	"pressure_mmhg":                           {title: "Pressure (mmHg)", unit: "short"},
+	"pressure_inhg":                           {title: "Pressure (inHg)", unit: "pressurehg"},
+	"battery_level_percent":                   {title: "Battery", unit: "percent"},
+}
+
+// dashboardDatasource refers to the datasource selected when importing the dashboard.
+var dashboardDatasource = map[string]string{"type": "prometheus", "uid": "${DS_PROMETHEUS}"}
+
+// writeDashboard writes a Grafana dashboard for the configured prefix and
+// labels to w.
+func writeDashboard(w io.Writer) error {
+	scheme, ok := labelSchemes[*labelScheme]
+	if !ok {
+		return fmt.Errorf("unknown label scheme %q", *labelScheme)
+	}
+	job, instance := promqlLabel(scheme.job), promqlLabel(scheme.instance)
+	groupBy := []string{instance, promqlLabel(scheme.device)}
+	for _, name := range slices.Sorted(maps.Keys(extraLabels)) {
+		groupBy = append(groupBy, promqlLabel(name))
+	}
+	selector := fmt.Sprintf(`{%s=%q,%s=~"$instance"}`, job, *jobName, instance)
+
+	var panels []map[string]any
+	add := func(title, unit, expr string) {
+		i := len(panels)
+		panels = append(panels, timeseriesPanel(i+1, title, unit, expr, 12*(i%2), 8*(i/2)))
+	}
+	for _, m := range slices.Concat(recordMetrics, latestMetrics) {
+		p, ok := dashboardPanels[m.name]
+		if !ok {
+			p = dashboardPanel{title: m.name, unit: "short"}
+		}
+		add(p.title, p.unit, fmt.Sprintf("max(%s%s%s) by (%s)", *metricPrefix, m.name, selector, strings.Join(groupBy, ",")))
+	}
+
+	// Collector health is exposed on /metrics, so its labels depend on the
+	// scrape configuration rather than on the collector flags.
+	add("Time since last successful refresh", "s",
+		fmt.Sprintf("time() - max(%slast_success_time_seconds) by (instance)", *metricPrefix))
+	add("Refresh attempts", "short",
+		fmt.Sprintf("sum(increase(%srefresh_latencies_seconds_count[$__rate_interval])) by (instance,status)", *metricPrefix))
+	add("Records written per refresh", "short",
+		fmt.Sprintf("max(%slast_refresh_records_written) by (instance)", *metricPrefix))
+
+	variableQuery := fmt.Sprintf("label_values(%sco2_ppm{%s=%q},%s)", *metricPrefix, job, *jobName, instance)
+	dashboard := map[string]any{
+		"__inputs": []map[string]any{{
+			"name":     "DS_PROMETHEUS",
+			"label":    "prometheus",
+			"type":     "datasource",
+			"pluginId": "prometheus",
+		}},
+		"editable":      true,
+		"graphTooltip":  0,
+		"panels":        panels,
+		"schemaVersion": 41,
+		"tags":          []string{"aranet4"},
+		"templating": map[string]any{
+			"list": []map[string]any{{
+				"current":    map[string]any{},
+				"datasource": dashboardDatasource,
+				"definition": variableQuery,
+				"includeAll": true,
+				"label":      "Instance",
+				"multi":      true,
+				"name":       "instance",
+				"query":      map[string]any{"qryType": 1, "query": variableQuery},
+				"refresh":    2,
+				"type":       "query",
+			}},
+		},
+		"time":  map[string]any{"from": "now-24h", "to": "now"},
+		"title": "Aranet4",
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dashboard)
+}
+
+// promqlLabel returns a label name for use in PromQL, quoting names that are
+// only valid with UTF-8 name support.
+func promqlLabel(name string) string {
+	if model.LegacyValidation.IsValidLabelName(name) {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+// timeseriesPanel returns a Grafana time series panel with a single query.
+func timeseriesPanel(id int, title, unit, expr string, x, y int) map[string]any {
+	return map[string]any{
+		"datasource": dashboardDatasource,
+		"fieldConfig": map[string]any{
+			"defaults":  map[string]any{"unit": unit},
+			"overrides": []any{},
+		},
+		"gridPos": map[string]any{"h": 8, "w": 12, "x": x, "y": y},
+		"id":      id,
+		"targets": []map[string]any{{
+			"datasource":   dashboardDatasource,
+			"editorMode":   "code",
+			"expr":         expr,
+			"legendFormat": "__auto",
+			"range":        true,
+			"refId":        "A",
+		}},
+		"title": title,
+		"type":  "timeseries",
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDashboard(t *testing.T) {
+	setFlag(t, metricPrefix, "home_")
+	setFlag(t, jobName, "air")
+	setFlag(t, &extraLabels, labelsFlag{"room": "bedroom"})
+
+	var buf bytes.Buffer
+	require.NoError(t, writeDashboard(&buf))
+
+	var dashboard struct {
+		Panels []struct {
+			Title   string `json:"title"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &dashboard))
+
+	exprs := make(map[string]string)
+	for _, p := range dashboard.Panels {
+		require.Len(t, p.Targets, 1, "panel %s", p.Title)
+		exprs[p.Title] = p.Targets[0].Expr
+	}
+	assert.Equal(t, `max(home_co2_ppm{job="air",instance=~"$instance"}) by (instance,device_addr,room)`, exprs["CO2"])
+	assert.Equal(t, `max(home_battery_level_percent{job="air",instance=~"$instance"}) by (instance,device_addr,room)`, exprs["Battery"])
+	assert.Len(t, dashboard.Panels, len(recordMetrics)+len(latestMetrics)+3)
+
+	setFlag(t, labelScheme, "otel")
+	buf.Reset()
+	require.NoError(t, writeDashboard(&buf))
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &dashboard))
+	assert.Equal(t, `max(home_co2_ppm{"service.name"="air","service.instance.id"=~"$instance"}) by ("service.instance.id","device.id",room)`, dashboard.Panels[0].Targets[0].Expr)
+}
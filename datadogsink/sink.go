@@ -0,0 +1,262 @@
+package datadogsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPastAge is how far in the past Datadog accepts points.
+	// https://docs.datadoghq.com/api/latest/metrics/#submit-metrics
+	maxPastAge = time.Hour
+	// maxFutureSkew is how far in the future Datadog accepts points.
+	maxFutureSkew = 10 * time.Minute
+
+	// gaugeType is the metric type identifier for gauges in the v2 series API.
+	gaugeType = 3
+)
+
+// ErrFutureTimestamp is returned by ReportMetric for values with a timestamp
+// too far in the future.
+var ErrFutureTimestamp = errors.New("timestamp too far in the future")
+
+// ErrNonFinite is returned by ReportMetric for NaN and infinite values.
+var ErrNonFinite = errors.New("value is not finite")
+
+// Config holds configuration for the Datadog sink.
+type Config struct {
+	// Endpoint is the base URL of the Datadog API (e.g., "https://api.datadoghq.com/")
+	Endpoint string
+
+	// APIKey is the Datadog API key used to authenticate requests.
+	APIKey string
+
+	// MetricPrefix is the prefix to use for all metric names (e.g., "aranet4_")
+	MetricPrefix string
+
+	// Labels are additional labels to add to all metrics as Datadog tags.
+	Labels map[string]string
+
+	// DryRun, if true, will log metrics instead of sending them to Datadog.
+	DryRun bool
+
+	// LogSamples, if true, logs every sent point at info level.
+	LogSamples bool
+}
+
+// Sink buffers metrics and sends them to Datadog using the v2 series API.
+// Points are only sent when Flush is called, so that a whole refresh is
+// submitted in a single request.
+type Sink struct {
+	client      *http.Client
+	url         string
+	validateURL string
+	config      *Config
+	tags        []string
+
+	// pending is a map of metric name to points not yet sent to Datadog.
+	pending map[string][]point
+
+	// lastTimes is a map of metric name to the last time it was sent.
+	lastTimes map[string]time.Time
+}
+
+type point struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type series struct {
+	Metric string   `json:"metric"`
+	Type   int      `json:"type"`
+	Points []point  `json:"points"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+type payload struct {
+	Series []series `json:"series"`
+}
+
+// New creates a new Datadog sink with the given configuration.
+func New(config Config) (*Sink, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("Endpoint is required")
+	}
+	if config.APIKey == "" && !config.DryRun {
+		return nil, fmt.Errorf("APIKey is required")
+	}
+
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL %q: %w", config.Endpoint, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", config.Endpoint)
+	}
+
+	var tags []string
+	for name, value := range config.Labels {
+		tags = append(tags, name+":"+value)
+	}
+	slices.Sort(tags)
+
+	seriesURL := u.JoinPath("/api/v2/series")
+	slog.Debug("Datadog sink created", "url", seriesURL.String(), "prefix", config.MetricPrefix, "tags", tags)
+
+	return &Sink{
+		client:      &http.Client{Timeout: time.Minute},
+		url:         seriesURL.String(),
+		validateURL: u.JoinPath("/api/v1/validate").String(),
+		config:      &config,
+		tags:        tags,
+		pending:     make(map[string][]point),
+		lastTimes:   make(map[string]time.Time),
+	}, nil
+}
+
+// ReportMetric buffers a metric value to be sent on the next Flush.
+// Points older than Datadog accepts are silently skipped.
+func (s *Sink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if ts.IsZero() {
+		return fmt.Errorf("cannot report metric %q with zero timestamp", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("metric %q value %v: %w", name, value, ErrNonFinite)
+	}
+	now := time.Now()
+	if ts.After(now.Add(maxFutureSkew)) {
+		return fmt.Errorf("timestamp %v for metric %q is more than %v ahead of now: %w", ts, name, maxFutureSkew, ErrFutureTimestamp)
+	}
+	if ts.Before(now.Add(-maxPastAge)) {
+		slog.Debug("skipping value older than Datadog accepts", "metric", name, "ts", ts)
+		return nil
+	}
+
+	last := s.lastTimes[name]
+	if pts := s.pending[name]; len(pts) > 0 {
+		last = time.Unix(pts[len(pts)-1].Timestamp, 0)
+	}
+	if !ts.Truncate(time.Second).After(last) {
+		slog.Debug("skipping value with timestamp before last reported", "metric", name, "ts", ts, "last", last)
+		return nil
+	}
+
+	s.pending[name] = append(s.pending[name], point{Timestamp: ts.Unix(), Value: value})
+	return nil
+}
+
+// Flush sends all buffered points to Datadog in a single request.
+func (s *Sink) Flush(ctx context.Context) error {
+	// Points kept from a failed flush may have aged past what Datadog accepts.
+	cutoff := time.Now().Add(-maxPastAge).Unix()
+	for name, pts := range s.pending {
+		pts = slices.DeleteFunc(pts, func(pt point) bool { return pt.Timestamp < cutoff })
+		if len(pts) == 0 {
+			delete(s.pending, name)
+		} else {
+			s.pending[name] = pts
+		}
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	var p payload
+	for name, pts := range s.pending {
+		p.Series = append(p.Series, series{
+			Metric: s.config.MetricPrefix + name,
+			Type:   gaugeType,
+			Points: pts,
+			Tags:   s.tags,
+		})
+	}
+	slices.SortFunc(p.Series, func(a, b series) int {
+		return strings.Compare(a.Metric, b.Metric)
+	})
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshaling payload: %w", err)
+	}
+
+	if s.config.DryRun {
+		// Nothing was sent, so last sent times are not advanced.
+		slog.Info("dry run, skipping Datadog write", "payload", string(body))
+		clear(s.pending)
+		return nil
+	}
+	if err := s.send(ctx, body); err != nil {
+		return err
+	}
+
+	for name, pts := range s.pending {
+		if s.config.LogSamples {
+			for _, pt := range pts {
+				slog.Info("sent sample", "metric", s.config.MetricPrefix+name, "value", pt.Value, "ts", time.Unix(pt.Timestamp, 0).Format(time.RFC3339))
+			}
+		}
+		s.lastTimes[name] = time.Unix(pts[len(pts)-1].Timestamp, 0)
+	}
+	clear(s.pending)
+	return nil
+}
+
+// Abort drops the points of a failed refresh. Last sent times were not
+// advanced, so they are reported again on the next refresh rather than
+// piling up while Datadog is unavailable.
+func (s *Sink) Abort() {
+	clear(s.pending)
+}
+
+// Check verifies that Datadog is reachable and accepts the API key, without
+// sending any points.
+func (s *Sink) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.validateURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("DD-API-KEY", s.config.APIKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("validating API key: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("validating API key: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// send posts a JSON payload to the series endpoint.
+func (s *Sink) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", s.config.APIKey)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sending request: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package datadogsink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+		errMsg  string
+	}{
+		{
+			name: "valid config",
+			config: Config{
+				Endpoint:     "https://api.datadoghq.com/",
+				APIKey:       "key",
+				MetricPrefix: "test_",
+			},
+		},
+		{
+			name: "missing endpoint",
+			config: Config{
+				APIKey: "key",
+			},
+			wantErr: true,
+			errMsg:  "Endpoint is required",
+		},
+		{
+			name: "missing API key",
+			config: Config{
+				Endpoint: "https://api.datadoghq.com/",
+			},
+			wantErr: true,
+			errMsg:  "APIKey is required",
+		},
+		{
+			name: "missing API key in dry run",
+			config: Config{
+				Endpoint: "https://api.datadoghq.com/",
+				DryRun:   true,
+			},
+		},
+		{
+			name: "URL without host",
+			config: Config{
+				Endpoint: "https://",
+				APIKey:   "key",
+			},
+			wantErr: true,
+			errMsg:  "has no host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := New(tt.config)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.errMsg)
+				require.Nil(t, sink)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, sink)
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var requests []payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/series", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("DD-API-KEY"))
+		var p payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		requests = append(requests, p)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink, err := New(Config{
+		Endpoint:     server.URL,
+		APIKey:       "secret",
+		MetricPrefix: "test_",
+		Labels:       map[string]string{"job": "test", "instance": "test-instance"},
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	// Points outside of the accepted window are skipped.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(-2*time.Hour), 400))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(-time.Minute), 500))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.NoError(t, sink.ReportMetric(ctx, "temperature_celsius", now, 21.5))
+	// Duplicate timestamps are skipped.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 700))
+	assert.Empty(t, requests, "Nothing should be sent before Flush")
+
+	require.NoError(t, sink.Flush(ctx))
+	require.Len(t, requests, 1, "All points should be sent in a single request")
+	require.Len(t, requests[0].Series, 2)
+
+	co2 := requests[0].Series[0]
+	assert.Equal(t, "test_co2_ppm", co2.Metric)
+	assert.Equal(t, gaugeType, co2.Type)
+	assert.Equal(t, []string{"instance:test-instance", "job:test"}, co2.Tags)
+	assert.Equal(t, []point{
+		{Timestamp: now.Add(-time.Minute).Unix(), Value: 500},
+		{Timestamp: now.Unix(), Value: 600},
+	}, co2.Points)
+	assert.Equal(t, "test_temperature_celsius", requests[0].Series[1].Metric)
+
+	// Already sent points are not sent again.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.NoError(t, sink.Flush(ctx))
+	assert.Len(t, requests, 1, "Flush with no new points should not send a request")
+}
+
+func TestReportMetric_Validation(t *testing.T) {
+	sink, err := New(Config{Endpoint: "https://api.datadoghq.com/", APIKey: "key"})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	err = sink.ReportMetric(ctx, "co2_ppm", time.Time{}, 1)
+	require.ErrorContains(t, err, "zero timestamp")
+
+	err = sink.ReportMetric(ctx, "co2_ppm", time.Now().Add(time.Hour), 1)
+	require.ErrorIs(t, err, ErrFutureTimestamp)
+}
+
+func TestFlush_Error(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, `{"errors":["Forbidden"]}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	sink, err := New(Config{Endpoint: server.URL, APIKey: "bad"})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", time.Now(), 500))
+
+	err = sink.Flush(ctx)
+	require.ErrorContains(t, err, "403")
+
+	// Points are kept after a failed flush, so they can be retried.
+	err = sink.Flush(ctx)
+	require.Error(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestFlush_AbortThenRetry(t *testing.T) {
+	var requests []payload
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, `{"errors":["Service Unavailable"]}`, http.StatusServiceUnavailable)
+			return
+		}
+		var p payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		requests = append(requests, p)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink, err := New(Config{Endpoint: server.URL, APIKey: "secret"})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(-time.Minute), 500))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.ErrorContains(t, sink.Flush(ctx), "503")
+	sink.Abort()
+
+	// The next refresh reports the same points again, plus a new one.
+	fail = false
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(-time.Minute), 500))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(time.Second), 700))
+	require.NoError(t, sink.Flush(ctx))
+
+	require.Len(t, requests, 1)
+	require.Len(t, requests[0].Series, 1)
+	assert.Equal(t, []point{
+		{Timestamp: now.Add(-time.Minute).Unix(), Value: 500},
+		{Timestamp: now.Unix(), Value: 600},
+		{Timestamp: now.Add(time.Second).Unix(), Value: 700},
+	}, requests[0].Series[0].Points, "Points of the failed flush should be sent exactly once")
+}
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/validate", r.URL.Path)
+		if r.Header.Get("DD-API-KEY") != "secret" {
+			http.Error(w, `{"errors":["Forbidden"]}`, http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"valid":true}`))
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	sink, err := New(Config{Endpoint: server.URL, APIKey: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, sink.Check(ctx))
+
+	sink, err = New(Config{Endpoint: server.URL, APIKey: "bad"})
+	require.NoError(t, err)
+	require.ErrorContains(t, sink.Check(ctx), "403")
+}
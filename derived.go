@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+
+	"github.com/knyar/aranet4-ble"
+)
+
+// Magnus formula coefficients for water over a plane surface, valid from
+// -45°C to 60°C (Sonntag, 1990).
+const (
+	magnusA = 17.62
+	magnusB = 243.12
+)
+
+// dewPoint returns the dew point in degrees Celsius for a temperature in
+// degrees Celsius and a relative humidity in percent.
+func dewPoint(tempC, rh float64) float64 {
+	gamma := math.Log(rh/100) + magnusA*tempC/(magnusB+tempC)
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// absoluteHumidity returns the absolute humidity in grams per cubic metre for
+// a temperature in degrees Celsius and a relative humidity in percent.
+func absoluteHumidity(tempC, rh float64) float64 {
+	// Saturation vapour pressure in hPa, with the Magnus formula.
+	saturation := 6.112 * math.Exp(magnusA*tempC/(magnusB+tempC))
+	// Ideal gas law, with the specific gas constant of water vapour
+	// (461.5 J/(kg·K)), converting hPa to Pa and kg to g.
+	return saturation * rh / 100 * 100 * 1000 / (461.5 * (tempC + 273.15))
+}
+
+// hasHumidity reports whether a reading has a corrected humidity that
+// derived metrics can be calculated from.
+func hasHumidity(d *aranet4.Data) bool {
+	return corrections.apply("humidity_percent", d.H) > 0
+}
+
+// dewPointMetric is reported for every record with -report-dew-point. It is
+// derived from the corrected temperature and humidity.
+var dewPointMetric = metric{
+	name: "dew_point_celsius",
+	value: func(d *aranet4.Data) float64 {
+		return dewPoint(corrections.apply("temperature_celsius", d.T), corrections.apply("humidity_percent", d.H))
+	},
+	valid:   hasHumidity,
+	derived: true,
+}
+
+// absoluteHumidityMetric is reported for every record with
+// -report-absolute-humidity. It is derived from the corrected temperature and
+// humidity.
+var absoluteHumidityMetric = metric{
+	name: "absolute_humidity_grams_per_cubic_meter",
+	value: func(d *aranet4.Data) float64 {
+		return absoluteHumidity(corrections.apply("temperature_celsius", d.T), corrections.apply("humidity_percent", d.H))
+	},
+	valid:   hasHumidity,
+	derived: true,
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDewPoint(t *testing.T) {
+	tests := []struct {
+		tempC, rh, want float64
+	}{
+		{tempC: 0, rh: 100, want: 0},
+		{tempC: 20, rh: 100, want: 20},
+		{tempC: 20, rh: 50, want: 9.3},
+		{tempC: 21, rh: 40, want: 6.9},
+		{tempC: 25, rh: 60, want: 16.7},
+		{tempC: 30, rh: 80, want: 26.2},
+		{tempC: 35, rh: 20, want: 8.7},
+		{tempC: -10, rh: 70, want: -14.4},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.want, dewPoint(tt.tempC, tt.rh), 0.1, "%g°C, %g%%", tt.tempC, tt.rh)
+	}
+}
+
+func TestAbsoluteHumidity(t *testing.T) {
+	tests := []struct {
+		tempC, rh, want float64
+	}{
+		{tempC: 0, rh: 100, want: 4.85},
+		{tempC: 18, rh: 65, want: 10.0},
+		{tempC: 20, rh: 50, want: 8.6},
+		{tempC: 21, rh: 40, want: 7.3},
+		{tempC: 25, rh: 60, want: 13.8},
+		{tempC: 30, rh: 80, want: 24.2},
+		{tempC: 22, rh: 0, want: 0},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.want, absoluteHumidity(tt.tempC, tt.rh), 0.1, "%g°C, %g%%", tt.tempC, tt.rh)
+	}
+}
+
+func TestReportMetrics_Derived(t *testing.T) {
+	corrections["humidity_percent"] = correction{scale: 1, offset: 10}
+	t.Cleanup(func() { delete(corrections, "humidity_percent") })
+	metrics, err := withUnits(append(slices.Clone(recordMetrics), dewPointMetric, absoluteHumidityMetric), "both", "hpa")
+	require.NoError(t, err)
+
+	c, sink := newTestCollector(t, aranet4.Data{}, nil)
+	ts := time.Now().Truncate(time.Second)
+	data := aranet4.Data{CO2: 600, T: 20, H: 40, P: 1000, Time: ts}
+	require.NoError(t, c.reportMetrics(context.Background(), &data, metrics))
+
+	// The dew point is calculated from corrected values.
+	values := make(map[string]float64)
+	for _, s := range sink.samples {
+		values[s.name] = s.value
+	}
+	assert.InDelta(t, 9.3, values["dew_point_celsius"], 0.1)
+	assert.InDelta(t, celsiusToFahrenheit(values["dew_point_celsius"]), values["dew_point_fahrenheit"], 1e-9)
+	assert.InDelta(t, 8.6, values["absolute_humidity_grams_per_cubic_meter"], 0.1)
+
+	// Without humidity there are no derived metrics, but the record is still valid.
+	data.H = -10
+	assert.Empty(t, invalidMetric(&data, metrics))
+	sink.samples = nil
+	require.NoError(t, c.reportMetrics(context.Background(), &data, metrics))
+	assert.Len(t, sink.samples, 5)
+	for _, s := range sink.samples {
+		assert.NotContains(t, []string{"dew_point_celsius", "dew_point_fahrenheit", "absolute_humidity_grams_per_cubic_meter"}, s.name)
+	}
+}
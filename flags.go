@@ -0,0 +1,340 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// deviceAddrs holds the devices set with -addr, in the order they were given.
+	deviceAddrs addrsFlag
+
+	// extraLabels holds free-form labels set with repeated -label flags.
+	extraLabels = labelsFlag{}
+
+	// corrections holds per-metric corrections set with repeated -correct flags.
+	corrections = correctionsFlag{}
+
+	// hciSocketIDs holds the adapters set with -hci-socket-id, in order of preference.
+	hciSocketIDs = socketIDsFlag{-1}
+
+	// activeHours holds the daily window set with -active-hours.
+	activeHours activeHoursFlag
+
+	// trustedProxies holds networks of reverse proxies set with -trusted-proxies.
+	trustedProxies prefixesFlag
+)
+
+func init() {
+	flag.Var(&deviceAddrs, "addr", "MAC address of Aranet4, or a comma-separated list of addresses to collect from several devices (can be repeated)")
+	flag.Var(extraLabels, "label", "Additional label to add to all metrics, as name=value (can be repeated)")
+	flag.Var(corrections, "correct", "Linear correction for a metric, as name=scale:1.0,offset:-50 (can be repeated)")
+	flag.Var(&hciSocketIDs, "hci-socket-id", "hci device socket ID, or a comma-separated list of IDs to fail over between")
+	flag.Var(&activeHours, "active-hours", "Only refresh on schedule during this daily window of local time, e.g. 07:00-23:00 (default always)")
+	flag.Var(&trustedProxies, "trusted-proxies", "Comma-separated list of CIDRs of reverse proxies trusted to set X-Forwarded-For and X-Real-IP")
+}
+
+// labelsFlag is a flag.Value collecting repeated name=value labels.
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string {
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(l)) {
+		pairs = append(pairs, name+"="+l[name])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	if _, dup := l[name]; dup {
+		return fmt.Errorf("label %q is configured more than once", name)
+	}
+	l[name] = value
+	return nil
+}
+
+// correction is a linear correction applied to a metric value.
+type correction struct {
+	scale  float64
+	offset float64
+}
+
+// apply returns the corrected value.
+func (c correction) apply(v float64) float64 {
+	return v*c.scale + c.offset
+}
+
+// correctionsFlag is a flag.Value collecting repeated per-metric corrections.
+type correctionsFlag map[string]correction
+
+func (cf correctionsFlag) String() string {
+	var values []string
+	for _, name := range slices.Sorted(maps.Keys(cf)) {
+		c := cf[name]
+		values = append(values, fmt.Sprintf("%s=scale:%g,offset:%g", name, c.scale, c.offset))
+	}
+	return strings.Join(values, " ")
+}
+
+// apply returns the value of the named metric with its correction applied,
+// if there is one.
+func (cf correctionsFlag) apply(name string, v float64) float64 {
+	if c, ok := cf[name]; ok {
+		return c.apply(v)
+	}
+	return v
+}
+
+func (cf correctionsFlag) Set(v string) error {
+	name, c, err := parseCorrection(v)
+	if err != nil {
+		return err
+	}
+	if _, dup := cf[name]; dup {
+		return fmt.Errorf("correction for %q is configured more than once", name)
+	}
+	cf[name] = c
+	return nil
+}
+
+// parseCorrection parses a correction in the name=scale:X,offset:Y format.
+// Either of scale and offset may be omitted.
+func parseCorrection(v string) (string, correction, error) {
+	name, spec, ok := strings.Cut(v, "=")
+	if !ok || name == "" || spec == "" {
+		return "", correction{}, fmt.Errorf("expected name=scale:X,offset:Y, got %q", v)
+	}
+	c := correction{scale: 1}
+	seen := make(map[string]bool)
+	for part := range strings.SplitSeq(spec, ",") {
+		key, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return "", correction{}, fmt.Errorf("expected key:value in %q", part)
+		}
+		if seen[key] {
+			return "", correction{}, fmt.Errorf("%q is set more than once in %q", key, v)
+		}
+		seen[key] = true
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", correction{}, fmt.Errorf("invalid %s value %q: %w", key, value, err)
+		}
+		switch key {
+		case "scale":
+			c.scale = f
+		case "offset":
+			c.offset = f
+		default:
+			return "", correction{}, fmt.Errorf("unknown correction parameter %q", key)
+		}
+	}
+	return name, c, nil
+}
+
+// prefixesFlag is a flag.Value holding a comma-separated list of networks.
+type prefixesFlag []netip.Prefix
+
+func (p *prefixesFlag) String() string {
+	var s []string
+	for _, prefix := range *p {
+		s = append(s, prefix.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *prefixesFlag) Set(v string) error {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	*p = prefixes
+	return nil
+}
+
+// contains returns whether addr is in any of the networks.
+func (p prefixesFlag) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrsFlag is a flag.Value collecting device addresses from repeated and
+// comma-separated values. Addresses are normalized to upper case with colons,
+// so that e.g. aa-bb-cc-dd-ee-ff and AA:BB:CC:DD:EE:FF are the same device.
+type addrsFlag []string
+
+func (f *addrsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *addrsFlag) Set(v string) error {
+	for addr := range strings.SplitSeq(v, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			return fmt.Errorf("empty device address in %q", v)
+		}
+		mac, err := net.ParseMAC(addr)
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("invalid device address %q", addr)
+		}
+		addr = strings.ToUpper(mac.String())
+		if slices.Contains(*f, addr) {
+			return fmt.Errorf("device %s is configured more than once", addr)
+		}
+		*f = append(*f, addr)
+	}
+	return nil
+}
+
+// socketIDsFlag is a flag.Value holding a comma-separated list of HCI socket IDs.
+type socketIDsFlag []int
+
+func (f *socketIDsFlag) String() string {
+	var s []string
+	for _, id := range *f {
+		s = append(s, strconv.Itoa(id))
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *socketIDsFlag) Set(v string) error {
+	var ids []int
+	for _, s := range strings.Split(v, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid socket ID %q: %w", s, err)
+		}
+		if slices.Contains(ids, id) {
+			return fmt.Errorf("socket ID %d is configured more than once", id)
+		}
+		ids = append(ids, id)
+	}
+	*f = ids
+	return nil
+}
+
+// activeHoursFlag is a flag.Value holding a daily time window as HH:MM-HH:MM.
+// The window wraps around midnight if it ends before it starts. The zero value
+// is always active.
+type activeHoursFlag struct {
+	// start and end are minutes since midnight; end is exclusive.
+	start, end int
+	set        bool
+}
+
+func (h *activeHoursFlag) String() string {
+	if !h.set {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", h.start/60, h.start%60, h.end/60, h.end%60)
+}
+
+func (h *activeHoursFlag) Set(v string) error {
+	from, to, ok := strings.Cut(v, "-")
+	if !ok {
+		return fmt.Errorf("expected HH:MM-HH:MM, got %q", v)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return fmt.Errorf("active hours %q are empty", v)
+	}
+	*h = activeHoursFlag{start: start, end: end, set: true}
+	return nil
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns whether t is within the window, in t's location.
+func (h activeHoursFlag) contains(t time.Time) bool {
+	if !h.set {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if h.start < h.end {
+		return m >= h.start && m < h.end
+	}
+	return m >= h.start || m < h.end
+}
+
+// activeBetween returns how much of the time from from to to is within the
+// window.
+func (h activeHoursFlag) activeBetween(from, to time.Time) time.Duration {
+	if !h.set {
+		return to.Sub(from)
+	}
+	var active time.Duration
+	// Start the day before, for a window wrapping around midnight that
+	// started then.
+	first := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, from.Location())
+	for day := first; !day.After(to); day = day.AddDate(0, 0, 1) {
+		start := time.Date(day.Year(), day.Month(), day.Day(), h.start/60, h.start%60, 0, 0, from.Location())
+		end := time.Date(day.Year(), day.Month(), day.Day(), h.end/60, h.end%60, 0, 0, from.Location())
+		if h.end < h.start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if d := minTime(end, to).Sub(maxTime(start, from)); d > 0 {
+			active += d
+		}
+	}
+	return active
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// nextActive returns t if it is within the window, or the next time the
+// window starts otherwise.
+func (h activeHoursFlag) nextActive(t time.Time) time.Time {
+	if h.contains(t) {
+		return t
+	}
+	next := time.Date(t.Year(), t.Month(), t.Day(), h.start/60, h.start%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
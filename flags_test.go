@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCorrection(t *testing.T) {
+	tests := []struct {
+		input    string
+		wantName string
+		want     correction
+		errMsg   string
+	}{
+		{input: "co2_ppm=scale:1.0,offset:-50", wantName: "co2_ppm", want: correction{scale: 1, offset: -50}},
+		{input: "temperature_celsius=offset:0.5", wantName: "temperature_celsius", want: correction{scale: 1, offset: 0.5}},
+		{input: "humidity_percent=scale:1.1", wantName: "humidity_percent", want: correction{scale: 1.1}},
+		{input: "co2_ppm", errMsg: "expected name=scale:X,offset:Y"},
+		{input: "co2_ppm=", errMsg: "expected name=scale:X,offset:Y"},
+		{input: "=scale:1", errMsg: "expected name=scale:X,offset:Y"},
+		{input: "co2_ppm=scale", errMsg: "expected key:value"},
+		{input: "co2_ppm=scale:abc", errMsg: "invalid scale value"},
+		{input: "co2_ppm=bias:1", errMsg: "unknown correction parameter"},
+		{input: "co2_ppm=offset:1,offset:2", errMsg: "set more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			name, c, err := parseCorrection(tt.input)
+			if tt.errMsg != "" {
+				require.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.want, c)
+		})
+	}
+}
+
+func TestCorrectionApply(t *testing.T) {
+	tests := []struct {
+		c     correction
+		value float64
+		want  float64
+	}{
+		{c: correction{scale: 1}, value: 800, want: 800},
+		{c: correction{scale: 1, offset: -50}, value: 800, want: 750},
+		{c: correction{scale: 0.5, offset: 10}, value: 100, want: 60},
+		{c: correction{scale: 1.02, offset: -0.3}, value: 21, want: 21.12},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.want, tt.c.apply(tt.value), 1e-9)
+	}
+}
+
+func TestCorrectionsFlag(t *testing.T) {
+	cf := correctionsFlag{}
+	require.NoError(t, cf.Set("co2_ppm=offset:-50"))
+	require.NoError(t, cf.Set("temperature_celsius=scale:2"))
+	require.ErrorContains(t, cf.Set("co2_ppm=offset:-40"), "more than once")
+	assert.Equal(t, "co2_ppm=scale:1,offset:-50 temperature_celsius=scale:2,offset:0", cf.String())
+}
+
+func TestAddrsFlag(t *testing.T) {
+	var f addrsFlag
+	require.NoError(t, f.Set("AA:BB:CC:DD:EE:01"))
+	require.NoError(t, f.Set("AA:BB:CC:DD:EE:02, AA:BB:CC:DD:EE:03"))
+	assert.Equal(t, addrsFlag{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02", "AA:BB:CC:DD:EE:03"}, f)
+	assert.Equal(t, "AA:BB:CC:DD:EE:01,AA:BB:CC:DD:EE:02,AA:BB:CC:DD:EE:03", f.String())
+	require.ErrorContains(t, f.Set("aa:bb:cc:dd:ee:01"), "more than once")
+	require.ErrorContains(t, f.Set("AA-BB-CC-DD-EE-02"), "more than once")
+	require.NoError(t, f.Set("aa-bb-cc-dd-ee-04"))
+	assert.Equal(t, "AA:BB:CC:DD:EE:04", f[3])
+	require.ErrorContains(t, f.Set("AA:BB:CC:DD:EE"), "invalid device address")
+	require.ErrorContains(t, f.Set("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"), "invalid device address")
+	require.ErrorContains(t, f.Set("AA:BB:CC:DD:EE:05,"), "empty device address")
+}
+
+func TestSocketIDsFlag(t *testing.T) {
+	f := socketIDsFlag{-1}
+	assert.Equal(t, "-1", f.String())
+	require.NoError(t, f.Set("1, 0"))
+	assert.Equal(t, socketIDsFlag{1, 0}, f)
+	require.ErrorContains(t, f.Set("0,0"), "more than once")
+	require.ErrorContains(t, f.Set("hci0"), "invalid socket ID")
+}
+
+func TestActiveHoursFlag(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2025, time.March, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	var always activeHoursFlag
+	assert.True(t, always.contains(at(3, 0)))
+	assert.Equal(t, at(3, 0), always.nextActive(at(3, 0)))
+
+	var day activeHoursFlag
+	require.NoError(t, day.Set("07:00-23:30"))
+	assert.Equal(t, "07:00-23:30", day.String())
+	assert.False(t, day.contains(at(6, 59)))
+	assert.True(t, day.contains(at(7, 0)))
+	assert.True(t, day.contains(at(23, 29)))
+	assert.False(t, day.contains(at(23, 30)))
+	assert.Equal(t, at(7, 0), day.nextActive(at(2, 0)))
+	assert.Equal(t, at(7, 0).AddDate(0, 0, 1), day.nextActive(at(23, 45)))
+
+	var night activeHoursFlag
+	require.NoError(t, night.Set("22:00-06:00"))
+	assert.True(t, night.contains(at(23, 0)))
+	assert.True(t, night.contains(at(5, 59)))
+	assert.False(t, night.contains(at(12, 0)))
+	assert.Equal(t, at(22, 0), night.nextActive(at(12, 0)))
+
+	assert.Equal(t, 3*time.Hour, always.activeBetween(at(3, 0), at(6, 0)))
+	assert.Equal(t, time.Duration(0), day.activeBetween(at(0, 0), at(7, 0)))
+	assert.Equal(t, 30*time.Minute, day.activeBetween(at(6, 0), at(7, 30)))
+	assert.Equal(t, 2*time.Hour, day.activeBetween(at(22, 30), at(8, 0).AddDate(0, 0, 1)))
+	assert.Equal(t, 16*time.Hour+30*time.Minute+2*time.Hour, day.activeBetween(at(22, 30), at(8, 0).AddDate(0, 0, 2)))
+	assert.Equal(t, 2*time.Hour, night.activeBetween(at(4, 0), at(12, 0)))
+	assert.Equal(t, 3*time.Hour, night.activeBetween(at(12, 0), at(1, 0).AddDate(0, 0, 1)))
+	assert.Equal(t, 8*time.Hour, night.activeBetween(at(21, 0), at(7, 0).AddDate(0, 0, 1)))
+
+	require.ErrorContains(t, night.Set("07:00"), "expected HH:MM-HH:MM")
+	require.ErrorContains(t, night.Set("7am-11pm"), "invalid time of day")
+	require.ErrorContains(t, night.Set("07:00-07:00"), "empty")
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readingsCollector is a prometheus.Collector exposing the latest reading of
+// the device as gauges, for scraping /metrics instead of writing to a sink.
+// Nothing is exposed until the device has been read.
+type readingsCollector struct {
+	c      *collector
+	labels prometheus.Labels
+}
+
+// Describe sends no descriptors, making this an unchecked collector: its
+// metrics are only known after the first read.
+func (r *readingsCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (r *readingsCollector) Collect(ch chan<- prometheus.Metric) {
+	data := r.c.latest.Load()
+	if data == nil {
+		return
+	}
+	metrics := append(slices.Clone(recordMetrics), latestMetrics...)
+	if *reportBatt {
+		metrics = append(metrics, batteryAvailableMetric)
+	}
+	for _, m := range metrics {
+		if m.valid != nil && !m.valid(data) {
+			continue
+		}
+		value, _, _ := m.values(data)
+		desc := prometheus.NewDesc(*metricPrefix+m.name, "Latest "+m.name+" reading of the device.", nil, r.labels)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+}
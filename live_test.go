@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadingsCollector(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	latest := record(now, 640)
+	latest.Battery = 81
+	c, _ := newTestCollector(t, latest, nil)
+	readings := &readingsCollector{c: c, labels: map[string]string{"device_addr": "aa:bb"}}
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(readings))
+
+	assert.Equal(t, 0, testutil.CollectAndCount(readings), "nothing is exposed before the first read")
+
+	require.NoError(t, c.refresh())
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	got := make(map[string]float64)
+	for _, f := range families {
+		require.Len(t, f.GetMetric(), 1)
+		m := f.GetMetric()[0]
+		assert.Equal(t, "device_addr", m.GetLabel()[0].GetName())
+		assert.Equal(t, "aa:bb", m.GetLabel()[0].GetValue())
+		got[f.GetName()] = m.GetGauge().GetValue()
+	}
+	assert.Equal(t, map[string]float64{
+		"aranet4_battery_level_percent": 81,
+		"aranet4_co2_ppm":               640,
+		"aranet4_humidity_percent":      40,
+		"aranet4_pressure_hpa":          1000,
+		"aranet4_temperature_celsius":   21,
+	}, got)
+
+	// Invalid values are not exposed.
+	c.latest.Store(&aranet4.Data{Battery: -1, T: 20, H: 50, Time: now})
+	assert.Equal(t, 2, testutil.CollectAndCount(readings))
+}
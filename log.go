@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// countingHandler is a slog.Handler that counts log records by level before
+// passing them to the wrapped handler, to allow alerting on error logs without
+// a log pipeline.
+type countingHandler struct {
+	slog.Handler
+	messages *prometheus.CounterVec
+}
+
+// newCountingHandler wraps h to count log records in a log_messages_total
+// counter registered in reg.
+func newCountingHandler(h slog.Handler, reg prometheus.Registerer) *countingHandler {
+	messages := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: *metricPrefix + "log_messages_total",
+		Help: "Number of log messages written by the collector, by level.",
+	}, []string{"level"})
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError} {
+		messages.WithLabelValues(levelLabel(level))
+	}
+	return &countingHandler{Handler: h, messages: messages}
+}
+
+func (h *countingHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.messages.WithLabelValues(levelLabel(r.Level)).Inc()
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &countingHandler{Handler: h.Handler.WithAttrs(attrs), messages: h.messages}
+}
+
+func (h *countingHandler) WithGroup(name string) slog.Handler {
+	return &countingHandler{Handler: h.Handler.WithGroup(name), messages: h.messages}
+}
+
+// levelLabel returns the label value for a log level, e.g. "warn".
+func levelLabel(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
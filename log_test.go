@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := newCountingHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}), prometheus.NewRegistry())
+	logger := slog.New(h)
+
+	logger.Debug("not enabled")
+	logger.Info("refreshed")
+	logger.With("device", "aa:bb").Error("failed")
+	logger.WithGroup("ble").Error("timeout", "attempt", 2)
+
+	assert.Equal(t, 0.0, testutil.ToFloat64(h.messages.WithLabelValues("debug")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(h.messages.WithLabelValues("info")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(h.messages.WithLabelValues("warn")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(h.messages.WithLabelValues("error")))
+	assert.Contains(t, buf.String(), "msg=failed device=aa:bb")
+	assert.Contains(t, buf.String(), "msg=timeout ble.attempt=2")
+	assert.NotContains(t, buf.String(), "not enabled")
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"log/slog"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/knyar/aranet4-ble"
@@ -24,6 +33,7 @@ import (
 	bonds "github.com/rigado/ble/linux/hci/bond"
 	"tailscale.com/syncs"
 
+	"github.com/knyar/aranet4-prom-collector/otlpsink"
 	"github.com/knyar/aranet4-prom-collector/promsync"
 	"github.com/mattn/go-isatty"
 )
@@ -31,31 +41,227 @@ import (
 var (
 	hostname, _ = os.Hostname()
 
-	verbose  = flag.Bool("verbose", false, "Verbose logging")
-	dryRun   = flag.Bool("dry-run", false, "Dry run mode")
-	listen   = flag.String("listen", "localhost:8000", "Listen address for HTTP server")
-	interval = flag.Duration("interval", time.Hour, "How often to sync data from Aranet4 to Prometheus")
-	timeout  = flag.Duration("timeout", 5*time.Minute, "Timeout for a single refresh operations")
+	configFile   = flag.String("config", "", "YAML configuration file, for options not set with flags")
+	verbose      = flag.Bool("verbose", false, "Verbose logging")
+	dryRun       = flag.Bool("dry-run", false, "Dry run mode")
+	logSamples   = flag.Bool("log-samples", false, "Log every written sample at info level")
+	printDash    = flag.Bool("print-dashboard", false, "Print a Grafana dashboard for the configured prefix and labels to stdout and exit")
+	validateOnly = flag.Bool("validate", false, "Check that the sink is reachable and the device can be discovered, without writing any data, and exit")
+	tailMode     = flag.Bool("tail", false, "Print the latest measurement to stdout on every interval, without writing to a sink")
+	planMode     = flag.Bool("plan", false, "Refresh once, print which historic records would be written or skipped, and exit (implies -dry-run)")
+	listen       = flag.String("listen", "localhost:8000", "Listen address for HTTP server")
+	compress     = flag.Bool("gzip", true, "Compress HTTP responses for clients that support gzip")
+	eventNames   = flag.String("events", "battery_replaced,moved,calibrated", "Comma-separated list of events accepted by /api/annotation")
+	debugAPI     = flag.Bool("debug-endpoints", false, "Enable debug endpoints under /api/debug/ that modify collector state")
+	interval     = flag.Duration("interval", time.Hour, "How often to sync data from Aranet4 to Prometheus")
+	timeout      = flag.Duration("timeout", 5*time.Minute, "Timeout for a single refresh operations")
+	maxFails     = flag.Int("max-consecutive-failures", 0, "Exit after this many consecutive failed refreshes, to be restarted by a supervisor (0 to retry forever)")
+	readyAge     = flag.Duration("ready-max-age", 0, "Maximum age of the last successful refresh for /readyz to report ready (0 for twice -interval)")
 
-	hciSocketID = flag.Int("hci-socket-id", -1, "hci device socket ID")
-	deviceAddr  = flag.String("addr", "", "MAC address of Aranet4")
+	startDelay  = flag.Duration("startup-delay", 0, "Fixed delay before the first refresh")
+	startJitter = flag.Duration("startup-jitter", 0, "Maximum random delay added to -startup-delay, to stagger many collectors")
+
+	heartbeat          = flag.Bool("heartbeat", false, "Write a heartbeat metric at the end of every successful refresh")
+	heartbeatOnFailure = flag.Bool("heartbeat-on-failure", false, "Also write the heartbeat metric after failed refreshes")
+	heartbeatValue     = flag.String("heartbeat-value", "timestamp", "Value of the heartbeat metric (timestamp, one)")
+	shutdownMarker     = flag.Bool("shutdown-marker", false, "Write device_up 1 after successful refreshes, and 0 after failed ones and when stopped with SIGTERM")
+
+	tempUnit  = flag.String("temperature-unit", "celsius", "Unit to report temperature in (celsius, fahrenheit, both)")
+	pressUnit = flag.String("pressure-unit", "hpa", "Comma-separated list of units to report pressure in (hpa, mmhg, inhg)")
+
+	reportBatt = flag.Bool("report-unknown-battery", false, "Also report battery_reading_available (0 or 1), to tell a missing battery reading apart from an empty battery")
+	reportDew  = flag.Bool("report-dew-point", false, "Also report the dew point, calculated from temperature and humidity, as dew_point_celsius (or in the -temperature-unit)")
+	reportAbsH = flag.Bool("report-absolute-humidity", false, "Also report the absolute humidity, calculated from temperature and humidity, as absolute_humidity_grams_per_cubic_meter")
+	reportRaw  = flag.Bool("report-raw", false, "Also report uncorrected values of metrics with a -correct flag as <metric>_raw")
+
+	futureRecords = flag.String("future-records", "skip", "What to do with historic records too far in the future for the sink: skip (and count) them, or fail the refresh")
+
+	subscribeMode = flag.Bool("subscribe", false, "Keep the connection to the device open and report new measurements as the device notifies about them, falling back to polling if notifications are not supported")
+	onlyLatest    = flag.Bool("report-only-latest", false, "Only report the latest measurement on each refresh, without reading or backfilling device history")
+	alignTimes    = flag.Duration("align-timestamps", 0, "Align measurement timestamps to the measurement interval of the device, with the phase rounded to this duration, which must evenly divide the interval, so that collectors reading the same device write identical timestamps (0 to disable)")
+	maxRecords    = flag.Int("max-records-per-refresh", 0, "Maximum number of newest historic records to report per refresh (0 for unlimited)")
+
+	lockThread  = flag.Bool("lock-ble-thread", false, "Run each Bluetooth read on a dedicated OS thread")
+	autoReset   = flag.Bool("auto-adapter-reset", false, "Reset the Bluetooth adapter after repeated connection failures (requires CAP_NET_ADMIN and affects other users of the adapter)")
+	resetAfter  = flag.Int("adapter-reset-after", 3, "Number of consecutive refreshes failing to connect, including their retries, before resetting the adapter with -auto-adapter-reset")
+	deviceConc  = flag.Int("device-concurrency", 1, "With several devices, how many to refresh at the same time (more than 1 needs an adapter that supports concurrent connections)")
+	connRetries = flag.Int("connect-retries", 2, "How many times to retry connecting to the device within a refresh")
+	persistConn = flag.Bool("persistent-connection", false, "Keep the connection to the device open between refreshes, reconnecting only after an error")
+	connBackoff = flag.Duration("connect-backoff", 5*time.Second, "Delay before the first connection retry, doubling with every retry")
+	scanTimeout = flag.Duration("scan-timeout", 30*time.Second, "How long a single scan for the device by -validate lasts")
+	scanRetries = flag.Int("scan-retries", 2, "How many times -validate scans again if the device was not seen")
 	btBondFile  = flag.String("bt-bonds-file", "bonds.json", "Bluetooth bond state file: written when pairing is successful")
+	passkeyWait = flag.Duration("passkey-timeout", 2*time.Minute, "How long to wait for a passkey to be entered when pairing")
 	passkeyMode = flag.String("passkey-mode", "auto", "Determines how passkey is requested at pairint time (auto, web, terminal")
+	passkeyFlag = flag.String("passkey", "", "Passkey to pair with, instead of prompting for it (also ARANET4_PASSKEY)")
 
+	sinkType     = flag.String("sink", "prometheus", "Where to send metrics (prometheus, datadog, victoriametrics, stdout, none)")
+	exposeLatest = flag.Bool("expose-readings", false, "Also expose the latest reading as gauges on /metrics, for scraping")
 	metricPrefix = flag.String("prefix", "aranet4_", "Prefix for metrics")
+	extraPrefix  = flag.String("additional-prefixes", "", "Comma-separated list of additional prefixes to also write metrics under (Prometheus sink only)")
 	promEndpoint = flag.String("prometheus-url", "http://localhost:9090/", "Prometheus base URL")
+	rwURL        = flag.String("remote-write-url", "", "Remote write URL (default: -prometheus-url with /api/v1/write appended)")
+	idleTimeout  = flag.Duration("prometheus-idle-timeout", 90*time.Second, "How long to keep idle connections to Prometheus open")
+	writeTimeout = flag.Duration("prometheus-write-timeout", 30*time.Second, "Timeout for a single remote write request")
+	writeRetries = flag.Int("prometheus-write-retries", 3, "Number of times to retry a failed remote write request, waiting 1s, 2s, 4s and so on in between")
+	batchSize    = flag.Int("prometheus-batch-size", 500, "Maximum number of samples per remote write request, with samples of a refresh written together at its end (0 to write each record separately; ignored with -prometheus-async-writers)")
+	asyncWriters = flag.Int("prometheus-async-writers", 0, "Send up to this many remote write requests concurrently, one metric at a time each (0 to write serially)")
+	dedupRes     = flag.String("dedup-resolution", "seconds", "Timestamp precision for deduplication against Prometheus (seconds, milliseconds)")
+	dedupLabels  = flag.String("dedup-match-labels", "", "Comma-separated list of labels to match when looking up the last written samples (default all labels)")
+	lookback     = flag.Duration("dedup-lookback", promsync.DefaultLookbackDelta, "How far back to look for the last written samples in Prometheus or VictoriaMetrics")
+	futureSkew   = flag.Duration("prometheus-max-future-skew", promsync.DefaultMaxFutureSkew, "How far ahead of the local clock sample timestamps may be (Prometheus rejects samples too far in the future, by default more than 1h)")
+	bestEffort   = flag.Bool("dedup-best-effort", false, "Keep writing without deduplication if querying Prometheus for the last written samples fails")
+	dedupConc    = flag.Int("dedup-concurrency", 0, "Before the first refresh, look up the last written samples of all metrics, running this many queries at a time (0 to look up each metric when it is first written)")
+	stateFile    = flag.String("prometheus-state-file", "", "File to save the last written times of metrics to, so that a restart doesn't query Prometheus for each of them")
+	stateMaxAge  = flag.Duration("prometheus-state-max-age", 0, "Query Prometheus again instead of using times from -prometheus-state-file if it is older than this (0 for three times -interval)")
+	skewWarning  = flag.Duration("clock-skew-warning", 0, "At startup, compare the Prometheus clock with the local clock and warn if they differ by more than this (0 to disable)")
+	rwVersion    = flag.String("remote-write-version", "", "Override the X-Prometheus-Remote-Write-Version header sent with remote write requests")
+	credHelper   = flag.String("credential-helper", "", "Command (split on spaces) printing a bearer token for Prometheus requests, as plain text or as JSON with token and expiry fields")
+	promUser     = flag.String("prometheus-user", "", "User name for basic auth with Prometheus")
+	promPassFile = flag.String("prometheus-password-file", "", "File containing the password for basic auth with Prometheus")
+	promToken    = flag.String("prometheus-bearer-token-file", "", "File containing a bearer token for Prometheus, read on every request")
+	promTenant   = flag.String("prometheus-tenant", "", "Tenant ID to send as the X-Scope-OrgID header, for Mimir and Cortex")
+	promCAFile   = flag.String("prometheus-ca-file", "", "PEM file with CA certificates to verify the Prometheus server certificate with")
+	promCertFile = flag.String("prometheus-cert-file", "", "PEM file with a client certificate for mutual TLS with Prometheus (requires -prometheus-key-file)")
+	promKeyFile  = flag.String("prometheus-key-file", "", "PEM file with the key of -prometheus-cert-file")
+	promInsecure = flag.Bool("prometheus-insecure-skip-verify", false, "Don't verify the Prometheus server certificate")
+	awsSigV4     = flag.Bool("aws-sigv4", false, "Sign Prometheus requests with AWS SigV4 (for Amazon Managed Service for Prometheus)")
+	awsRegion    = flag.String("aws-region", os.Getenv("AWS_REGION"), "AWS region for -aws-sigv4")
+	labelScheme  = flag.String("label-scheme", "prometheus", "Names of the job, instance and device labels (prometheus: job, instance, device_addr; otel: service.name, service.instance.id, device.id)")
 	jobName      = flag.String("job", "aranet4", "Job name for metrics")
 	instanceName = flag.String("instance", hostname, "Instance name for metrics")
+
+	mqttBroker    = flag.String("mqtt-broker", "", "MQTT broker URL (e.g. tcp://localhost:1883) to also publish the latest reading to, for Home Assistant")
+	mqttTopic     = flag.String("mqtt-topic-prefix", "aranet4", "Prefix of the MQTT topics readings are published to, as <prefix>/<device>/state")
+	mqttUser      = flag.String("mqtt-user", "", "User name for the MQTT broker")
+	mqttPassFile  = flag.String("mqtt-password-file", "", "File containing the password for the MQTT broker")
+	mqttDiscovery = flag.String("mqtt-discovery-prefix", "homeassistant", "Prefix of Home Assistant MQTT discovery topics (empty to disable discovery)")
+
+	co2AlertAt   = flag.Int("co2-alert-threshold", 0, "CO2 level in ppm above which to post an alert to -co2-alert-webhook (0 to disable)")
+	co2AlertURL  = flag.String("co2-alert-webhook", "", "URL to post a JSON payload to when CO2 rises above -co2-alert-threshold, and when the alert clears")
+	co2AlertHyst = flag.Int("co2-alert-hysteresis", 100, "How far in ppm below -co2-alert-threshold CO2 must drop for the alert to clear")
+
+	battAlertAt   = flag.Int("battery-alert-percent", 0, "Battery level in percent below which to post an alert to -battery-alert-webhook once (0 to disable)")
+	battAlertURL  = flag.String("battery-alert-webhook", "", "URL to post a JSON payload to when the battery drops below -battery-alert-percent")
+	battAlertHyst = flag.Int("battery-alert-hysteresis", 5, "How far in percent above -battery-alert-percent the battery must recover to re-arm the alert")
+
+	otlpURL = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint (e.g. http://localhost:4318) to also export metrics to")
+
+	vmURL         = flag.String("vm-url", "http://localhost:8428/", "VictoriaMetrics base URL")
+	datadogURL    = flag.String("datadog-url", "https://api.datadoghq.com/", "Datadog API base URL")
+	datadogAPIKey = flag.String("datadog-api-key", "", "Datadog API key")
 )
 
 func main() {
 	flag.Parse()
+	// Flags set on the command line take precedence over the environment,
+	// and both over the config file.
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		slog.Error("failed to set flags from environment", "error", err)
+		os.Exit(1)
+	}
+	if *configFile != "" {
+		if err := loadConfig(*configFile); err != nil {
+			slog.Error("failed to load config file", "config", *configFile, "error", err)
+			os.Exit(1)
+		}
+	}
 
+	level := slog.LevelInfo
 	if *verbose {
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+		level = slog.LevelDebug
+	}
+	// slog's default handler writes through the log package, which SetDefault
+	// redirects back to the new handler, so it can't be wrapped.
+	slog.SetDefault(slog.New(newCountingHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}), prometheus.DefaultRegisterer)))
+	if *reportDew {
+		recordMetrics = append(recordMetrics, dewPointMetric)
+	}
+	if *reportAbsH {
+		recordMetrics = append(recordMetrics, absoluteHumidityMetric)
+	}
+	var err error
+	if recordMetrics, err = withUnits(recordMetrics, *tempUnit, *pressUnit); err != nil {
+		slog.Error("invalid units", "error", err)
+		os.Exit(1)
+	}
+	if *printDash {
+		if err := writeDashboard(os.Stdout); err != nil {
+			slog.Error("failed to write dashboard", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *planMode {
+		*dryRun = true
+		if *sinkType != "prometheus" {
+			slog.Error("-plan is only supported with the prometheus sink", "sink", *sinkType)
+			os.Exit(1)
+		}
+	}
+	if len(deviceAddrs) == 0 {
+		slog.Error("device address is required", "device-addr", deviceAddrs.String())
+		os.Exit(1)
+	}
+	if len(deviceAddrs) > 1 && (*subscribeMode || *tailMode || *persistConn) {
+		// All keep a connection open, which would block other devices.
+		slog.Error("-subscribe, -tail and -persistent-connection only support a single device", "device-addr", deviceAddrs.String())
+		os.Exit(1)
 	}
-	if *deviceAddr == "" {
-		slog.Error("device address is required", "device-addr", *deviceAddr)
+	if slices.ContainsFunc(strings.Split(*eventNames, ","), func(e string) bool { return strings.TrimSpace(e) == "" }) {
+		slog.Error("events must not contain empty event names", "events", *eventNames)
+		os.Exit(1)
+	}
+	if *subscribeMode && activeHours.set {
+		// A subscription reports every notification, so it would keep the
+		// adapter busy outside of active hours.
+		slog.Error("-subscribe can't be combined with -active-hours", "active-hours", activeHours.String())
+		os.Exit(1)
+	}
+	for name := range corrections {
+		if !slices.Contains(measurementMetrics, name) {
+			slog.Error("correction for unknown metric", "metric", name, "known", measurementMetrics)
+			os.Exit(1)
+		}
+	}
+	if *futureRecords != "skip" && *futureRecords != "fail" {
+		slog.Error("invalid future records policy", "future-records", *futureRecords)
+		os.Exit(1)
+	}
+	if *alignTimes < 0 {
+		slog.Error("align-timestamps must not be negative", "align-timestamps", *alignTimes)
+		os.Exit(1)
+	}
+	if *maxRecords < 0 {
+		slog.Error("max-records-per-refresh must not be negative", "max-records-per-refresh", *maxRecords)
+		os.Exit(1)
+	}
+	if *co2AlertAt < 0 || *co2AlertHyst < 0 {
+		slog.Error("co2-alert-threshold and co2-alert-hysteresis must not be negative", "co2-alert-threshold", *co2AlertAt, "co2-alert-hysteresis", *co2AlertHyst)
+		os.Exit(1)
+	}
+	if *co2AlertAt > 0 && *co2AlertURL == "" {
+		slog.Error("-co2-alert-threshold requires -co2-alert-webhook")
+		os.Exit(1)
+	}
+	if *battAlertAt < 0 || *battAlertHyst < 0 {
+		slog.Error("battery-alert-percent and battery-alert-hysteresis must not be negative", "battery-alert-percent", *battAlertAt, "battery-alert-hysteresis", *battAlertHyst)
+		os.Exit(1)
+	}
+	if *battAlertAt > 0 && *battAlertURL == "" {
+		slog.Error("-battery-alert-percent requires -battery-alert-webhook")
+		os.Exit(1)
+	}
+	if *readyAge < 0 {
+		slog.Error("ready-max-age must not be negative", "ready-max-age", *readyAge)
+		os.Exit(1)
+	}
+	if *maxFails < 0 {
+		slog.Error("max-consecutive-failures must not be negative", "max-consecutive-failures", *maxFails)
+		os.Exit(1)
+	}
+	if *startDelay < 0 || *startJitter < 0 {
+		slog.Error("startup delay and jitter must not be negative", "startup-delay", *startDelay, "startup-jitter", *startJitter)
 		os.Exit(1)
 	}
 	if *interval <= 0 {
@@ -67,50 +273,343 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *deviceConc <= 0 {
+		slog.Error("device-concurrency must be greater than 0", "device-concurrency", *deviceConc)
+		os.Exit(1)
+	}
+	if *lookback <= 0 {
+		slog.Error("dedup-lookback must be greater than 0", "dedup-lookback", *lookback)
+		os.Exit(1)
+	}
+	if *futureSkew <= 0 {
+		slog.Error("prometheus-max-future-skew must be greater than 0", "prometheus-max-future-skew", *futureSkew)
+		os.Exit(1)
+	}
+	if *stateMaxAge < 0 {
+		slog.Error("prometheus-state-max-age must not be negative", "prometheus-state-max-age", *stateMaxAge)
+		os.Exit(1)
+	}
+	if *connRetries < 0 || *connBackoff <= 0 {
+		slog.Error("connect-retries must not be negative and connect-backoff must be greater than 0", "connect-retries", *connRetries, "connect-backoff", *connBackoff)
+		os.Exit(1)
+	}
+	if *autoReset && *resetAfter <= 0 {
+		slog.Error("adapter-reset-after must be greater than 0", "adapter-reset-after", *resetAfter)
+		os.Exit(1)
+	}
+	if *shutdownMarker && *sinkType != "prometheus" {
+		// The marker is written concurrently with refreshes, which only
+		// the Prometheus sink supports.
+		slog.Error("-shutdown-marker is only supported with the prometheus sink", "sink", *sinkType)
+		os.Exit(1)
+	}
+	if *heartbeatValue != "timestamp" && *heartbeatValue != "one" {
+		slog.Error("invalid heartbeat value", "heartbeat-value", *heartbeatValue)
+		os.Exit(1)
+	}
+
+	if *scanTimeout <= 0 || *scanRetries < 0 {
+		slog.Error("scan-timeout must be greater than 0 and scan-retries must not be negative", "scan-timeout", *scanTimeout, "scan-retries", *scanRetries)
+		os.Exit(1)
+	}
+	if *passkeyWait <= 0 {
+		slog.Error("passkey-timeout must be greater than 0", "passkey-timeout", *passkeyWait)
+		os.Exit(1)
+	}
 	if *passkeyMode != "auto" && *passkeyMode != "web" && *passkeyMode != "terminal" {
 		slog.Error("invalid passkey mode", "passkey-mode", *passkeyMode)
 		os.Exit(1)
 	}
+	if *passkeyFlag != "" {
+		if _, err := parsePasskey(*passkeyFlag); err != nil {
+			// The passkey itself is not logged.
+			slog.Error("invalid passkey", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	prom, err := promsync.New(promsync.Config{
-		PrometheusEndpoint: *promEndpoint,
-		MetricPrefix:       *metricPrefix,
-		Labels: map[string]string{
-			"job":         *jobName,
-			"instance":    *instanceName,
-			"device_addr": *deviceAddr,
-		},
-		DryRun: *dryRun,
-	})
-	if err != nil {
-		slog.Error("failed to create Prometheus syncer", "error", err)
-		os.Exit(1)
+	if *tailMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := tail(ctx, os.Stdout)
+		stop()
+		if err != nil {
+			slog.Error("failed to print readings", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	slog.Info("starting Aranet4 Prometheus collector", "device-addr", *deviceAddr, "listen", *listen)
-	c, err := newCollector(prom)
-	if err != nil {
-		slog.Error("failed to create collector", "error", err)
+	// Each device gets its own sink, so that its metrics carry its address.
+	var sinks []Sink
+	for _, addr := range deviceAddrs {
+		labels, err := builtinLabels(addr)
+		if err != nil {
+			slog.Error("invalid labels", "error", err)
+			os.Exit(1)
+		}
+		sink, err := newSink(labels, deviceRegisterer(addr))
+		if err != nil {
+			slog.Error("failed to create sink", "sink", *sinkType, "error", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if *validateOnly {
+		if !validate(sinks[0], deviceAddrs) {
+			os.Exit(1)
+		}
+		slog.Info("all checks passed")
+		return
+	}
+
+	slog.Info("starting Aranet4 Prometheus collector", "device-addr", deviceAddrs.String(), "listen", *listen, "sink", *sinkType)
+	var collectors []*collector
+	slots := make(chan struct{}, *deviceConc)
+	for i, addr := range deviceAddrs {
+		c, err := newCollector(sinks[i], addr, deviceRegisterer(addr))
+		if err != nil {
+			slog.Error("failed to create collector", "device-addr", addr, "error", err)
+			os.Exit(1)
+		}
+		c.slots = slots
+		if *mqttBroker != "" {
+			if c.mqtt, err = newMQTTPublisher(addr); err != nil {
+				slog.Error("failed to configure MQTT", "error", err)
+				os.Exit(1)
+			}
+		}
+		if *co2AlertAt > 0 {
+			c.co2Alert = &alert{
+				field:      "co2",
+				webhook:    *co2AlertURL,
+				threshold:  float64(*co2AlertAt),
+				hysteresis: float64(*co2AlertHyst),
+			}
+		}
+		if *battAlertAt > 0 {
+			c.batteryAlert = &alert{
+				field:      "battery",
+				webhook:    *battAlertURL,
+				threshold:  float64(*battAlertAt),
+				hysteresis: float64(*battAlertHyst),
+				below:      true,
+				oneShot:    true,
+			}
+		}
+		if *otlpURL != "" {
+			if c.otlp, err = newOTLPSink(addr); err != nil {
+				slog.Error("failed to configure OTLP", "error", err)
+				os.Exit(1)
+			}
+		}
+		collectors = append(collectors, c)
+	}
+	// The web server shows the first device. It is started before the first
+	// refresh, which can take minutes, so that health checks and the web
+	// passkey prompt for pairing are available in the meantime.
+	if err := collectors[0].serve(collectors); err != nil {
+		slog.Error("failed to start web server", "error", err)
 		os.Exit(1)
 	}
 
-	c.loop()
+	for _, sink := range sinks {
+		if *skewWarning > 0 {
+			checkClockSkew(sink)
+		}
+		if *dedupConc > 0 {
+			warmup(sink)
+		}
+	}
+
+	// Installed before the first refresh, so that a signal during the first
+	// read still marks the devices down.
+	if *shutdownMarker && !*planMode {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		go markShutdown(ctx, stop, collectors)
+	}
+
+	// Stagger the first refresh, unless we are only running once.
+	if delay := startupDelay(); delay > 0 && !*planMode {
+		slog.Info("delaying first refresh", "delay", delay)
+		time.Sleep(delay)
+	}
+	if wait := time.Until(activeHours.nextActive(time.Now())); wait > 0 && !*planMode {
+		slog.Info("outside of active hours, delaying first refresh", "active-hours", activeHours.String(), "wait_for", wait)
+		time.Sleep(wait)
+	}
+
+	// Each device does its own first refresh, bounded by -device-concurrency
+	// like later ones, so that a slow or unreachable device doesn't hold back
+	// the others.
+	single := len(collectors) == 1
+	if *planMode {
+		var wg sync.WaitGroup
+		for _, c := range collectors {
+			wg.Go(func() { c.firstRefresh(single) })
+		}
+		wg.Wait()
+		return
+	}
+	for _, c := range collectors[1:] {
+		go func() {
+			c.firstRefresh(single)
+			c.loop()
+		}()
+	}
+	collectors[0].firstRefresh(single)
+	collectors[0].loop()
+}
+
+// firstRefresh refreshes once to get the initial data. If exitOnError is set,
+// a failure exits; otherwise, as with several devices, a device that can't be
+// read is retried by its loop instead of stopping the others.
+func (c *collector) firstRefresh(exitOnError bool) {
+	err := c.refresh()
+	c.writeHeartbeat(err)
+	c.writeDeviceUp(err)
+	if err != nil && exitOnError {
+		slog.Error("failed to refresh", "error", err)
+		os.Exit(1)
+	} else if err != nil {
+		slog.Error("failed to refresh", "device-addr", c.addr, "error", err)
+	}
 }
 
 type collector struct {
-	prom *promsync.Syncer
+	sink Sink
+
+	// addr is the MAC address of the device.
+	addr string
+
+	// reg is the registry of the collector's metrics.
+	reg prometheus.Registerer
+
+	// slots bounds how many collectors refresh at the same time. It is
+	// shared by the collectors of all devices, and nil in tests.
+	slots chan struct{}
+
+	// readFn reads the latest data and all historic data from the device.
+	// It is c.readData, except in tests. A nil slice of historic data means
+	// that history was not read.
+	readFn func(ctx context.Context) (latest *aranet4.Data, all []aranet4.Data, _ error)
+
+	// connMu guards conn and disconnect, the connection kept open between
+	// refreshes with -persistent-connection.
+	connMu     sync.Mutex
+	conn       *aranet4.Device
+	disconnect func()
+
 	// tmpl is the template for the status page.
 	tmpl *template.Template
 
 	// lastSuccess is the last time the collector successfully refreshed data.
 	lastSuccess syncs.AtomicValue[time.Time]
 
+	// registerLastSuccess registers the last success time metric after the
+	// first successful refresh.
+	registerLastSuccess sync.Once
+
 	// lastReported is the timestamp of the last reported measurement.
 	lastReported syncs.AtomicValue[time.Time]
 
 	// attempts is a histogram of refresh latencies.
 	attempts *prometheus.HistogramVec
 
+	// measurementInterval is the measurement interval configured on the device.
+	measurementInterval prometheus.Gauge
+
+	// observedInterval is the median gap between consecutive historic records.
+	observedInterval prometheus.Gauge
+
+	// historyGap is the largest gap between consecutive historic records, or
+	// between the last reported record and the oldest one read, as of the
+	// last refresh.
+	historyGap prometheus.Gauge
+
+	// historySpan and historyRecords describe the history stored on the
+	// device as of the last refresh.
+	historySpan    prometheus.Gauge
+	historyRecords prometheus.Gauge
+
+	// teardownTimeouts counts BLE teardown steps abandoned after teardownTimeout.
+	teardownTimeouts prometheus.Counter
+
+	// writeLatency is a histogram of the age of newly written records.
+	writeLatency prometheus.Histogram
+
+	// recordsWritten and recordsDeduped are the number of historic records
+	// written and skipped as duplicates in the last refresh.
+	recordsWritten prometheus.Gauge
+	recordsDeduped prometheus.Gauge
+
+	// measurements counts measurements taken by the device, derived from the
+	// historic records newer than newestRecord seen on each refresh.
+	measurements prometheus.Counter
+	newestRecord time.Time
+
+	// futureRecords counts historic records skipped due to their timestamp
+	// being too far in the future.
+	futureRecords prometheus.Counter
+
+	// recordsCapped counts historic records skipped due to -max-records-per-refresh.
+	recordsCapped prometheus.Counter
+
+	// connectFailures is the number of consecutive refreshes that failed to
+	// connect, however many retries each of them made. It is only accessed
+	// from refresh, which never runs concurrently.
+	connectFailures int
+
+	// lastAdapter is the HCI socket ID that last connected to the device.
+	// Like connectFailures, it is only accessed from refresh.
+	lastAdapter int
+
+	// adapterReads counts successful reads by adapter.
+	adapterReads *prometheus.CounterVec
+
+	// httpRequests counts web server requests by path, method and status.
+	httpRequests *prometheus.CounterVec
+
+	// listenAddr is the address the web server is listening on, which differs
+	// from -listen if it has no port or port 0.
+	listenAddr string
+
+	// listenPort is a gauge of the port the web server is listening on.
+	listenPort prometheus.Gauge
+
+	// connections counts connection attempts by outcome: success,
+	// connect_failed, or setup_failed if pairing or encryption failed.
+	connections *prometheus.CounterVec
+
+	// pairings counts pairing attempts made because no bond was found.
+	pairings prometheus.Counter
+
+	// infoMetric is set to 1 for the firmware, hardware and serial number of
+	// the device from the last successful read.
+	infoMetric *prometheus.GaugeVec
+
+	// adapterResets counts Bluetooth adapter resets by status.
+	adapterResets *prometheus.CounterVec
+
+	// mqtt publishes the latest reading with -mqtt-broker.
+	mqtt *mqttPublisher
+
+	// otlp also exports all metrics with -otlp-endpoint.
+	otlp *otlpsink.Sink
+
+	// co2Alert posts a webhook when CO2 crosses -co2-alert-threshold.
+	co2Alert *alert
+
+	// batteryAlert posts a webhook when the battery drops below
+	// -battery-alert-percent, and re-arms once it recovers.
+	batteryAlert *alert
+
+	// latest is the latest reading from the last successful refresh.
+	latest syncs.AtomicValue[*aranet4.Data]
+
+	// deviceInfo is the device metadata from the last successful read.
+	deviceInfo syncs.AtomicValue[*deviceInfo]
+
 	// passkeyChan is a channel for passing the passkey to the collector.
 	passkeyChan syncs.AtomicValue[chan int]
 
@@ -118,48 +617,229 @@ type collector struct {
 	refreshChan chan bool
 }
 
-// newCollector creates a new collector and attemots a first sync.
-func newCollector(prom *promsync.Syncer) (*collector, error) {
-	tmpl, err := template.ParseFS(staticFiles, "index.html")
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse template: %w", err)
-	}
-
+// newCollectorWithRegistry creates a collector with its metrics registered
+// in reg, without starting the HTTP server or refreshing data.
+func newCollectorWithRegistry(sink Sink, reg prometheus.Registerer) *collector {
+	f := promauto.With(reg)
 	c := &collector{
-		prom: prom,
-		tmpl: tmpl,
-		attempts: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		sink: sink,
+		reg:  reg,
+		attempts: f.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    *metricPrefix + "refresh_latencies_seconds",
 			Help:    "Latencies of refresh attempts.",
 			Buckets: prometheus.ExponentialBucketsRange(1, 120, 5),
 		}, []string{"status"}),
+		measurementInterval: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "measurement_interval_seconds",
+			Help: "Measurement interval configured on the device.",
+		}),
+		observedInterval: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "observed_interval_seconds",
+			Help: "Median interval between consecutive historic records read from the device.",
+		}),
+		historyGap: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "history_gap_seconds",
+			Help: "Largest gap in the historic records read from the device, longer than the measurement interval.",
+		}),
+		historySpan: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "history_span_seconds",
+			Help: "Time between the oldest and the newest historic record stored on the device.",
+		}),
+		historyRecords: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "history_record_count",
+			Help: "Number of historic records stored on the device.",
+		}),
+		teardownTimeouts: f.NewCounter(prometheus.CounterOpts{
+			Name: *metricPrefix + "ble_teardown_timeouts_total",
+			Help: "Total number of Bluetooth teardown steps that timed out.",
+		}),
+		adapterResets: f.NewCounterVec(prometheus.CounterOpts{
+			Name: *metricPrefix + "adapter_resets_total",
+			Help: "Total number of Bluetooth adapter resets by status.",
+		}, []string{"status"}),
+		adapterReads: f.NewCounterVec(prometheus.CounterOpts{
+			Name: *metricPrefix + "adapter_reads_total",
+			Help: "Total number of successful device reads by Bluetooth adapter.",
+		}, []string{"adapter"}),
+		connections: f.NewCounterVec(prometheus.CounterOpts{
+			Name: *metricPrefix + "connection_attempts_total",
+			Help: "Total number of attempts to connect to the device by outcome.",
+		}, []string{"outcome"}),
+		pairings: f.NewCounter(prometheus.CounterOpts{
+			Name: *metricPrefix + "pairings_total",
+			Help: "Total number of attempts to pair with the device because no bond was found.",
+		}),
+		infoMetric: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name: *metricPrefix + "device_info",
+			Help: "Device firmware, hardware and serial number, as labels of a constant 1.",
+		}, []string{"firmware", "hardware", "serial"}),
+		listenPort: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "http_listen_port",
+			Help: "The port the web server is listening on.",
+		}),
+		httpRequests: f.NewCounterVec(prometheus.CounterOpts{
+			Name: *metricPrefix + "http_requests_total",
+			Help: "Total number of HTTP requests to the web server by path, method and status.",
+		}, []string{"path", "method", "status"}),
+		writeLatency: f.NewHistogram(prometheus.HistogramOpts{
+			Name:    *metricPrefix + "measurement_to_write_latency_seconds",
+			Help:    "Time between a measurement being taken and it being written, for newly written records.",
+			Buckets: prometheus.ExponentialBucketsRange(60, 7*24*3600, 10),
+		}),
+		recordsWritten: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "last_refresh_records_written",
+			Help: "Number of historic records written in the last refresh.",
+		}),
+		recordsDeduped: f.NewGauge(prometheus.GaugeOpts{
+			Name: *metricPrefix + "last_refresh_records_deduped",
+			Help: "Number of historic records skipped as already written in the last refresh.",
+		}),
+		measurements: f.NewCounter(prometheus.CounterOpts{
+			Name: *metricPrefix + "measurements_total",
+			Help: "Total number of measurements taken by the device since the collector started, counting all stored history on the first read.",
+		}),
+		futureRecords: f.NewCounter(prometheus.CounterOpts{
+			Name: *metricPrefix + "future_records_skipped_total",
+			Help: "Total number of historic records skipped because their timestamp is too far in the future.",
+		}),
+		recordsCapped: f.NewCounter(prometheus.CounterOpts{
+			Name: *metricPrefix + "records_capped_total",
+			Help: "Total number of historic records skipped due to the per-refresh record limit.",
+		}),
 		refreshChan: make(chan bool),
+		lastAdapter: hciSocketIDs[0],
+	}
+	c.readFn = c.readData
+	f.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: *metricPrefix + "active",
+		Help: "Whether scheduled refreshes are currently active (1) or paused by -active-hours (0).",
+	}, func() float64 {
+		if activeHours.contains(time.Now()) {
+			return 1
+		}
+		return 0
+	})
+	return c
+}
+
+// newCollector creates a collector for the device with the given address,
+// with its metrics registered in reg.
+func newCollector(sink Sink, addr string, reg prometheus.Registerer) (*collector, error) {
+	tmpl, err := template.ParseFS(staticFiles, "index.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	c := newCollectorWithRegistry(sink, reg)
+	c.addr = addr
+	c.tmpl = tmpl
+	if *exposeLatest {
+		labels, err := builtinLabels(addr)
+		if err == nil {
+			labels, err = mergeLabels(labels)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels: %w", err)
+		}
+		// The readings carry the device label already, so they are
+		// registered without the device label of reg.
+		prometheus.MustRegister(&readingsCollector{c: c, labels: labels})
 	}
+	return c, nil
+}
+
+// serve starts the web server. Readiness is reported for all devices.
+func (c *collector) serve(devices []*collector) error {
 	http.Handle("/", c)
+	http.HandleFunc("/api/device/info", c.handleDeviceInfo)
+	http.HandleFunc("/api/annotation", c.handleAnnotation)
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", handleHealthz)
+	http.Handle("/readyz", readyzHandler(devices))
+	if *debugAPI {
+		http.HandleFunc("/api/debug/reset-dedup", c.handleResetDedup)
+	}
+	handler := instrumentHandler(http.DefaultServeMux, c.httpRequests, http.DefaultServeMux)
+	if *compress {
+		handler = gzipHandler(handler)
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	c.listenAddr = ln.Addr().String()
+	if _, port, err := net.SplitHostPort(c.listenAddr); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			c.listenPort.Set(float64(p))
+		}
+	}
+	slog.Info("web server listening", "listen", *listen, "addr", c.listenAddr)
 	go func() {
-		slog.Error("http.ListenAndServe", "error", http.ListenAndServe(*listen, nil))
+		slog.Error("http.Serve", "error", http.Serve(ln, handler))
 		os.Exit(1)
 	}()
+	return nil
+}
 
-	// Refresh once immediately to get the initial data.
-	if err := c.refresh(); err != nil {
-		return nil, fmt.Errorf("failed to refresh: %w", err)
+// checkClockSkew logs a warning if the clock of the sink differs from the
+// local clock by more than -clock-skew-warning. Samples are rejected as too far
+// in the future or past based on the sink's clock, so a drifting host clock can
+// cause writes to fail for no apparent reason.
+func checkClockSkew(sink Sink) {
+	skewer, ok := sink.(clockSkewer)
+	if !ok {
+		slog.Warn("sink does not support measuring clock skew", "sink", *sinkType)
+		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	skew, err := skewer.ClockSkew(ctx)
+	if err != nil {
+		slog.Error("failed to measure clock skew", "error", err)
+		return
+	}
+	if skew.Abs() > *skewWarning {
+		slog.Warn("sink clock differs from local clock", "skew", skew, "threshold", *skewWarning)
+		return
+	}
+	slog.Debug("measured clock skew", "skew", skew)
+}
 
-	// Only report last success time metric if we've successfully refreshed data.
-	promauto.NewGaugeFunc(prometheus.GaugeOpts{
-		Name: *metricPrefix + "last_success_time_seconds",
-		Help: "The last time the collector successfully refreshed data.",
-	}, func() float64 {
-		return float64(c.lastSuccess.Load().Unix())
-	})
+// warmup looks up the last reported times of all metrics with -dedup-concurrency
+// queries at a time. Failed lookups are retried when the metrics are reported.
+func warmup(sink Sink) {
+	w, ok := sink.(warmer)
+	if !ok {
+		slog.Warn("sink does not support -dedup-concurrency", "sink", *sinkType)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	t0 := time.Now()
+	names := append(metricNames(recordMetrics), metricNames(latestMetrics)...)
+	if err := w.Warmup(ctx, names); err != nil {
+		slog.Warn("failed to look up last written samples", "error", err)
+		return
+	}
+	slog.Info("looked up last written samples", "metrics", len(names), "duration", time.Since(t0))
+}
 
-	return c, nil
+// startupDelay returns the delay before the first refresh.
+func startupDelay() time.Duration {
+	delay := *startDelay
+	if *startJitter > 0 {
+		delay += rand.N(*startJitter)
+	}
+	return delay
 }
 
-// loop regularly refreshes data.
+// loop regularly refreshes data, or keeps a subscription open with -subscribe.
 func (c *collector) loop() {
+	if *subscribeMode {
+		c.subscribe()
+	}
+
+	failures := 0
 	for {
 		waitFor := time.Until(c.lastSuccess.Load().Add(*interval))
 		if waitFor > 0 {
@@ -168,6 +848,12 @@ func (c *collector) loop() {
 			// Keep retrying more aggressively if we're behind schedule.
 			waitFor = time.Second
 		}
+		// Scheduled refreshes are skipped outside of active hours; history
+		// is backfilled on the first refresh after the window starts.
+		if next := activeHours.nextActive(time.Now().Add(waitFor)); time.Until(next) > waitFor {
+			waitFor = time.Until(next)
+			slog.Info("outside of active hours, waiting", "active-hours", activeHours.String(), "wait_for", waitFor)
+		}
 
 		// Wait for timer, or for a refresh request.
 		select {
@@ -175,14 +861,113 @@ func (c *collector) loop() {
 		case <-c.refreshChan:
 		}
 
-		if err := c.refresh(); err != nil {
-			slog.Error("failed to refresh", "error", err)
+		err := c.refresh()
+		c.writeHeartbeat(err)
+		c.writeDeviceUp(err)
+		if err != nil {
+			failures++
+			slog.Error("failed to refresh", "error", err, "consecutive_failures", failures)
+			if *maxFails > 0 && failures >= *maxFails {
+				slog.Error("too many consecutive failures; exiting", "max-consecutive-failures", *maxFails)
+				os.Exit(1)
+			}
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// writeHeartbeat writes the heartbeat metric after a refresh attempt, if enabled.
+// Its timestamp always advances, so it is never skipped as a duplicate.
+func (c *collector) writeHeartbeat(refreshErr error) {
+	if !*heartbeat || (refreshErr != nil && !*heartbeatOnFailure) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	now := time.Now()
+	value := float64(now.Unix())
+	if *heartbeatValue == "one" {
+		value = 1
+	}
+	if err := c.sink.ReportMetric(ctx, "heartbeat", now, value); err != nil {
+		slog.Error("failed to write heartbeat", "error", err)
+		return
+	}
+	if f, ok := c.sink.(flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			slog.Error("failed to flush heartbeat", "error", err)
+		}
+	}
+}
+
+// writeDeviceUp writes the device_up metric after a refresh attempt, if
+// -shutdown-marker is set: 1 if the refresh succeeded and 0 if it failed.
+func (c *collector) writeDeviceUp(refreshErr error) {
+	if !*shutdownMarker {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	up := 1.0
+	if refreshErr != nil {
+		up = 0
+	}
+	if err := c.sink.ReportMetric(ctx, "device_up", time.Now(), up); err != nil {
+		slog.Error("failed to write device_up", "error", err)
+		return
+	}
+	if f, ok := c.sink.(flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			slog.Error("failed to flush device_up", "error", err)
 		}
 	}
 }
 
-// refresh runs a single attempt to pull data from Aranet and report it to Prometheus.
-func (c *collector) refresh() (retErr error) {
+// shutdownTimeout bounds writing device_up on shutdown, so that a slow sink
+// doesn't delay stopping the collector.
+const shutdownTimeout = 5 * time.Second
+
+// markShutdown waits for ctx, notified of SIGTERM or an interrupt, to be done,
+// writes device_up 0 for all devices so that dashboards show the planned outage
+// straight away, and exits. stop stops the notifications.
+func markShutdown(ctx context.Context, stop context.CancelFunc, collectors []*collector) {
+	<-ctx.Done()
+	// A second signal stops the collector without waiting.
+	stop()
+	slog.Info("shutting down, writing device_up 0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, c := range collectors {
+		c.closeConn()
+		if err := c.sink.ReportMetric(ctx, "device_up", time.Now(), 0); err != nil {
+			slog.Error("failed to write device_up on shutdown", "device-addr", c.addr, "error", err)
+		}
+		if f, ok := c.sink.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				slog.Error("failed to flush device_up on shutdown", "device-addr", c.addr, "error", err)
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+// refresh runs a single attempt to pull data from Aranet and report it to
+// Prometheus, once fewer than -device-concurrency other devices are refreshing.
+func (c *collector) refresh() error {
+	if c.slots != nil {
+		c.slots <- struct{}{}
+		defer func() { <-c.slots }()
+	}
+	return c.refreshWith(c.readFn)
+}
+
+// refreshWith runs a single refresh attempt, reading data with readFn. If it
+// returns no historic data, the latest measurement is reported as the only
+// historic record.
+func (c *collector) refreshWith(readFn func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error)) (retErr error) {
 	t0 := time.Now()
 
 	// There's no way to pass a real timeout to the ble library, so we just end
@@ -202,6 +987,11 @@ func (c *collector) refresh() (retErr error) {
 		status := "success"
 		if retErr != nil {
 			status = "error"
+			// Don't leave writes of the failed refresh running into the
+			// next one.
+			if a, ok := c.sink.(aborter); ok {
+				a.Abort()
+			}
 		}
 		c.attempts.WithLabelValues(status).Observe(time.Since(t0).Seconds())
 	}()
@@ -210,90 +1000,531 @@ func (c *collector) refresh() (retErr error) {
 
 	// We only use the latest data for reporting battery level,
 	// since it's not stored in the historic data.
-	latest, all, err := c.readData(ctx)
+	if *lockThread {
+		readFn = onLockedThread(readFn)
+	}
+	latest, all, err := readFn(ctx)
 	if err != nil {
 		return fmt.Errorf("reading data: %w", err)
 	}
-	slog.Info("Read data from Aranet4", "battery_level", latest.Battery, "num_historic_records", len(all))
-
-	if latest.Battery > -1 {
-		if err := c.prom.ReportMetric(ctx, "battery_level_percent", latest.Time, float64(latest.Battery)); err != nil {
-			return fmt.Errorf("reporting battery level: %w", err)
+	slog.Info("Read data from Aranet4", "device-addr", c.addr, "battery_level", latest.Battery, "num_historic_records", len(all))
+	if *alignTimes > 0 {
+		if err := alignTimestamps(latest, all, *alignTimes); err != nil {
+			return err
 		}
 	}
+	// Alerts only depend on the reading, so an outage of the sink doesn't
+	// hold them back.
+	if !*dryRun {
+		c.evaluateAlerts(ctx, latest)
+	}
 
+	metrics := latestMetrics
+	if *reportBatt {
+		metrics = append(slices.Clone(metrics), batteryAvailableMetric)
+	}
+	if err := c.reportMetrics(ctx, latest, metrics); err != nil {
+		return fmt.Errorf("reporting latest data: %w", err)
+	}
+
+	history := all != nil
+	if !history {
+		all = []aranet4.Data{*latest}
+	}
 	if len(all) == 0 {
 		return fmt.Errorf("no historic records returned")
 	}
 	slices.SortFunc(all, func(a, b aranet4.Data) int {
 		return a.Time.Compare(b.Time)
 	})
-	var lastReported time.Time
+	if latest.Interval > 0 {
+		c.measurementInterval.Set(latest.Interval.Seconds())
+	}
+	if observed := medianInterval(all); observed > 0 {
+		c.observedInterval.Set(observed.Seconds())
+	}
+	if history {
+		interval := latest.Interval
+		if interval <= 0 {
+			interval = medianInterval(all)
+		}
+		n, largest := historyGaps(c.lastReported.Load(), all, interval)
+		if n > 0 {
+			slog.Info("gaps in historic records", "device-addr", c.addr, "num_gaps", n, "largest_gap", largest, "interval", interval)
+		}
+		c.historyGap.Set(largest.Seconds())
+	}
+	c.countMeasurements(all)
+	numRecords, span := len(all), historySpan(all)
+	// Only records newer than the last reported one count against the cap,
+	// so that a full device history is not capped on every refresh.
+	newer := all
+	if last := c.lastReported.Load(); !last.IsZero() {
+		i := slices.IndexFunc(all, func(d aranet4.Data) bool { return d.Time.After(last) })
+		if i < 0 {
+			i = len(all)
+		}
+		newer = all[i:]
+	}
+	if *maxRecords > 0 && len(newer) > *maxRecords {
+		skipped := len(newer) - *maxRecords
+		slog.Warn("too many new historic records, only reporting the newest ones", "num_records", len(newer), "skipped", skipped, "max_records", *maxRecords)
+		c.recordsCapped.Add(float64(skipped))
+		all = newer[skipped:]
+	}
+	var plan recordPlan
+	if *planMode {
+		plan = recordPlan{}
+	}
+	var lastReported, prev time.Time
+	var numWritten, numDeduped int
+	// Written records are only observed once the sink has flushed them, so
+	// that the latency measures when they land rather than when they were
+	// buffered, and records of failed refreshes are not observed twice.
+	var writtenTimes []time.Time
 	for _, data := range all {
+		if !data.Time.IsZero() && data.Time.Equal(prev) {
+			slog.Debug("duplicate timestamp, skipping", "data", data)
+			continue
+		}
+		prev = data.Time
 		if data.Time.IsZero() {
 			slog.Warn("unexpected time value, skipping", "data", data)
+			plan.add(&data, planSkipInvalid)
 			continue
 		}
-		if data.CO2 <= 0 {
-			slog.Warn("unexpected CO2 value, skipping", "data", data)
+		if name := invalidMetric(&data, recordMetrics); name != "" {
+			slog.Warn("unexpected value, skipping", "metric", name, "data", data)
+			plan.add(&data, planSkipInvalid)
 			continue
 		}
-		if data.P <= 0 {
-			slog.Warn("unexpected pressure value, skipping", "data", data)
+		if plan != nil {
+			action, err := c.planRecord(ctx, &data)
+			if err != nil {
+				return fmt.Errorf("planning data %v: %w", data, err)
+			}
+			slog.Debug("planned record", "action", action, "data", data)
+			plan.add(&data, action)
 			continue
 		}
+		// Sinks that support planning tell us whether the record is new.
+		deduped := false
+		if _, ok := c.sink.(planner); ok {
+			action, err := c.planRecord(ctx, &data)
+			if err != nil {
+				return fmt.Errorf("checking data %v: %w", data, err)
+			}
+			deduped = action == promsync.PlanSkipDuplicate
+		}
 		slog.Debug("reporting new record", "data", data)
-		if err := c.reportMetrics(ctx, &data); err != nil {
+		if err := c.reportMetrics(ctx, &data, recordMetrics); err != nil {
+			if *futureRecords == "skip" && isFutureTimestamp(err) {
+				// Usually caused by device clock drift; don't let one record fail the batch.
+				slog.Warn("timestamp too far in the future, skipping", "data", data, "error", err)
+				c.futureRecords.Inc()
+				continue
+			}
 			return fmt.Errorf("reporting data %v: %w", data, err)
 		}
+		if deduped {
+			numDeduped++
+		} else {
+			numWritten++
+			writtenTimes = append(writtenTimes, data.Time)
+		}
 		lastReported = data.Time
 	}
+	if plan != nil {
+		return plan.print(os.Stdout)
+	}
+	if f, ok := c.sink.(flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			return fmt.Errorf("flushing sink: %w", err)
+		}
+	}
+	for _, ts := range writtenTimes {
+		c.writeLatency.Observe(time.Since(ts).Seconds())
+	}
+	if c.otlp != nil {
+		// Exporting is best effort, and doesn't fail the refresh.
+		if err := c.otlp.Flush(ctx); err != nil {
+			slog.Warn("failed to export metrics via OTLP", "error", err)
+		}
+	}
+	if c.mqtt != nil && !*dryRun {
+		// Publishing is best effort, and doesn't fail the refresh.
+		if err := c.mqtt.Publish(ctx, latest); err != nil {
+			slog.Warn("failed to publish to MQTT", "error", err)
+		}
+	}
+	if history {
+		c.historyRecords.Set(float64(numRecords))
+		c.historySpan.Set(span.Seconds())
+	}
+	c.recordsWritten.Set(float64(numWritten))
+	c.recordsDeduped.Set(float64(numDeduped))
 	if !lastReported.IsZero() {
 		c.lastReported.Store(lastReported)
 	}
+	c.latest.Store(latest)
 	c.lastSuccess.Store(time.Now())
+	// Only report last success time metric if we've successfully refreshed data.
+	c.registerLastSuccess.Do(func() {
+		promauto.With(c.reg).NewGaugeFunc(prometheus.GaugeOpts{
+			Name: *metricPrefix + "last_success_time_seconds",
+			Help: "The last time the collector successfully refreshed data.",
+		}, func() float64 {
+			return float64(c.lastSuccess.Load().Unix())
+		})
+	})
 	return nil
 }
 
-// readData reads the latest data and all historic data from Aranet4.
+// alignTimestamps places measurement timestamps on the grid of the device's
+// measurements: multiples of the measurement interval, offset by the phase of
+// the latest measurement rounded to d. d must evenly divide the interval, so
+// that the phase stays on the same grid, and records never collapse onto the
+// same timestamp.
+//
+// The device only reports how long ago its last measurement was taken, so
+// record times are reconstructed from the local clock at the time of the read
+// and differ slightly between reads. Anchoring them to the measurements makes
+// collectors reading the same device agree on timestamps (unless their phase
+// estimates straddle a multiple of d), so that they write the same samples
+// rather than near-duplicates.
+func alignTimestamps(latest *aranet4.Data, all []aranet4.Data, d time.Duration) error {
+	interval := latest.Interval
+	if interval <= 0 {
+		// Without an interval there is no grid to align to.
+		return nil
+	}
+	if d > interval || interval%d != 0 {
+		return fmt.Errorf("-align-timestamps=%v does not evenly divide the measurement interval %v", d, interval)
+	}
+	phase := latest.Time.Sub(latest.Time.Truncate(interval)).Round(d) % interval
+	align := func(t time.Time) time.Time {
+		return t.Add(-phase).Round(interval).Add(phase)
+	}
+	latest.Time = align(latest.Time)
+	for i := range all {
+		if !all[i].Time.IsZero() {
+			all[i].Time = align(all[i].Time)
+		}
+	}
+	return nil
+}
+
+// countMeasurements adds historic records newer than any seen before to the
+// measurements counter. Records must be sorted by time.
+func (c *collector) countMeasurements(all []aranet4.Data) {
+	n := 0
+	for _, data := range all {
+		// Historic timestamps are reconstructed relative to the current time,
+		// so the same record can move slightly between reads.
+		if data.Time.After(c.newestRecord.Add(data.Interval / 2)) {
+			n++
+		}
+	}
+	if n > 0 {
+		c.measurements.Add(float64(n))
+		c.newestRecord = all[len(all)-1].Time
+	}
+}
+
+// historySpan returns the time between the oldest and the newest record, which
+// must be sorted by time. Records with zero timestamps are ignored.
+func historySpan(all []aranet4.Data) time.Duration {
+	i := slices.IndexFunc(all, func(d aranet4.Data) bool { return !d.Time.IsZero() })
+	if i < 0 {
+		return 0
+	}
+	return all[len(all)-1].Time.Sub(all[i].Time)
+}
+
+// historyGaps returns the number of gaps longer than the measurement interval
+// between consecutive records, which must be sorted by time, and the largest
+// of them. If since is not zero, a gap between it and the oldest record is
+// counted too: the device overwrote records before they could be reported.
+// Records with zero timestamps are ignored.
+func historyGaps(since time.Time, all []aranet4.Data, interval time.Duration) (n int, largest time.Duration) {
+	if interval <= 0 {
+		return 0, 0
+	}
+	// Historic timestamps are reconstructed, so allow for some jitter.
+	threshold := interval + interval/2
+	prev := since
+	for _, data := range all {
+		if data.Time.IsZero() {
+			continue
+		}
+		if gap := data.Time.Sub(prev); !prev.IsZero() && gap > threshold {
+			n++
+			largest = max(largest, gap)
+		}
+		prev = data.Time
+	}
+	return n, largest
+}
+
+// medianInterval returns the median gap between consecutive records, which
+// must be sorted by time. Records with zero timestamps are ignored.
+func medianInterval(all []aranet4.Data) time.Duration {
+	var gaps []time.Duration
+	var prev time.Time
+	for _, data := range all {
+		if data.Time.IsZero() {
+			continue
+		}
+		if !prev.IsZero() {
+			gaps = append(gaps, data.Time.Sub(prev))
+		}
+		prev = data.Time
+	}
+	if len(gaps) == 0 {
+		return 0
+	}
+	slices.Sort(gaps)
+	return gaps[len(gaps)/2]
+}
+
+// readData reads the latest data and all historic data from Aranet4,
+// retrying failed connections up to -connect-retries times.
 func (c *collector) readData(ctx context.Context) (latest *aranet4.Data, all []aranet4.Data, _ error) {
+	if *persistConn {
+		return c.readPersistent(ctx)
+	}
+	device, disconnect, err := c.connectRetrying(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer disconnect()
+	latest, all, err = c.readDevice(device, !*onlyLatest)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.adapterReads.WithLabelValues(adapterName(c.lastAdapter)).Inc()
+	return latest, all, nil
+}
+
+// readPersistent reads via the connection kept open between refreshes with
+// -persistent-connection. If the connection dropped or reading from it fails,
+// it is closed and the read is retried on a new connection, like without
+// -persistent-connection. The new connection is kept if reading succeeds.
+func (c *collector) readPersistent(ctx context.Context) (latest *aranet4.Data, all []aranet4.Data, _ error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != nil {
+		select {
+		case <-c.conn.Client().Disconnected():
+			slog.Warn("persistent connection dropped, reconnecting", "device-addr", c.addr)
+		default:
+			latest, all, err := c.readDevice(c.conn, !*onlyLatest)
+			if err == nil {
+				c.adapterReads.WithLabelValues(adapterName(c.lastAdapter)).Inc()
+				return latest, all, nil
+			}
+			slog.Warn("failed to read via persistent connection, reconnecting", "device-addr", c.addr, "error", err)
+		}
+		c.closeConnLocked()
+	}
+
+	device, disconnect, err := c.connectRetrying(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	latest, all, err = c.readDevice(device, !*onlyLatest)
+	if err != nil {
+		disconnect()
+		return nil, nil, err
+	}
+	c.adapterReads.WithLabelValues(adapterName(c.lastAdapter)).Inc()
+	c.conn, c.disconnect = device, disconnect
+	return latest, all, nil
+}
+
+// closeConn closes the connection kept open with -persistent-connection, if
+// any. It does nothing while a refresh is using the connection, so that it
+// never blocks shutdown; the connection is closed along with the process then.
+func (c *collector) closeConn() {
+	if !c.connMu.TryLock() {
+		return
+	}
+	defer c.connMu.Unlock()
+	c.closeConnLocked()
+}
+
+// closeConnLocked closes the persistent connection. c.connMu must be held.
+func (c *collector) closeConnLocked() {
+	if c.conn == nil {
+		return
+	}
+	c.disconnect()
+	c.conn, c.disconnect = nil, nil
+}
+
+// connectRetrying connects to Aranet4, retrying failed connections up to
+// -connect-retries times.
+func (c *collector) connectRetrying(ctx context.Context) (*aranet4.Device, func(), error) {
+	return c.connectCounting(ctx, *connRetries)
+}
+
+// connectAny connects to Aranet4 without retrying.
+func (c *collector) connectAny(ctx context.Context) (*aranet4.Device, func(), error) {
+	return c.connectCounting(ctx, 0)
+}
+
+// connectCounting connects to Aranet4, retrying up to retries times. A call
+// that fails to connect counts as one connection failure towards
+// -adapter-reset-after, no matter how many attempts it made.
+func (c *collector) connectCounting(ctx context.Context, retries int) (device *aranet4.Device, disconnect func(), _ error) {
+	if *autoReset && c.connectFailures >= *resetAfter {
+		for _, id := range hciSocketIDs {
+			slog.Warn("resetting Bluetooth adapter after repeated connection failures", "hci-socket-id", id, "failures", c.connectFailures)
+			if err := resetAdapter(id); err != nil {
+				slog.Error("failed to reset Bluetooth adapter", "error", err)
+				c.adapterResets.WithLabelValues("error").Inc()
+			} else {
+				c.adapterResets.WithLabelValues("success").Inc()
+			}
+		}
+		c.connectFailures = 0
+	}
+
+	var connected bool
+	err := retryConnect(ctx, retries, *connBackoff, func() (err error) {
+		var ok bool
+		device, disconnect, ok, err = c.connectAdapters(ctx)
+		connected = connected || ok
+		return err
+	})
+	if connected {
+		c.connectFailures = 0
+	} else if err != nil {
+		c.connectFailures++
+	}
+	return device, disconnect, err
+}
+
+// retryConnect calls fn until it succeeds, up to retries more times, waiting backoff
+// before the first retry and twice as long before every later one. It gives
+// up early if ctx is done.
+func retryConnect(ctx context.Context, retries int, backoff time.Duration, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > retries {
+			return err
+		}
+		slog.Warn("failed to connect, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// connectAdapters connects to Aranet4, trying each configured adapter in turn
+// until one connects to the device. It returns whether any adapter connected.
+func (c *collector) connectAdapters(ctx context.Context) (_ *aranet4.Device, disconnect func(), connected bool, _ error) {
+	// Start with the adapter that worked last time.
+	ids := slices.Clone(hciSocketIDs)
+	if i := slices.Index(ids, c.lastAdapter); i > 0 {
+		ids = append(append([]int{ids[i]}, ids[:i]...), ids[i+1:]...)
+	}
+	var errs []error
+	for _, id := range ids {
+		device, disconnect, connected, err := c.connect(ctx, id)
+		switch {
+		case err == nil:
+			c.connections.WithLabelValues("success").Inc()
+		case connected:
+			c.connections.WithLabelValues("setup_failed").Inc()
+		default:
+			c.connections.WithLabelValues("connect_failed").Inc()
+		}
+		if connected {
+			c.lastAdapter = id
+			return device, disconnect, true, err
+		}
+		if len(ids) > 1 {
+			slog.Warn("failed to connect via adapter", "hci-socket-id", id, "error", err)
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, false, errors.Join(errs...)
+}
+
+// adapterName returns the name of an adapter for metric labels.
+func adapterName(id int) string {
+	if id < 0 {
+		return "default"
+	}
+	return fmt.Sprintf("hci%d", id)
+}
+
+// connectMu serializes setting the default device and connecting with it.
+var connectMu sync.Mutex
+
+// connect connects to Aranet4 using the given adapter, pairing if there is no
+// bond yet, and starts encryption. It returns whether the connection itself
+// succeeded, and a function to disconnect and stop the adapter.
+func (c *collector) connect(ctx context.Context, id int) (_ *aranet4.Device, disconnect func(), connected bool, _ error) {
 	bm := bonds.NewBondManager(*btBondFile)
 
 	d, err := linux.NewDevice(
 		ble.OptEnableSecurity(bm),
-		ble.OptTransportHCISocket(*hciSocketID),
+		ble.OptTransportHCISocket(id),
 		ble.OptDialerTimeout(10*time.Second),
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't init device: %w", err)
+		return nil, nil, false, fmt.Errorf("can't init device hci-socket-id=%d: %w", id, err)
 	}
-	ble.SetDefaultDevice(d)
-	defer d.Stop()
+	stop := func() { c.teardown("stopping device", d.Stop) }
 
-	slog.Debug("connecting to device", "device-addr", *deviceAddr)
-	device, err := aranet4.New(ctx, *deviceAddr)
+	slog.Debug("connecting to device", "device-addr", c.addr, "hci-socket-id", id)
+	// The connection is made via the default device, so devices refreshed
+	// concurrently take turns connecting.
+	connectMu.Lock()
+	ble.SetDefaultDevice(d)
+	device, err := aranet4.New(ctx, c.addr)
+	connectMu.Unlock()
 	if err != nil {
-		return nil, nil, fmt.Errorf("connecting to device: %w", err)
+		stop()
+		return nil, nil, false, fmt.Errorf("connecting to device via hci-socket-id=%d: %w", id, err)
+	}
+	disconnect = func() {
+		c.teardown("closing connection", device.Close)
+		stop()
 	}
-	defer device.Close()
 
 	addr := device.Client().Addr().Bytes()
 	// Bond manager expects address in big-endian?
 	slices.Reverse(addr)
 	for !bm.Exists(hex.EncodeToString(addr)) {
 		slog.Warn("no bond found, pairing")
+		c.pairings.Inc()
 		authData := ble.AuthData{PasskeyFn: func() int { return c.passkey(ctx) }}
-		if err := device.Client().Pair(authData, 2*time.Minute); err != nil {
-			return nil, nil, fmt.Errorf("pairing: %w", err)
+		// The pairing timeout covers waiting for the passkey, plus some time
+		// for the pairing exchange itself.
+		if err := device.Client().Pair(authData, *passkeyWait+30*time.Second); err != nil {
+			disconnect()
+			return nil, nil, true, fmt.Errorf("pairing: %w", err)
 		}
 	}
 
 	slog.Debug("starting encryption")
 	m := make(chan ble.EncryptionChangedInfo)
 	if err := device.Client().StartEncryption(m); err != nil {
-		return nil, nil, fmt.Errorf("starting encryption: %w", err)
+		disconnect()
+		return nil, nil, true, fmt.Errorf("starting encryption: %w", err)
 	}
+	return device, disconnect, true, nil
+}
 
+// readDevice reads the latest data from a connected device, and all historic
+// data if history is true.
+func (c *collector) readDevice(device *aranet4.Device, history bool) (latest *aranet4.Data, all []aranet4.Data, _ error) {
 	slog.Debug("reading latest data")
 	data, err := device.Read()
 	if err != nil {
@@ -302,6 +1533,38 @@ func (c *collector) readData(ctx context.Context) (latest *aranet4.Data, all []a
 
 	slog.Debug("read data", "data", data)
 
+	firmware, err := device.Version()
+	if err != nil {
+		slog.Warn("failed to read firmware version", "error", err)
+	}
+	hardware, err := readInfoString(device, uuidHardwareRevision)
+	if err != nil {
+		slog.Warn("failed to read hardware revision", "error", err)
+	}
+	serial, err := readInfoString(device, uuidSerialNumber)
+	if err != nil {
+		slog.Warn("failed to read serial number", "error", err)
+	}
+	info := &deviceInfo{
+		Address:                    c.addr,
+		Name:                       device.Name(),
+		Firmware:                   firmware,
+		Hardware:                   hardware,
+		Serial:                     serial,
+		MeasurementIntervalSeconds: data.Interval.Seconds(),
+		BatteryPercent:             data.Battery,
+		LastMeasurement:            data.Time,
+		ReadAt:                     time.Now(),
+	}
+	if fields := strings.Fields(info.Name); len(fields) > 0 {
+		info.Model = fields[0]
+	}
+	c.setDeviceInfo(info)
+
+	if !history {
+		return &data, nil, nil
+	}
+
 	slog.Debug("reading historic data")
 	allData, err := device.ReadAll()
 	if err != nil {
@@ -310,28 +1573,262 @@ func (c *collector) readData(ctx context.Context) (latest *aranet4.Data, all []a
 	return &data, allData, nil
 }
 
-// reportMetrics reports the metrics for a single data point to Prometheus.
-func (c *collector) reportMetrics(ctx context.Context, data *aranet4.Data) error {
-	report := func(name string, value float64) error {
-		return c.prom.ReportMetric(ctx, name, data.Time, value)
+// Characteristics of the Device Information service that aranet4-ble has no
+// methods for.
+const (
+	uuidHardwareRevision = "00002a27-0000-1000-8000-00805f9b34fb"
+	uuidSerialNumber     = "00002a25-0000-1000-8000-00805f9b34fb"
+)
+
+// readInfoString reads a string characteristic of the Device Information
+// service.
+func readInfoString(device *aranet4.Device, uuid string) (string, error) {
+	client := device.Client()
+	char := client.Profile().FindCharacteristic(&ble.Characteristic{UUID: ble.MustParse(uuid)})
+	if char == nil {
+		return "", fmt.Errorf("characteristic %s not found", uuid)
+	}
+	b, err := client.ReadCharacteristic(char)
+	if err != nil {
+		return "", fmt.Errorf("reading characteristic %s: %w", uuid, err)
+	}
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+// setDeviceInfo stores the device metadata from a successful read, and
+// updates the device info metric to match.
+func (c *collector) setDeviceInfo(info *deviceInfo) {
+	// Fields that failed to read are empty; keep their previous values
+	// rather than flapping the labels.
+	if prev := c.deviceInfo.Load(); prev != nil {
+		for _, f := range []struct{ cur, prev *string }{
+			{&info.Firmware, &prev.Firmware},
+			{&info.Hardware, &prev.Hardware},
+			{&info.Serial, &prev.Serial},
+		} {
+			if *f.cur == "" {
+				*f.cur = *f.prev
+			}
+		}
+	}
+	c.deviceInfo.Store(info)
+	// Drop the labels of the previous read, e.g. after a firmware update.
+	c.infoMetric.Reset()
+	c.infoMetric.WithLabelValues(info.Firmware, info.Hardware, info.Serial).Set(1)
+}
+
+// onLockedThread wraps a read function to run in a dedicated goroutine locked
+// to its OS thread. The HCI transport may be sensitive to the reading goroutine
+// migrating between threads.
+func onLockedThread(fn func(context.Context) (*aranet4.Data, []aranet4.Data, error)) func(context.Context) (*aranet4.Data, []aranet4.Data, error) {
+	return func(ctx context.Context) (latest *aranet4.Data, all []aranet4.Data, err error) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			// Panics in refresh are recovered, but not in other goroutines.
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic reading data: %v", r)
+				}
+			}()
+			latest, all, err = fn(ctx)
+		}()
+		<-done
+		return latest, all, err
+	}
+}
+
+// teardownTimeout is how long to wait for a Bluetooth teardown step before
+// abandoning it.
+const teardownTimeout = 10 * time.Second
+
+// teardown runs a Bluetooth teardown step, abandoning it if it hangs so that
+// the next refresh can still be scheduled.
+func (c *collector) teardown(step string, fn func() error) {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Warn("teardown failed", "step", step, "error", err)
+		}
+	case <-time.After(teardownTimeout):
+		slog.Error("teardown timed out, abandoning", "step", step, "timeout", teardownTimeout)
+		c.teardownTimeouts.Inc()
 	}
-	if err := report("co2_ppm", float64(data.CO2)); err != nil {
-		return fmt.Errorf("reporting CO2: %w", err)
+}
+
+// metric describes how a metric is derived from a reading.
+type metric struct {
+	name string
+	// value extracts the metric value from a reading.
+	value func(*aranet4.Data) float64
+	// valid reports whether a reading has a plausible value for the metric.
+	// Readings are not validated if it is nil.
+	valid func(*aranet4.Data) bool
+	// base, if set, is the name of the metric this one is a unit conversion
+	// of: its correction applies, and convert is applied to the result.
+	base    string
+	convert func(float64) float64
+	// derived is whether the metric is calculated from other metrics rather
+	// than measured. An invalid value only skips the metric, not the record.
+	derived bool
+}
+
+// values returns the value of the metric in data with its correction applied,
+// and, if there is a correction, the uncorrected value.
+func (m metric) values(data *aranet4.Data) (value, raw float64, corrected bool) {
+	value = m.value(data)
+	name := m.name
+	if m.base != "" {
+		name = m.base
 	}
-	if err := report("humidity_percent", data.H); err != nil {
-		return fmt.Errorf("reporting humidity: %w", err)
+	raw = value
+	corr, corrected := corrections[name]
+	if corrected {
+		value = corr.apply(value)
 	}
-	if err := report("pressure_hpa", data.P); err != nil {
-		return fmt.Errorf("reporting pressure: %w", err)
+	if m.convert != nil {
+		value, raw = m.convert(value), m.convert(raw)
 	}
-	if err := report("temperature_celsius", data.T); err != nil {
-		return fmt.Errorf("reporting temperature: %w", err)
+	return value, raw, corrected
+}
+
+// recordMetrics are reported for every historic record. Records with an
+// invalid value for any of them, other than derived ones, are skipped
+// entirely.
+var recordMetrics = []metric{
+	{
+		name:  "co2_ppm",
+		value: func(d *aranet4.Data) float64 { return float64(d.CO2) },
+		valid: func(d *aranet4.Data) bool { return d.CO2 > 0 },
+	},
+	{
+		name:  "humidity_percent",
+		value: func(d *aranet4.Data) float64 { return d.H },
+	},
+	{
+		name:  "pressure_hpa",
+		value: func(d *aranet4.Data) float64 { return d.P },
+		valid: func(d *aranet4.Data) bool { return d.P > 0 },
+	},
+	{
+		name:  "temperature_celsius",
+		value: func(d *aranet4.Data) float64 { return d.T },
+	},
+}
+
+// latestMetrics are only reported for the latest reading, since they are not
+// stored in the device history.
+var latestMetrics = []metric{
+	{
+		name:  "battery_level_percent",
+		value: func(d *aranet4.Data) float64 { return float64(d.Battery) },
+		valid: func(d *aranet4.Data) bool { return d.Battery > -1 },
+	},
+}
+
+// batteryAvailableMetric is reported for the latest reading with
+// -report-unknown-battery.
+var batteryAvailableMetric = metric{
+	name: "battery_reading_available",
+	value: func(d *aranet4.Data) float64 {
+		if d.Battery > -1 {
+			return 1
+		}
+		return 0
+	},
+}
+
+// measurementMetrics are the names of metrics read from the device for every
+// record, in the units the device measures in, which corrections apply to.
+var measurementMetrics = metricNames(recordMetrics)
+
+// metricNames returns the names of the given metrics.
+func metricNames(metrics []metric) []string {
+	names := make([]string, len(metrics))
+	for i, m := range metrics {
+		names[i] = m.name
+	}
+	return names
+}
+
+// invalidMetric returns the name of the first metric for which data has an
+// invalid value, or an empty string if all values are valid.
+func invalidMetric(data *aranet4.Data, metrics []metric) string {
+	for _, m := range metrics {
+		if !m.derived && m.valid != nil && !m.valid(data) {
+			return m.name
+		}
+	}
+	return ""
+}
+
+// deviceInfo is the device metadata exposed at /api/device/info.
+type deviceInfo struct {
+	Address                    string    `json:"address"`
+	Name                       string    `json:"name"`
+	Model                      string    `json:"model"`
+	Firmware                   string    `json:"firmware"`
+	Hardware                   string    `json:"hardware"`
+	Serial                     string    `json:"serial"`
+	MeasurementIntervalSeconds float64   `json:"measurement_interval_seconds"`
+	BatteryPercent             int       `json:"battery_percent"`
+	LastMeasurement            time.Time `json:"last_measurement"`
+	ReadAt                     time.Time `json:"read_at"`
+}
+
+// reportMetrics reports the given metrics for a single data point, skipping
+// metrics the data point has no valid value for.
+func (c *collector) reportMetrics(ctx context.Context, data *aranet4.Data, metrics []metric) error {
+	var names []string
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if m.valid != nil && !m.valid(data) {
+			continue
+		}
+		value, raw, corrected := m.values(data)
+		if corrected && *reportRaw {
+			names = append(names, m.name+"_raw")
+			values[m.name+"_raw"] = raw
+		}
+		names = append(names, m.name)
+		values[m.name] = value
+	}
+	if c.otlp != nil {
+		for _, name := range names {
+			if err := c.otlp.ReportMetric(ctx, name, data.Time, values[name]); err != nil {
+				slog.Warn("failed to export metric via OTLP", "metric", name, "error", err)
+			}
+		}
+	}
+	if b, ok := c.sink.(batchReporter); ok {
+		if err := b.ReportMetrics(ctx, data.Time, values); err != nil {
+			return fmt.Errorf("reporting %s: %w", strings.Join(names, ", "), err)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := c.sink.ReportMetric(ctx, name, data.Time, values[name]); err != nil {
+			return fmt.Errorf("reporting %s: %w", name, err)
+		}
 	}
 	return nil
 }
 
-// passkey prompts the user for a passkey.
+// passkey returns the passkey set with -passkey, or prompts the user for one.
+// It returns 0, failing the pairing attempt, if no passkey is entered within
+// -passkey-timeout.
 func (c *collector) passkey(ctx context.Context) int {
+	if *passkeyFlag != "" {
+		slog.Info("pairing with the passkey set with -passkey")
+		p, _ := parsePasskey(*passkeyFlag)
+		return p
+	}
+	ctx, cancel := context.WithTimeout(ctx, *passkeyWait)
+	defer cancel()
 	m := *passkeyMode
 	if m == "terminal" || (m == "auto" && isatty.IsTerminal(os.Stdin.Fd())) {
 		return c.passkeyFromTerminal(ctx)
@@ -339,16 +1836,34 @@ func (c *collector) passkey(ctx context.Context) int {
 	return c.passkeyFromWeb(ctx)
 }
 
+// parsePasskey parses a passkey of up to 6 digits.
+func parsePasskey(s string) (int, error) {
+	if len(s) > 6 {
+		return 0, fmt.Errorf("passkey must have at most 6 digits, got %d", len(s))
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, errors.New("passkey must only contain digits")
+		}
+	}
+	return strconv.Atoi(s)
+}
+
 // passkeyFromWeb prompts the user for a passkey via a web page.
 func (c *collector) passkeyFromWeb(ctx context.Context) int {
 	pk := make(chan int)
 	c.passkeyChan.Store(pk)
 	defer c.passkeyChan.Store(nil)
 
-	addrport := strings.Split(*listen, ":")
+	addr := c.listenAddr
+	if addr == "" {
+		addr = *listen
+	}
+	addrport := strings.Split(addr, ":")
 	log.Printf("Please enter passkey at http://%s:%s/", hostname, addrport[len(addrport)-1])
 	select {
 	case <-ctx.Done():
+		slog.Error("timed out waiting for passkey", "error", ctx.Err())
 		return 0
 	case k, ok := <-pk:
 		if !ok {
@@ -359,14 +1874,42 @@ func (c *collector) passkeyFromWeb(ctx context.Context) int {
 	}
 }
 
+// terminalLines returns a channel of lines read from stdin. Stdin is only read
+// by a single goroutine, so that a prompt that timed out does not keep reading
+// input meant for a later one.
+var terminalLines = sync.OnceValue(func() <-chan string {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return lines
+})
+
 // passkeyFromTerminal prompts the user for a passkey from the terminal.
 func (c *collector) passkeyFromTerminal(ctx context.Context) int {
-	fmt.Print("Enter passkey: ")
-	var p int
-	n, err := fmt.Scanf("%d", &p)
-	if err != nil || n != 1 {
-		fmt.Printf("ERROR: expected 1 integer; got %d values (%v)\n", n, err)
-		return c.passkeyFromTerminal(ctx)
+	for {
+		fmt.Print("Enter passkey: ")
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			slog.Error("timed out waiting for passkey", "error", ctx.Err())
+			return 0
+		case line, ok := <-terminalLines():
+			if !ok {
+				slog.Error("stdin closed while waiting for passkey")
+				return 0
+			}
+			var p int
+			n, err := fmt.Sscanf(line, "%d", &p)
+			if err != nil || n != 1 {
+				fmt.Printf("ERROR: expected 1 integer; got %d values (%v)\n", n, err)
+				continue
+			}
+			return p
+		}
 	}
-	return p
 }
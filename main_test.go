@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/knyar/aranet4-prom-collector/promsync"
+)
+
+// sample is a single metric value received by fakeSink.
+type sample struct {
+	name  string
+	ts    time.Time
+	value float64
+}
+
+// fakeSink records all reported samples. Like promsync, it rejects
+// timestamps more than an hour in the future.
+type fakeSink struct {
+	samples []sample
+}
+
+func (s *fakeSink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if ts.After(time.Now().Add(time.Hour)) {
+		return fmt.Errorf("metric %q: %w", name, promsync.ErrFutureTimestamp)
+	}
+	s.samples = append(s.samples, sample{name: name, ts: ts, value: value})
+	return nil
+}
+
+// newTestCollector creates a collector reporting to a fake sink, with the
+// given data returned instead of reading from a device.
+func newTestCollector(t *testing.T, latest aranet4.Data, all []aranet4.Data) (*collector, *fakeSink) {
+	t.Helper()
+	sink := &fakeSink{}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &latest, all, nil
+	}
+	return c, sink
+}
+
+// record returns a valid historic record with the given time.
+func record(ts time.Time, co2 int) aranet4.Data {
+	return aranet4.Data{CO2: co2, T: 21, H: 40, P: 1000, Battery: -1, Interval: 5 * time.Minute, Time: ts}
+}
+
+func TestRefresh_ChronologicalOrder(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * 5 * time.Minute) }
+
+	// Shuffled, with duplicate timestamps.
+	all := []aranet4.Data{
+		record(at(3), 430),
+		record(at(0), 400),
+		record(at(5), 450),
+		record(at(1), 410),
+		record(at(3), 431),
+		record(at(2), 420),
+		record(at(0), 401),
+		record(at(4), 440),
+	}
+	c, sink := newTestCollector(t, aranet4.Data{Battery: 90, Time: at(5)}, all)
+
+	require.NoError(t, c.refresh())
+
+	byMetric := make(map[string][]time.Time)
+	for _, s := range sink.samples {
+		byMetric[s.name] = append(byMetric[s.name], s.ts)
+	}
+	for _, name := range measurementMetrics {
+		times := byMetric[name]
+		require.Len(t, times, 6, "metric %s", name)
+		for i := 1; i < len(times); i++ {
+			assert.True(t, times[i].After(times[i-1]), "metric %s: %v is not after %v", name, times[i], times[i-1])
+		}
+	}
+	assert.Equal(t, at(5), c.lastReported.Load())
+	assert.Equal(t, 8.0, testutil.ToFloat64(c.historyRecords))
+	assert.Equal(t, (25 * time.Minute).Seconds(), testutil.ToFloat64(c.historySpan))
+}
+
+func TestRefresh_FutureRecords(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	all := []aranet4.Data{
+		record(now.Add(-10*time.Minute), 400),
+		record(now.Add(-5*time.Minute), 410),
+		record(now.Add(3*time.Hour), 420),
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		setFlag(t, futureRecords, "skip")
+		c, sink := newTestCollector(t, aranet4.Data{Battery: -1}, all)
+
+		require.NoError(t, c.refresh())
+		assert.Len(t, sink.samples, 2*len(measurementMetrics))
+		assert.Equal(t, now.Add(-5*time.Minute), c.lastReported.Load())
+		assert.Equal(t, 1.0, testutil.ToFloat64(c.futureRecords))
+		assert.Equal(t, uint64(2), histogramCount(t, c.writeLatency))
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		setFlag(t, futureRecords, "fail")
+		c, _ := newTestCollector(t, aranet4.Data{Battery: -1}, all)
+
+		err := c.refresh()
+		require.ErrorIs(t, err, promsync.ErrFutureTimestamp)
+		assert.True(t, c.lastReported.Load().IsZero())
+	})
+}
+
+// histogramCount returns the number of observations in a histogram.
+// flakySink is a fakeSink whose Flush fails while err is set.
+type flakySink struct {
+	fakeSink
+	err error
+}
+
+func (s *flakySink) Flush(ctx context.Context) error { return s.err }
+
+func TestRefresh_WriteLatencyAfterFlush(t *testing.T) {
+	sink := &flakySink{err: errors.New("flush failed")}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	now := time.Now().Truncate(time.Minute)
+	all := []aranet4.Data{record(now.Add(-5*time.Minute), 400), record(now, 410)}
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &all[1], all, nil
+	}
+
+	require.ErrorContains(t, c.refresh(), "flush failed")
+	assert.Zero(t, histogramCount(t, c.writeLatency), "Records of a failed flush are not written yet")
+
+	sink.err = nil
+	require.NoError(t, c.refresh())
+	assert.Equal(t, uint64(2), histogramCount(t, c.writeLatency), "Records are observed once, when flushed")
+}
+
+func histogramCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// setFlag sets a flag value for the duration of a test.
+func setFlag[T any](t *testing.T, f *T, value T) {
+	t.Helper()
+	old := *f
+	*f = value
+	t.Cleanup(func() { *f = old })
+}
+
+func TestRefresh_InvalidValues(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	noCO2 := record(now.Add(-10*time.Minute), 0)
+	noPressure := record(now.Add(-5*time.Minute), 410)
+	noPressure.P = 0
+	all := []aranet4.Data{noCO2, noPressure, record(now, 420)}
+	c, sink := newTestCollector(t, aranet4.Data{Battery: 80, Time: now}, all)
+
+	require.NoError(t, c.refresh())
+
+	got := make(map[string]float64)
+	for _, s := range sink.samples {
+		got[s.name] = s.value
+	}
+	assert.Equal(t, map[string]float64{
+		"battery_level_percent": 80,
+		"co2_ppm":               420,
+		"humidity_percent":      40,
+		"pressure_hpa":          1000,
+		"temperature_celsius":   21,
+	}, got, "Only the valid record and the battery level should be reported")
+}
+
+// abortSink is a fakeSink counting aborted refreshes.
+type abortSink struct {
+	fakeSink
+	aborts int
+}
+
+func (s *abortSink) Abort() { s.aborts++ }
+
+func TestRefresh_Abort(t *testing.T) {
+	sink := &abortSink{}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	now := time.Now().Truncate(time.Minute)
+	latest := record(now, 400)
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &latest, []aranet4.Data{record(now.Add(2*time.Hour), 410)}, nil
+	}
+
+	require.NoError(t, c.refresh())
+	assert.Zero(t, sink.aborts)
+
+	setFlag(t, futureRecords, "fail")
+	require.Error(t, c.refresh())
+	assert.Equal(t, 1, sink.aborts)
+}
+
+func TestRefresh_MaxRecords(t *testing.T) {
+	setFlag(t, maxRecords, 3)
+	base := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	var all []aranet4.Data
+	for i := range 10 {
+		all = append(all, record(base.Add(time.Duration(i)*5*time.Minute), 400+i))
+	}
+	c, sink := newTestCollector(t, all[len(all)-1], all)
+	co2Times := func() []time.Time {
+		var times []time.Time
+		for _, s := range sink.samples {
+			if s.name == "co2_ppm" {
+				times = append(times, s.ts)
+			}
+		}
+		sink.samples = nil
+		return times
+	}
+
+	require.NoError(t, c.refresh())
+	assert.Equal(t, []time.Time{all[7].Time, all[8].Time, all[9].Time}, co2Times())
+	assert.Equal(t, 7.0, testutil.ToFloat64(c.recordsCapped))
+
+	// Records already reported don't count against the cap.
+	require.NoError(t, c.refresh())
+	assert.Equal(t, 7.0, testutil.ToFloat64(c.recordsCapped))
+
+	more := append(slices.Clone(all), record(base.Add(50*time.Minute), 410), record(base.Add(55*time.Minute), 411))
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &more[len(more)-1], more, nil
+	}
+	require.NoError(t, c.refresh())
+	assert.Equal(t, 7.0, testutil.ToFloat64(c.recordsCapped))
+	assert.Contains(t, co2Times(), more[len(more)-1].Time)
+}
+
+func TestOnLockedThread(t *testing.T) {
+	latest := &aranet4.Data{Battery: 50}
+	read := onLockedThread(func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return latest, []aranet4.Data{*latest}, nil
+	})
+	got, all, err := read(context.Background())
+	require.NoError(t, err)
+	assert.Same(t, latest, got)
+	assert.Len(t, all, 1)
+
+	read = onLockedThread(func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		panic("boom")
+	})
+	_, _, err = read(context.Background())
+	require.ErrorContains(t, err, "boom")
+}
+
+func TestRefresh_WithoutHistory(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	latest := record(now, 500)
+	latest.Battery = 70
+	c, sink := newTestCollector(t, latest, nil)
+
+	require.NoError(t, c.refresh())
+
+	assert.Len(t, sink.samples, len(measurementMetrics)+1, "Latest measurement and battery level should be reported")
+	assert.Equal(t, now, c.lastReported.Load())
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.historyRecords), "History gauges should not be set without history")
+}
+
+func TestRefresh_CountMeasurements(t *testing.T) {
+	base := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	history := func(jitter time.Duration, n int) []aranet4.Data {
+		var all []aranet4.Data
+		for i := range n {
+			all = append(all, record(base.Add(time.Duration(i)*5*time.Minute+jitter), 400+i))
+		}
+		return all
+	}
+	c, _ := newTestCollector(t, aranet4.Data{}, nil)
+	read := func(all []aranet4.Data) {
+		t.Helper()
+		latest := all[len(all)-1]
+		c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+			return &latest, all, nil
+		}
+		require.NoError(t, c.refresh())
+	}
+
+	read(history(0, 3))
+	assert.Equal(t, 3.0, testutil.ToFloat64(c.measurements), "All records are new on the first read")
+
+	// Reconstructed timestamps moving by a few seconds are not new records.
+	read(history(2*time.Second, 4))
+	assert.Equal(t, 4.0, testutil.ToFloat64(c.measurements), "Only the new record is counted")
+
+	read(history(-2*time.Second, 4))
+	assert.Equal(t, 4.0, testutil.ToFloat64(c.measurements), "Nothing new")
+}
+
+func TestRefresh_UnknownBattery(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	all := []aranet4.Data{record(now, 400)}
+
+	for _, battery := range []int{-1, 0, 55} {
+		t.Run(fmt.Sprint(battery), func(t *testing.T) {
+			setFlag(t, reportBatt, true)
+			c, sink := newTestCollector(t, aranet4.Data{Battery: battery, Time: now}, all)
+			require.NoError(t, c.refresh())
+
+			got := make(map[string]float64)
+			for _, s := range sink.samples {
+				got[s.name] = s.value
+			}
+			available, level := got["battery_reading_available"], got["battery_level_percent"]
+			if battery < 0 {
+				assert.Equal(t, 0.0, available)
+				assert.NotContains(t, got, "battery_level_percent")
+			} else {
+				assert.Equal(t, 1.0, available)
+				assert.Equal(t, float64(battery), level)
+			}
+		})
+	}
+}
+
+func TestPrintReading(t *testing.T) {
+	var buf bytes.Buffer
+	ts := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, printReading(&buf, &aranet4.Data{Time: ts, CO2: 612, T: 21.35, H: 44, P: 1013.2, Battery: 87}))
+	require.NoError(t, printReading(&buf, &aranet4.Data{Time: ts, CO2: 1204, T: -3.2, H: 90, P: 998, Battery: -1}))
+	assert.Equal(t, ""+
+		"2025-01-02T03:04:05Z             612       21.4            44          1013.2           87\n"+
+		"2025-01-02T03:04:05Z            1204       -3.2            90           998.0            -\n",
+		buf.String())
+}
+
+func TestPasskey_Timeout(t *testing.T) {
+	setFlag(t, passkeyMode, "web")
+	setFlag(t, passkeyWait, 50*time.Millisecond)
+	c, _ := newTestCollector(t, aranet4.Data{}, nil)
+
+	start := time.Now()
+	assert.Equal(t, 0, c.passkey(context.Background()))
+	assert.Less(t, time.Since(start), time.Second)
+	// A passkey submitted after the timeout is rejected instead of blocking.
+	assert.Nil(t, c.passkeyChan.Load())
+}
+
+func TestPasskey_Flag(t *testing.T) {
+	setFlag(t, passkeyMode, "web")
+	setFlag(t, passkeyFlag, "012345")
+	c, _ := newTestCollector(t, aranet4.Data{}, nil)
+
+	// The passkey is returned without prompting on the web page.
+	assert.Equal(t, 12345, c.passkey(context.Background()))
+	assert.Nil(t, c.passkeyChan.Load())
+}
+
+func TestParsePasskey(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr string
+	}{
+		{in: "123456", want: 123456},
+		{in: "000042", want: 42},
+		{in: "1234567", wantErr: "at most 6 digits"},
+		{in: "-12345", wantErr: "only contain digits"},
+		{in: "12 345", wantErr: "only contain digits"},
+	}
+	for _, tt := range tests {
+		got, err := parsePasskey(tt.in)
+		if tt.wantErr != "" {
+			assert.ErrorContains(t, err, tt.wantErr, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestRefresh_AlignTimestamps(t *testing.T) {
+	setFlag(t, alignTimes, 10*time.Second)
+	base := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	// Reconstructed times are a couple of seconds off the grid of
+	// measurements, which are 2m30s past every 5 minutes.
+	all := []aranet4.Data{
+		record(base.Add(2*time.Minute+28*time.Second), 400),
+		record(base.Add(7*time.Minute+33*time.Second), 410),
+	}
+	latest := record(base.Add(7*time.Minute+32*time.Second), 410)
+	latest.Battery = 90
+	c, sink := newTestCollector(t, latest, all)
+
+	require.NoError(t, c.refresh())
+
+	var times []time.Time
+	for _, s := range sink.samples {
+		if s.name == "co2_ppm" {
+			times = append(times, s.ts)
+		}
+	}
+	assert.Equal(t, []time.Time{base.Add(2*time.Minute + 30*time.Second), base.Add(7*time.Minute + 30*time.Second)}, times)
+	assert.Equal(t, base.Add(7*time.Minute+30*time.Second), c.lastReported.Load())
+}
+
+func TestAlignTimestamps(t *testing.T) {
+	base := time.Date(2025, 1, 2, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		d       time.Duration
+		latest  time.Duration
+		all     []time.Duration
+		want    []time.Duration
+		wantErr string
+	}{
+		{name: "on the grid", d: 10 * time.Second, latest: 10*time.Minute + 1*time.Second, all: []time.Duration{4*time.Minute + 59*time.Second, 10*time.Minute + 2*time.Second}, want: []time.Duration{5 * time.Minute, 10 * time.Minute}},
+		{name: "offset grid", d: time.Minute, latest: 11*time.Minute + 50*time.Second, all: []time.Duration{6*time.Minute + 55*time.Second, 11*time.Minute + 52*time.Second}, want: []time.Duration{7 * time.Minute, 12 * time.Minute}},
+		{name: "phase rounds to the interval", d: time.Minute, latest: 14*time.Minute + 40*time.Second, all: []time.Duration{9*time.Minute + 41*time.Second, 14*time.Minute + 39*time.Second}, want: []time.Duration{10 * time.Minute, 15 * time.Minute}},
+		{name: "one interval", d: 5 * time.Minute, latest: 10*time.Minute + 3*time.Second, all: []time.Duration{5*time.Minute + 2*time.Second, 10*time.Minute + 3*time.Second}, want: []time.Duration{5 * time.Minute, 10 * time.Minute}},
+		{name: "longer than the interval", d: 10 * time.Minute, latest: 10 * time.Minute, wantErr: "does not evenly divide"},
+		{name: "not dividing the interval", d: 7 * time.Second, latest: 10 * time.Minute, wantErr: "does not evenly divide the measurement interval 5m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latest := record(base.Add(tt.latest), 400)
+			var all []aranet4.Data
+			for _, d := range tt.all {
+				all = append(all, record(base.Add(d), 400))
+			}
+			err := alignTimestamps(&latest, all, tt.d)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var got []time.Duration
+			for _, data := range all {
+				got = append(got, data.Time.Sub(base))
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.want[len(tt.want)-1], latest.Time.Sub(base))
+		})
+	}
+
+	// Without a measurement interval, nothing is aligned.
+	latest := aranet4.Data{Time: base.Add(time.Second)}
+	require.NoError(t, alignTimestamps(&latest, nil, 10*time.Second))
+	assert.Equal(t, base.Add(time.Second), latest.Time)
+}
+
+func TestReportMetrics_RecordTimestamp(t *testing.T) {
+	c, sink := newTestCollector(t, aranet4.Data{}, nil)
+	// Far enough in the past that using time.Now() instead would be obvious.
+	ts := time.Now().Add(-36 * time.Hour).Truncate(time.Second)
+	data := aranet4.Data{CO2: 812, T: 22.5, H: 38, P: 1007.5, Battery: 60, Time: ts}
+
+	require.NoError(t, c.reportMetrics(context.Background(), &data, recordMetrics))
+
+	assert.ElementsMatch(t, []sample{
+		{name: "co2_ppm", ts: ts, value: 812},
+		{name: "humidity_percent", ts: ts, value: 38},
+		{name: "pressure_hpa", ts: ts, value: 1007.5},
+		{name: "temperature_celsius", ts: ts, value: 22.5},
+	}, sink.samples)
+}
+
+func TestWriteDeviceUp(t *testing.T) {
+	c, sink := newTestCollector(t, aranet4.Data{}, nil)
+	c.writeDeviceUp(nil)
+	assert.Empty(t, sink.samples, "device_up is only written with -shutdown-marker")
+
+	setFlag(t, shutdownMarker, true)
+	c.writeDeviceUp(nil)
+	c.writeDeviceUp(fmt.Errorf("boom"))
+	require.Len(t, sink.samples, 2)
+	assert.Equal(t, "device_up", sink.samples[0].name)
+	assert.Equal(t, []float64{1, 0}, []float64{sink.samples[0].value, sink.samples[1].value})
+}
+
+// batchSink is a fakeSink that also reports metrics in batches.
+type batchSink struct {
+	fakeSink
+	batches []map[string]float64
+}
+
+func (s *batchSink) ReportMetrics(ctx context.Context, ts time.Time, values map[string]float64) error {
+	s.batches = append(s.batches, values)
+	return nil
+}
+
+func TestReportMetrics_Batch(t *testing.T) {
+	sink := &batchSink{}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	data := record(time.Now().Truncate(time.Minute), 700)
+
+	require.NoError(t, c.reportMetrics(context.Background(), &data, recordMetrics))
+	assert.Empty(t, sink.samples)
+	assert.Equal(t, []map[string]float64{{
+		"co2_ppm":             700,
+		"humidity_percent":    40,
+		"pressure_hpa":        1000,
+		"temperature_celsius": 21,
+	}}, sink.batches)
+}
+
+func TestRetryConnect(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	failTwice := func() error {
+		calls++
+		if calls <= 2 {
+			return fmt.Errorf("attempt %d failed", calls)
+		}
+		return nil
+	}
+	require.NoError(t, retryConnect(ctx, 2, time.Millisecond, failTwice))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	require.ErrorContains(t, retryConnect(ctx, 1, time.Millisecond, failTwice), "attempt 2 failed")
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.ErrorContains(t, retryConnect(ctx, 5, time.Hour, failTwice), "attempt 1 failed")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRefresh_MultipleDevices(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	now := time.Now().Truncate(time.Minute)
+	for _, addr := range []string{"AA:BB:CC:DD:EE:01", "AA:BB:CC:DD:EE:02"} {
+		c := newCollectorWithRegistry(&fakeSink{}, prometheus.WrapRegistererWith(prometheus.Labels{"device_addr": addr}, reg))
+		c.addr = addr
+		c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+			latest := record(now, 400)
+			return &latest, nil, nil
+		}
+		require.NoError(t, c.refresh())
+		require.NoError(t, c.refresh())
+	}
+	count, err := testutil.GatherAndCount(reg, "aranet4_last_success_time_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestRefresh_Concurrency(t *testing.T) {
+	slots := make(chan struct{}, 2)
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for range 5 {
+		c, _ := newTestCollector(t, record(time.Now().Truncate(time.Minute), 400), nil)
+		c.slots = slots
+		readFn := c.readFn
+		c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return readFn(ctx)
+		}
+		wg.Go(func() { assert.NoError(t, c.refresh()) })
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning.Load())
+}
+
+func TestRefresh_OTLP(t *testing.T) {
+	var mu sync.Mutex
+	var points map[string][]uint64
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		mu.Lock()
+		defer mu.Unlock()
+		points = make(map[string][]uint64)
+		for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+			for _, pt := range m.GetGauge().DataPoints {
+				points[m.Name] = append(points[m.Name], pt.TimeUnixNano)
+			}
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	setFlag(t, otlpURL, server.URL)
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	latest := record(base.Add(5*time.Minute), 410)
+	latest.Battery = 80
+	c, sink := newTestCollector(t, latest, []aranet4.Data{record(base, 400), latest})
+	var err error
+	c.otlp, err = newOTLPSink("AA:BB:CC:DD:EE:FF")
+	require.NoError(t, err)
+
+	// A failed export doesn't fail the refresh.
+	status = http.StatusServiceUnavailable
+	require.NoError(t, c.refresh())
+	assert.NotEmpty(t, sink.samples)
+
+	status = http.StatusOK
+	require.NoError(t, c.refresh())
+	at := func(ts time.Time) uint64 { return uint64(ts.UnixNano()) }
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []uint64{at(base), at(latest.Time)}, points[*metricPrefix+"co2_ppm"])
+	assert.Equal(t, []uint64{at(latest.Time)}, points[*metricPrefix+"battery_level_percent"])
+}
+
+func TestSetDeviceInfo(t *testing.T) {
+	c, _ := newTestCollector(t, aranet4.Data{}, nil)
+	c.setDeviceInfo(&deviceInfo{Firmware: "v1.4.19", Hardware: "12", Serial: "1234"})
+	c.setDeviceInfo(&deviceInfo{Firmware: "v1.5.0", Hardware: "12", Serial: "1234"})
+
+	// Only the labels of the last read are exposed.
+	assert.Equal(t, 1, testutil.CollectAndCount(c.infoMetric))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.infoMetric.WithLabelValues("v1.5.0", "12", "1234")))
+	assert.Equal(t, "v1.5.0", c.deviceInfo.Load().Firmware)
+
+	// Fields that failed to read keep their previous values.
+	c.setDeviceInfo(&deviceInfo{Firmware: "", Hardware: "13", Serial: ""})
+	assert.Equal(t, 1, testutil.CollectAndCount(c.infoMetric))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.infoMetric.WithLabelValues("v1.5.0", "13", "1234")))
+	assert.Equal(t, "v1.5.0", c.deviceInfo.Load().Firmware)
+}
+
+// dedupSink only accepts samples newer than the last accepted one of each
+// metric, like promsync does.
+type dedupSink struct {
+	fakeSink
+	last map[string]time.Time
+}
+
+func (s *dedupSink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if !ts.After(s.last[name]) {
+		return nil
+	}
+	s.last[name] = ts
+	return s.fakeSink.ReportMetric(ctx, name, ts, value)
+}
+
+// planningDedupSink is a dedupSink that also plans, like promsync.
+type planningDedupSink struct {
+	dedupSink
+}
+
+func (s *planningDedupSink) Plan(ctx context.Context, name string, ts time.Time) (string, error) {
+	if ts.After(s.last[name]) {
+		return promsync.PlanWrite, nil
+	}
+	return promsync.PlanSkipDuplicate, nil
+}
+
+func TestRefresh_DedupCountsWithUnits(t *testing.T) {
+	metrics, err := withUnits(recordMetrics, "fahrenheit", "inhg")
+	require.NoError(t, err)
+	setFlag(t, &recordMetrics, metrics)
+
+	now := time.Now().Truncate(time.Minute)
+	all := []aranet4.Data{record(now.Add(-10*time.Minute), 400), record(now.Add(-5*time.Minute), 410), record(now, 420)}
+	sink := &planningDedupSink{dedupSink{last: make(map[string]time.Time)}}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return &all[2], all, nil
+	}
+
+	require.NoError(t, c.refresh())
+	assert.Equal(t, 3.0, testutil.ToFloat64(c.recordsWritten))
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.recordsDeduped))
+
+	// Records are deduplicated by the metrics written, not by
+	// temperature_celsius and pressure_hpa.
+	require.NoError(t, c.refresh())
+	assert.Equal(t, 0.0, testutil.ToFloat64(c.recordsWritten))
+	assert.Equal(t, 3.0, testutil.ToFloat64(c.recordsDeduped))
+}
+
+func TestRefresh_Downtime(t *testing.T) {
+	base := time.Now().Add(-8 * time.Hour).Truncate(time.Minute)
+	at := func(i int) time.Time { return base.Add(time.Duration(i) * 5 * time.Minute) }
+	history := func(from, to int) []aranet4.Data {
+		var all []aranet4.Data
+		for i := from; i <= to; i++ {
+			all = append(all, record(at(i), 400+i))
+		}
+		return all
+	}
+	sink := &dedupSink{last: make(map[string]time.Time)}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	read := func(all []aranet4.Data) {
+		t.Helper()
+		latest := all[len(all)-1]
+		c.readFn = func(ctx context.Context) (*aranet4.Data, []aranet4.Data, error) {
+			return &latest, all, nil
+		}
+		require.NoError(t, c.refresh())
+	}
+
+	read(history(0, 12))
+	before := len(sink.samples)
+
+	// After 6 hours of downtime, the device still stores everything since
+	// the last refresh, and all of it is written.
+	read(history(0, 12+72))
+	var times []time.Time
+	for _, s := range sink.samples[before:] {
+		if s.name == "co2_ppm" {
+			times = append(times, s.ts)
+		}
+	}
+	require.Len(t, times, 72)
+	for i, ts := range times {
+		assert.Equal(t, at(13+i), ts)
+	}
+	assert.Zero(t, testutil.ToFloat64(c.historyGap))
+
+	// After an even longer downtime the device overwrote the records right
+	// after the last reported one, which shows up as a gap.
+	read(history(12+72+12, 12+72+24))
+	assert.Equal(t, time.Hour.Seconds(), testutil.ToFloat64(c.historyGap))
+}
+
+func TestHistoryGaps(t *testing.T) {
+	base := time.Now().Truncate(time.Minute)
+	at := func(m int) aranet4.Data { return record(base.Add(time.Duration(m)*time.Minute), 400) }
+	tests := []struct {
+		name        string
+		since       time.Time
+		all         []aranet4.Data
+		wantN       int
+		wantLargest time.Duration
+	}{
+		{name: "no gaps", all: []aranet4.Data{at(0), at(5), at(10), at(16)}},
+		{name: "gaps", all: []aranet4.Data{at(0), at(5), at(20), at(25), at(385)}, wantN: 2, wantLargest: 6 * time.Hour},
+		{name: "zero timestamps ignored", all: []aranet4.Data{{}, at(0), {}, at(5)}},
+		{name: "since overlapping", since: base.Add(5 * time.Minute), all: []aranet4.Data{at(0), at(5), at(10)}},
+		{name: "since before oldest", since: base.Add(-time.Hour), all: []aranet4.Data{at(0), at(5)}, wantN: 1, wantLargest: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, largest := historyGaps(tt.since, tt.all, 5*time.Minute)
+			assert.Equal(t, tt.wantN, n)
+			assert.Equal(t, tt.wantLargest, largest)
+		})
+	}
+}
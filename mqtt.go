@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/knyar/aranet4-ble"
+)
+
+// mqttPublisher publishes the latest reading of a device to an MQTT broker
+// as JSON, along with Home Assistant discovery configs for its sensors.
+type mqttPublisher struct {
+	client mqtt.Client
+
+	// addr is the device address, and id its unique ID in topics.
+	addr, id string
+
+	// last is the time of the last published reading. It is only accessed
+	// from refresh, which never runs concurrently.
+	last time.Time
+}
+
+// mqttReading is the JSON payload published for a reading.
+type mqttReading struct {
+	CO2         int       `json:"co2"`
+	Temperature float64   `json:"temperature"`
+	Humidity    float64   `json:"humidity"`
+	Pressure    float64   `json:"pressure"`
+	Battery     *int      `json:"battery,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// mqttSensor describes a sensor announced with Home Assistant discovery.
+type mqttSensor struct {
+	key, name, deviceClass, unit string
+}
+
+// mqttSensors are the fields of mqttReading announced as sensors.
+var mqttSensors = []mqttSensor{
+	{key: "co2", name: "CO2", deviceClass: "carbon_dioxide", unit: "ppm"},
+	{key: "temperature", name: "Temperature", deviceClass: "temperature", unit: "°C"},
+	{key: "humidity", name: "Humidity", deviceClass: "humidity", unit: "%"},
+	{key: "pressure", name: "Pressure", deviceClass: "atmospheric_pressure", unit: "hPa"},
+	{key: "battery", name: "Battery", deviceClass: "battery", unit: "%"},
+}
+
+// newMQTTPublisher connects to the broker set with -mqtt-broker in the
+// background, reconnecting as needed.
+func newMQTTPublisher(addr string) (*mqttPublisher, error) {
+	p := &mqttPublisher{
+		addr: addr,
+		id:   strings.ToLower(strings.ReplaceAll(addr, ":", "")),
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(*mqttBroker).
+		SetClientID("aranet4-" + p.id).
+		SetUsername(*mqttUser).
+		SetConnectRetry(true).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			slog.Info("connected to MQTT broker", "broker", *mqttBroker)
+			// Publish discovery configs on every connection, in case the
+			// broker lost its retained messages. The handler must not block.
+			go func() {
+				if err := p.publishDiscovery(); err != nil {
+					slog.Warn("failed to publish Home Assistant discovery configs", "error", err)
+				}
+			}()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("lost connection to MQTT broker", "broker", *mqttBroker, "error", err)
+		})
+	if *mqttPassFile != "" {
+		b, err := os.ReadFile(*mqttPassFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT password: %w", err)
+		}
+		opts.SetPassword(strings.TrimRight(string(b), "\r\n"))
+	}
+	p.client = mqtt.NewClient(opts)
+	// With ConnectRetry, the token only completes once connected.
+	p.client.Connect()
+	return p, nil
+}
+
+// stateTopic returns the topic readings are published to.
+func (p *mqttPublisher) stateTopic() string {
+	return *mqttTopic + "/" + p.id + "/state"
+}
+
+// Publish publishes a reading, unless it is not newer than the last
+// published one. Readings are corrected like reported metrics.
+func (p *mqttPublisher) Publish(ctx context.Context, data *aranet4.Data) error {
+	if !data.Time.After(p.last) {
+		return nil
+	}
+	payload, err := json.Marshal(newMQTTReading(data))
+	if err != nil {
+		return err
+	}
+	if err := p.publish(ctx, p.stateTopic(), payload); err != nil {
+		return err
+	}
+	p.last = data.Time
+	return nil
+}
+
+// publishDiscovery publishes the Home Assistant discovery configs of all
+// sensors, unless discovery is disabled.
+func (p *mqttPublisher) publishDiscovery() error {
+	if *mqttDiscovery == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	for topic, config := range p.discoveryConfigs() {
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if err := p.publish(ctx, topic, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoveryConfigs returns the Home Assistant discovery configs of all
+// sensors, by topic.
+func (p *mqttPublisher) discoveryConfigs() map[string]map[string]any {
+	device := map[string]any{
+		"identifiers":  []string{"aranet4_" + p.id},
+		"connections":  [][]string{{"bluetooth", p.addr}},
+		"name":         "Aranet4 " + p.addr,
+		"manufacturer": "SAF Tehnika",
+		"model":        "Aranet4",
+	}
+	configs := make(map[string]map[string]any)
+	for _, s := range mqttSensors {
+		topic := fmt.Sprintf("%s/sensor/aranet4_%s/%s/config", *mqttDiscovery, p.id, s.key)
+		configs[topic] = map[string]any{
+			"name":                s.name,
+			"unique_id":           "aranet4_" + p.id + "_" + s.key,
+			"state_topic":         p.stateTopic(),
+			"value_template":      "{{ value_json." + s.key + " }}",
+			"device_class":        s.deviceClass,
+			"unit_of_measurement": s.unit,
+			"state_class":         "measurement",
+			"device":              device,
+		}
+	}
+	return configs
+}
+
+// publish publishes a retained message with QoS 1 and waits for it to be
+// acknowledged. Retaining readings lets Home Assistant show the last one
+// straight away after a restart.
+func (p *mqttPublisher) publish(ctx context.Context, topic string, payload []byte) error {
+	token := p.client.Publish(topic, 1, true, payload)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("publishing to %s: %w", topic, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("publishing to %s: %w", topic, ctx.Err())
+	}
+}
+
+// newMQTTReading returns the payload for a reading, with corrections applied.
+func newMQTTReading(data *aranet4.Data) mqttReading {
+	r := mqttReading{
+		CO2:         int(math.Round(corrections.apply("co2_ppm", float64(data.CO2)))),
+		Temperature: corrections.apply("temperature_celsius", data.T),
+		Humidity:    corrections.apply("humidity_percent", data.H),
+		Pressure:    corrections.apply("pressure_hpa", data.P),
+		Timestamp:   data.Time,
+	}
+	if data.Battery > -1 {
+		r.Battery = &data.Battery
+	}
+	return r
+}
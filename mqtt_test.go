@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMQTTReading(t *testing.T) {
+	ts := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		data aranet4.Data
+		want string
+	}{
+		{
+			name: "with battery",
+			data: aranet4.Data{CO2: 812, T: 22.5, H: 38, P: 1007.5, Battery: 60, Time: ts},
+			want: `{"co2":762,"temperature":22.5,"humidity":38,"pressure":1007.5,"battery":60,"timestamp":"2025-03-01T12:00:00Z"}`,
+		},
+		{
+			name: "unknown battery",
+			data: aranet4.Data{CO2: 450, T: 19, H: 45, P: 990, Battery: -1, Time: ts},
+			want: `{"co2":400,"temperature":19,"humidity":45,"pressure":990,"timestamp":"2025-03-01T12:00:00Z"}`,
+		},
+	}
+	corrections["co2_ppm"] = correction{scale: 1, offset: -50}
+	t.Cleanup(func() { delete(corrections, "co2_ppm") })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(newMQTTReading(&tt.data))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(b))
+		})
+	}
+}
+
+func TestMQTTDiscoveryConfigs(t *testing.T) {
+	p := &mqttPublisher{addr: "AA:BB:CC:DD:EE:FF", id: "aabbccddeeff"}
+	configs := p.discoveryConfigs()
+	require.Len(t, configs, len(mqttSensors))
+
+	co2 := configs["homeassistant/sensor/aranet4_aabbccddeeff/co2/config"]
+	require.NotNil(t, co2)
+	assert.Equal(t, "aranet4_aabbccddeeff_co2", co2["unique_id"])
+	assert.Equal(t, "aranet4/aabbccddeeff/state", co2["state_topic"])
+	assert.Equal(t, "{{ value_json.co2 }}", co2["value_template"])
+	assert.Equal(t, "carbon_dioxide", co2["device_class"])
+	assert.Equal(t, "ppm", co2["unit_of_measurement"])
+}
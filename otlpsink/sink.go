@@ -0,0 +1,214 @@
+// Package otlpsink sends metrics to an OpenTelemetry collector or backend
+// using OTLP over HTTP.
+//
+// Requests are built from the OTLP protobuf definitions rather than with the
+// OpenTelemetry metrics SDK, since the SDK stamps data points with the time of
+// collection, while every point here carries the time it was measured at.
+package otlpsink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// scopeName is the instrumentation scope of all metrics.
+const scopeName = "github.com/knyar/aranet4-prom-collector"
+
+// ErrNonFinite is returned by ReportMetric for NaN and infinite values.
+var ErrNonFinite = errors.New("value is not finite")
+
+// errRejected is returned by send for client errors, which are not retried.
+var errRejected = errors.New("request rejected")
+
+// Config holds configuration for the OTLP sink.
+type Config struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver (e.g.,
+	// "http://localhost:4318"). Metrics are sent to its /v1/metrics path.
+	Endpoint string
+
+	// MetricPrefix is the prefix to use for all metric names (e.g., "aranet4_")
+	MetricPrefix string
+
+	// Labels are added to all metrics as resource attributes.
+	Labels map[string]string
+
+	// DryRun, if true, will log metrics instead of sending them.
+	DryRun bool
+
+	// LogSamples, if true, logs every sent point at info level.
+	LogSamples bool
+}
+
+// Sink buffers metrics and sends them as OTLP gauges. Points are only sent
+// when Flush is called, so that a whole refresh is exported in a single
+// request.
+type Sink struct {
+	client   *http.Client
+	url      string
+	config   *Config
+	resource *resourcepb.Resource
+
+	// pending is a map of metric name to points not yet sent.
+	pending map[string][]*metricspb.NumberDataPoint
+
+	// lastTimes is a map of metric name to the time of its last sent point,
+	// so that history read again on every refresh is only sent once.
+	lastTimes map[string]time.Time
+}
+
+// New creates a new OTLP sink with the given configuration.
+func New(config Config) (*Sink, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("Endpoint is required")
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL %q: %w", config.Endpoint, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", config.Endpoint)
+	}
+
+	resource := &resourcepb.Resource{}
+	for _, name := range slices.Sorted(maps.Keys(config.Labels)) {
+		resource.Attributes = append(resource.Attributes, &commonpb.KeyValue{
+			Key:   name,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: config.Labels[name]}},
+		})
+	}
+
+	metricsURL := u.JoinPath("/v1/metrics")
+	slog.Debug("OTLP sink created", "url", metricsURL.String(), "prefix", config.MetricPrefix, "labels", config.Labels)
+
+	return &Sink{
+		client:    &http.Client{Timeout: time.Minute},
+		url:       metricsURL.String(),
+		config:    &config,
+		resource:  resource,
+		pending:   make(map[string][]*metricspb.NumberDataPoint),
+		lastTimes: make(map[string]time.Time),
+	}, nil
+}
+
+// ReportMetric buffers a metric value to be sent on the next Flush. Values
+// not newer than the last one sent or buffered for the metric are skipped.
+func (s *Sink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if ts.IsZero() {
+		return fmt.Errorf("cannot report metric %q with zero timestamp", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("metric %q value %v: %w", name, value, ErrNonFinite)
+	}
+
+	last := s.lastTimes[name]
+	if pts := s.pending[name]; len(pts) > 0 {
+		last = time.Unix(0, int64(pts[len(pts)-1].TimeUnixNano))
+	}
+	if !ts.After(last) {
+		slog.Debug("skipping value with timestamp before last reported", "metric", name, "ts", ts, "last", last)
+		return nil
+	}
+
+	s.pending[name] = append(s.pending[name], &metricspb.NumberDataPoint{
+		TimeUnixNano: uint64(ts.UnixNano()),
+		Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	})
+	return nil
+}
+
+// Flush sends all buffered points in a single request. Points are kept if
+// sending fails, so that they are retried on the next Flush, unless the
+// request was rejected: retrying it would fail the same way.
+func (s *Sink) Flush(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	req := s.request()
+	if s.config.DryRun {
+		// Nothing was sent, so last sent times are not advanced.
+		slog.Info("dry run, skipping OTLP export", "request", protojson.Format(req))
+		clear(s.pending)
+		return nil
+	}
+
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+	err = s.send(ctx, body)
+	if err != nil && !errors.Is(err, errRejected) {
+		return err
+	}
+
+	for name, pts := range s.pending {
+		if s.config.LogSamples && err == nil {
+			for _, pt := range pts {
+				slog.Info("sent sample", "metric", s.config.MetricPrefix+name, "value", pt.GetAsDouble(), "ts", time.Unix(0, int64(pt.TimeUnixNano)).Format(time.RFC3339))
+			}
+		}
+		s.lastTimes[name] = time.Unix(0, int64(pts[len(pts)-1].TimeUnixNano))
+	}
+	clear(s.pending)
+	return err
+}
+
+// request returns an export request with a gauge for every metric with
+// buffered points, sorted by name.
+func (s *Sink) request() *colmetricspb.ExportMetricsServiceRequest {
+	scope := &metricspb.ScopeMetrics{
+		Scope: &commonpb.InstrumentationScope{Name: scopeName},
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.pending)) {
+		scope.Metrics = append(scope.Metrics, &metricspb.Metric{
+			Name: s.config.MetricPrefix + name,
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: s.pending[name]}},
+		})
+	}
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource:     s.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{scope},
+		}},
+	}
+}
+
+// send posts a protobuf-encoded export request.
+func (s *Sink) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("sending request: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			err = fmt.Errorf("%w: %w", errRejected, err)
+		}
+		return err
+	}
+	return nil
+}
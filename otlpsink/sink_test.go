@@ -0,0 +1,149 @@
+package otlpsink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{name: "valid config", config: Config{Endpoint: "http://localhost:4318"}},
+		{name: "missing endpoint", wantErr: "Endpoint is required"},
+		{name: "URL without host", config: Config{Endpoint: "http://"}, wantErr: "has no host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := New(tt.config)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				require.Nil(t, sink)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, sink)
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var requests []*colmetricspb.ExportMetricsServiceRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+		requests = append(requests, req)
+	}))
+	defer server.Close()
+
+	sink, err := New(Config{
+		Endpoint:     server.URL,
+		MetricPrefix: "test_",
+		Labels:       map[string]string{"job": "test", "instance": "test-instance", "device_addr": "AA:BB"},
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now.Add(-time.Hour), 500))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.NoError(t, sink.ReportMetric(ctx, "temperature_celsius", now, 21.5))
+	// Duplicate timestamps are skipped.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 700))
+	assert.Empty(t, requests, "Nothing should be sent before Flush")
+
+	require.NoError(t, sink.Flush(ctx))
+	require.Len(t, requests, 1, "All points should be sent in a single request")
+	require.Len(t, requests[0].ResourceMetrics, 1)
+	rm := requests[0].ResourceMetrics[0]
+
+	attrs := make(map[string]string)
+	for _, kv := range rm.Resource.Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	assert.Equal(t, map[string]string{"job": "test", "instance": "test-instance", "device_addr": "AA:BB"}, attrs)
+
+	require.Len(t, rm.ScopeMetrics, 1)
+	metrics := rm.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "test_co2_ppm", metrics[0].Name)
+	assert.Equal(t, "test_temperature_celsius", metrics[1].Name)
+	pts := metrics[0].GetGauge().DataPoints
+	require.Len(t, pts, 2)
+	// Points carry the time they were measured at.
+	assert.Equal(t, uint64(now.Add(-time.Hour).UnixNano()), pts[0].TimeUnixNano)
+	assert.Equal(t, 500.0, pts[0].GetAsDouble())
+	assert.Equal(t, uint64(now.UnixNano()), pts[1].TimeUnixNano)
+	assert.Equal(t, 600.0, pts[1].GetAsDouble())
+
+	// Already sent points are not sent again.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", now, 600))
+	require.NoError(t, sink.Flush(ctx))
+	assert.Len(t, requests, 1, "Flush with no new points should not send a request")
+}
+
+func TestReportMetric_Validation(t *testing.T) {
+	sink, err := New(Config{Endpoint: "http://localhost:4318"})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.ErrorContains(t, sink.ReportMetric(ctx, "co2_ppm", time.Time{}, 1), "zero timestamp")
+	require.ErrorIs(t, sink.ReportMetric(ctx, "co2_ppm", time.Now(), math.NaN()), ErrNonFinite)
+}
+
+func TestFlush_Error(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int
+	}{
+		// Points are kept after a failed flush, so they can be retried.
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantCalls: 2},
+		{name: "too many requests", status: http.StatusTooManyRequests, wantCalls: 2},
+		// Rejected points are dropped, and not reported again.
+		{name: "rejected", status: http.StatusBadRequest, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				http.Error(w, "failed", tt.status)
+			}))
+			defer server.Close()
+
+			sink, err := New(Config{Endpoint: server.URL})
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			ts := time.Now()
+			require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts, 500))
+			require.ErrorContains(t, sink.Flush(ctx), fmt.Sprint(tt.status))
+
+			require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts, 500))
+			if tt.wantCalls > 1 {
+				require.Error(t, sink.Flush(ctx))
+			} else {
+				require.NoError(t, sink.Flush(ctx))
+			}
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
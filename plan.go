@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+
+	"github.com/knyar/aranet4-prom-collector/promsync"
+)
+
+// planSkipInvalid is the plan action for records that fail validation.
+const planSkipInvalid = "skip-invalid"
+
+// planActions lists all plan actions in the order they are printed.
+var planActions = []string{promsync.PlanWrite, promsync.PlanSkipDuplicate, promsync.PlanSkipFuture, planSkipInvalid}
+
+// planner is implemented by sinks that can tell what they would do with a
+// metric value without writing it.
+type planner interface {
+	Plan(ctx context.Context, name string, ts time.Time) (string, error)
+}
+
+// planEntry summarizes records sharing the same plan action.
+type planEntry struct {
+	count          int
+	oldest, newest time.Time
+}
+
+// recordPlan classifies historic records in -plan mode. A nil recordPlan
+// ignores all records.
+type recordPlan map[string]*planEntry
+
+// add records the plan action for a single record.
+func (p recordPlan) add(data *aranet4.Data, action string) {
+	if p == nil {
+		return
+	}
+	e, ok := p[action]
+	if !ok {
+		e = &planEntry{oldest: data.Time}
+		p[action] = e
+	}
+	e.count++
+	if data.Time.Before(e.oldest) {
+		e.oldest = data.Time
+	}
+	if data.Time.After(e.newest) {
+		e.newest = data.Time
+	}
+}
+
+// print writes the plan summary table.
+func (p recordPlan) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tRECORDS\tOLDEST\tNEWEST")
+	for _, action := range planActions {
+		e, ok := p[action]
+		if !ok {
+			fmt.Fprintf(tw, "%s\t0\t-\t-\n", action)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", action, e.count, formatPlanTime(e.oldest), formatPlanTime(e.newest))
+	}
+	return tw.Flush()
+}
+
+func formatPlanTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// planRecord classifies a valid record by asking the sink about each of its
+// metrics, under the names they are written as (e.g. temperature_fahrenheit).
+// Derived metrics are left out, since they are not written for every record.
+// A record is written if any of its metrics would be written.
+func (c *collector) planRecord(ctx context.Context, data *aranet4.Data) (string, error) {
+	p, ok := c.sink.(planner)
+	if !ok {
+		return "", fmt.Errorf("sink %q does not support planning", *sinkType)
+	}
+	result := promsync.PlanSkipDuplicate
+	for _, m := range recordMetrics {
+		if m.derived {
+			continue
+		}
+		action, err := p.Plan(ctx, m.name, data.Time)
+		if err != nil {
+			return "", fmt.Errorf("planning %s: %w", m.name, err)
+		}
+		switch action {
+		case promsync.PlanWrite:
+			return action, nil
+		case promsync.PlanSkipFuture:
+			result = action
+		}
+	}
+	return result, nil
+}
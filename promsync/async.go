@@ -0,0 +1,127 @@
+package promsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// write is a single remote write request for samples with the same timestamp,
+// usually of one metric under all prefixes.
+type write struct {
+	ctx context.Context
+	req *prompb.WriteRequest
+	ts  time.Time
+
+	// keys, names and values are the prefixed metric name, the metric name
+	// and the value of each time series in req.
+	keys   []string
+	names  []string
+	values []float64
+}
+
+// asyncWriter sends write requests in the background, with a bounded number
+// of requests in flight. Writes of the same metric are sent one at a time and
+// in order, so that last reported times only ever advance; once a write
+// fails, later writes of that metric are dropped until the next Flush, so that
+// no gaps are left behind the last reported time.
+type asyncWriter struct {
+	send func(*write) error
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	mu sync.Mutex
+	// queues is a map of metric name to writes not yet sent. A metric has a
+	// goroutine sending its writes as long as it is in the map.
+	queues map[string][]*write
+	// queued is a map of prefixed metric name to the time of its last
+	// queued write.
+	queued map[string]time.Time
+	// failed is the set of metric names with a failed write.
+	failed map[string]bool
+	errs   []error
+}
+
+func newAsyncWriter(workers int, send func(*write) error) *asyncWriter {
+	return &asyncWriter{
+		send:   send,
+		sem:    make(chan struct{}, workers),
+		queues: make(map[string][]*write),
+		queued: make(map[string]time.Time),
+		failed: make(map[string]bool),
+	}
+}
+
+// enqueue queues a write of the metric name. It returns false if the write was
+// dropped because an earlier write of the metric failed.
+func (a *asyncWriter) enqueue(name string, w *write) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failed[name] {
+		return false
+	}
+	for _, key := range w.keys {
+		a.queued[key] = w.ts
+	}
+	q, running := a.queues[name]
+	a.queues[name] = append(q, w)
+	if !running {
+		a.wg.Add(1)
+		go a.run(name)
+	}
+	return true
+}
+
+// queuedTime returns the time of the last queued write of a prefixed metric
+// name, or the zero time if there is none.
+func (a *asyncWriter) queuedTime(key string) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queued[key]
+}
+
+// run sends queued writes of a metric until its queue is empty.
+func (a *asyncWriter) run(name string) {
+	defer a.wg.Done()
+	for {
+		a.mu.Lock()
+		q := a.queues[name]
+		if len(q) == 0 {
+			delete(a.queues, name)
+			a.mu.Unlock()
+			return
+		}
+		w := q[0]
+		a.queues[name] = q[1:]
+		a.mu.Unlock()
+
+		a.sem <- struct{}{}
+		err := a.send(w)
+		<-a.sem
+		if err != nil {
+			a.mu.Lock()
+			a.errs = append(a.errs, fmt.Errorf("writing metric %q: %w", name, err))
+			a.failed[name] = true
+			delete(a.queues, name)
+			a.mu.Unlock()
+			return
+		}
+	}
+}
+
+// wait blocks until all queued writes have been sent, and returns the errors
+// of failed writes.
+func (a *asyncWriter) wait() error {
+	a.wg.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := errors.Join(a.errs...)
+	a.errs = nil
+	clear(a.queued)
+	clear(a.failed)
+	return err
+}
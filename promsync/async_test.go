@@ -0,0 +1,142 @@
+package promsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// emptyQueryHandler answers every query with an empty vector, as on a cold start.
+var emptyQueryHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   map[string]any{"resultType": "vector", "result": []any{}},
+	})
+})
+
+func TestReportMetric_Async(t *testing.T) {
+	var mu sync.Mutex
+	written := make(map[string][]int64)
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := decodeWriteRequest(t, r)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ts := range req.Timeseries {
+			name := ts.Labels[0].Value
+			if strings.HasPrefix(name, "test_fail") && len(written[name]) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			written[name] = append(written[name], ts.Samples[0].Timestamp)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+	syncer.async = newAsyncWriter(3, syncer.send)
+
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := range 10 {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		for _, name := range []string{"co2", "temperature", "fail"} {
+			require.NoError(t, syncer.ReportMetric(ctx, name, ts, float64(i)))
+			// Duplicates of queued writes are skipped.
+			require.NoError(t, syncer.ReportMetric(ctx, name, ts, float64(i)))
+		}
+	}
+	err := syncer.Flush(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `writing metric "fail"`)
+
+	for _, name := range []string{"test_co2", "test_temperature"} {
+		require.Len(t, written[name], 10, name)
+		for i, ts := range written[name] {
+			assert.Equal(t, start.Add(time.Duration(i)*time.Minute).UnixMilli(), ts, name)
+		}
+		assert.Equal(t, start.Add(9*time.Minute), syncer.lastTimes[name])
+	}
+	// Writes after the failed one are dropped, leaving no gap.
+	assert.Len(t, written["test_fail"], 1)
+	assert.Equal(t, start, syncer.lastTimes["test_fail"])
+
+	// The next refresh continues after the last successful write.
+	require.NoError(t, syncer.ReportMetric(ctx, "fail", start, 0))
+	require.NoError(t, syncer.Flush(ctx))
+	assert.Len(t, written["test_fail"], 1)
+}
+
+func TestAbort(t *testing.T) {
+	var mu sync.Mutex
+	var written []int64
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := decodeWriteRequest(t, r)
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, req.Timeseries[0].Samples[0].Timestamp)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+	syncer.async = newAsyncWriter(1, syncer.send)
+
+	// A refresh fails with writes queued against its cancelled context.
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := time.Now().Add(-time.Hour).Truncate(time.Second)
+	syncer.async.sem <- struct{}{}
+	for i := range 3 {
+		require.NoError(t, syncer.ReportMetric(ctx, "co2", ts.Add(time.Duration(i)*time.Minute), float64(i)))
+	}
+	cancel()
+	<-syncer.async.sem
+	syncer.Abort()
+	assert.Empty(t, written)
+
+	// The next refresh writes them again, and doesn't fail on the errors of
+	// the aborted writes.
+	for i := range 3 {
+		require.NoError(t, syncer.ReportMetric(context.Background(), "co2", ts.Add(time.Duration(i)*time.Minute), float64(i)))
+	}
+	require.NoError(t, syncer.Flush(context.Background()))
+	assert.Len(t, written, 3)
+}
+
+func BenchmarkReportMetric(b *testing.B) {
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate the round trip to a remote backend.
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	metrics := []string{"co2_ppm", "humidity_percent", "pressure_hpa", "temperature_celsius"}
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			syncer := createTestSyncerWithMocks(b, emptyQueryHandler, writeHandler)
+			if workers > 0 {
+				syncer.async = newAsyncWriter(workers, syncer.send)
+			}
+			ctx := context.Background()
+			ts := time.Now().Add(-24 * time.Hour)
+			for b.Loop() {
+				// A refresh backfilling ten records of all metrics.
+				for range 10 {
+					ts = ts.Add(time.Second)
+					for _, name := range metrics {
+						if err := syncer.ReportMetric(ctx, name, ts, 1); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if err := syncer.Flush(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package promsync
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher buffers writes to be sent together by Flush, in requests of up to
+// size samples, so that backfilling a long history takes a handful of
+// requests instead of one per record.
+type batcher struct {
+	size int
+
+	mu     sync.Mutex
+	writes []*write
+	// buffered is a map of prefixed metric name to the time of its last
+	// buffered write.
+	buffered map[string]time.Time
+}
+
+func newBatcher(size int) *batcher {
+	return &batcher{size: size, buffered: make(map[string]time.Time)}
+}
+
+// add buffers a write.
+func (b *batcher) add(w *write) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writes = append(b.writes, w)
+	for _, key := range w.keys {
+		b.buffered[key] = w.ts
+	}
+}
+
+// bufferedTime returns the time of the last buffered write of a prefixed
+// metric name, or the zero time if there is none.
+func (b *batcher) bufferedTime(key string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffered[key]
+}
+
+// take removes all buffered writes and returns them split into batches of up
+// to size samples, keeping them in order. A write with more samples than size
+// gets a batch of its own.
+func (b *batcher) take() [][]*write {
+	b.mu.Lock()
+	writes := b.writes
+	b.writes = nil
+	clear(b.buffered)
+	b.mu.Unlock()
+
+	var batches [][]*write
+	var batch []*write
+	n := 0
+	for _, w := range writes {
+		if len(batch) > 0 && n+len(w.keys) > b.size {
+			batches = append(batches, batch)
+			batch, n = nil, 0
+		}
+		batch = append(batch, w)
+		n += len(w.keys)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
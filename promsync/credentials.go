@@ -0,0 +1,115 @@
+package promsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// CredentialHelperConfig configures an external command that prints a bearer
+// token for authenticating requests, for setups with short-lived credentials.
+//
+// The command prints either the token itself, which is then cached for TTL,
+// or a JSON object like {"token": "...", "expiry": "2006-01-02T15:04:05Z"},
+// in which case the token is cached until shortly before it expires.
+type CredentialHelperConfig struct {
+	// Command is the program to run and its arguments.
+	Command []string
+
+	// Timeout bounds a single run of the command (default 10s).
+	Timeout time.Duration
+
+	// TTL is how long tokens without an expiry are cached (default 5m).
+	TTL time.Duration
+}
+
+// credentialExpiryMargin is how long before its expiry a token is refreshed,
+// so that it does not expire while a request is in flight.
+const credentialExpiryMargin = 30 * time.Second
+
+// credentialTransport is an http.RoundTripper that sets a bearer token
+// obtained from a credential helper on every request.
+type credentialTransport struct {
+	base   http.RoundTripper
+	config CredentialHelperConfig
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newCredentialTransport wraps base with bearer tokens from a credential helper.
+func newCredentialTransport(config *CredentialHelperConfig, base http.RoundTripper) (*credentialTransport, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("credential helper command is required")
+	}
+	if config.Timeout < 0 || config.TTL < 0 {
+		return nil, fmt.Errorf("credential helper timeout and TTL must not be negative")
+	}
+	t := &credentialTransport{base: base, config: *config}
+	if t.config.Timeout == 0 {
+		t.config.Timeout = 10 * time.Second
+	}
+	if t.config.TTL == 0 {
+		t.config.TTL = 5 * time.Minute
+	}
+	return t, nil
+}
+
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.getToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// getToken returns the cached token, running the helper if it has expired.
+func (t *credentialTransport) getToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.config.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.config.Command[0], t.config.Command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Don't wait for output of children that outlive a killed helper.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running credential helper %q: %w: %s", t.config.Command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	out = bytes.TrimSpace(out)
+	token := string(out)
+	expiry := time.Now().Add(t.config.TTL)
+	if bytes.HasPrefix(out, []byte("{")) {
+		var cred struct {
+			Token  string    `json:"token"`
+			Expiry time.Time `json:"expiry"`
+		}
+		if err := json.Unmarshal(out, &cred); err != nil {
+			return "", fmt.Errorf("parsing credential helper output: %w", err)
+		}
+		token = cred.Token
+		if !cred.Expiry.IsZero() {
+			expiry = cred.Expiry.Add(-credentialExpiryMargin)
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("credential helper %q returned no token", t.config.Command[0])
+	}
+	t.token, t.expiry = token, expiry
+	return token, nil
+}
@@ -0,0 +1,103 @@
+package promsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// helperCommand returns a credential helper command running a shell script,
+// and a function returning how many times it ran.
+func helperCommand(t *testing.T, script string) ([]string, func() int) {
+	t.Helper()
+	runs := filepath.Join(t.TempDir(), "runs")
+	command := []string{"sh", "-c", "echo >> " + runs + "; " + script}
+	return command, func() int {
+		b, err := os.ReadFile(runs)
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(b), "\n")
+	}
+}
+
+func TestCredentialTransport(t *testing.T) {
+	expired := time.Now().Add(10 * time.Second).UTC().Format(time.RFC3339)
+	valid := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name     string
+		script   string
+		wantAuth string
+		wantRuns int
+		wantErr  string
+	}{
+		{name: "plain token", script: "echo secret", wantAuth: "Bearer secret", wantRuns: 1},
+		{name: "json with expiry", script: `echo '{"token":"abc","expiry":"` + valid + `"}'`, wantAuth: "Bearer abc", wantRuns: 1},
+		{name: "json expiring soon", script: `echo '{"token":"abc","expiry":"` + expired + `"}'`, wantAuth: "Bearer abc", wantRuns: 3},
+		{name: "empty output", script: "true", wantErr: "returned no token"},
+		{name: "failing command", script: "echo denied >&2; exit 1", wantErr: "denied"},
+		{name: "invalid json", script: "echo '{'", wantErr: "parsing credential helper output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = append(auth, r.Header.Get("Authorization"))
+			}))
+			defer server.Close()
+
+			command, runs := helperCommand(t, tt.script)
+			transport, err := newCredentialTransport(&CredentialHelperConfig{Command: command}, http.DefaultTransport)
+			require.NoError(t, err)
+			client := &http.Client{Transport: transport}
+
+			for range 3 {
+				resp, err := client.Get(server.URL)
+				if tt.wantErr != "" {
+					require.ErrorContains(t, err, tt.wantErr)
+					return
+				}
+				require.NoError(t, err)
+				resp.Body.Close()
+			}
+			assert.Equal(t, []string{tt.wantAuth, tt.wantAuth, tt.wantAuth}, auth)
+			assert.Equal(t, tt.wantRuns, runs(), "helper runs")
+		})
+	}
+}
+
+func TestCredentialTransport_Timeout(t *testing.T) {
+	transport, err := newCredentialTransport(&CredentialHelperConfig{
+		Command: []string{"sleep", "10"},
+		Timeout: 50 * time.Millisecond,
+	}, http.DefaultTransport)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = transport.getToken(context.Background())
+	require.ErrorContains(t, err, "running credential helper")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNew_CredentialHelper(t *testing.T) {
+	_, err := New(Config{
+		PrometheusEndpoint: "http://localhost:9090",
+		SigV4:              &SigV4Config{Region: "us-east-1"},
+		CredentialHelper:   &CredentialHelperConfig{Command: []string{"true"}},
+	})
+	require.ErrorContains(t, err, "mutually exclusive")
+
+	_, err = New(Config{
+		PrometheusEndpoint: "http://localhost:9090",
+		CredentialHelper:   &CredentialHelperConfig{},
+	})
+	require.ErrorContains(t, err, "command is required")
+}
@@ -0,0 +1,58 @@
+package promsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSigV4Transport_Validation(t *testing.T) {
+	_, err := newSigV4Transport(&SigV4Config{}, http.DefaultTransport)
+	require.ErrorContains(t, err, "region is required")
+
+	_, err = newSigV4Transport(&SigV4Config{Region: "us-east-1", AccessKey: "AKID"}, http.DefaultTransport)
+	require.ErrorContains(t, err, "must be set together")
+}
+
+func TestReportMetric_SigV4(t *testing.T) {
+	var writeAuth, queryAuth string
+	var writeSeries int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/write" {
+			writeAuth = r.Header.Get("Authorization")
+			req := decodeWriteRequest(t, r)
+			writeSeries = len(req.Timeseries)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		queryAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer server.Close()
+
+	syncer, err := New(Config{
+		PrometheusEndpoint: server.URL,
+		MetricPrefix:       "test_",
+		SigV4: &SigV4Config{
+			Region:    "eu-west-1",
+			AccessKey: "AKIDEXAMPLE",
+			SecretKey: "secret",
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1.0))
+
+	for _, auth := range []string{queryAuth, writeAuth} {
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), auth)
+		assert.Contains(t, auth, "/eu-west-1/aps/aws4_request")
+	}
+	assert.Equal(t, 1, writeSeries, "Body should be intact after signing")
+}
@@ -0,0 +1,107 @@
+package promsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state is the content of StateFile.
+type state struct {
+	// Labels are the labels of all metrics the times were written with.
+	Labels map[string]string `json:"labels"`
+
+	// LastTimes is a map of prefixed metric name to the last time it was written.
+	LastTimes map[string]time.Time `json:"last_times"`
+}
+
+// stateLabels returns the labels saved with the state, which need to match
+// for the saved times to be used.
+func (c *Config) stateLabels() map[string]string {
+	all := make(map[string]string)
+	maps.Copy(all, c.Labels)
+	maps.Copy(all, c.ExtraLabels)
+	return all
+}
+
+// loadState returns the last reported times saved in StateFile. It returns
+// no times if the file does not exist, is older than StateMaxAge, or was saved
+// with different labels.
+func loadState(config *Config) (map[string]time.Time, error) {
+	info, err := os.Stat(config.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if age := time.Since(info.ModTime()); age > config.StateMaxAge {
+		slog.Info("ignoring stale state file", "file", config.StateFile, "age", age, "max_age", config.StateMaxAge)
+		return nil, nil
+	}
+	b, err := os.ReadFile(config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	var st state
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", config.StateFile, err)
+	}
+	if !maps.Equal(st.Labels, config.stateLabels()) {
+		slog.Info("ignoring state file saved with different labels", "file", config.StateFile)
+		return nil, nil
+	}
+	slog.Debug("loaded last times from state file", "file", config.StateFile, "metrics", len(st.LastTimes))
+	return st.LastTimes, nil
+}
+
+// saveState writes the last reported times to StateFile if they changed
+// since they were last saved. The file is replaced atomically, so that it
+// is never left half-written.
+func (s *Syncer) saveState() error {
+	s.mu.Lock()
+	if !s.stateDirty {
+		s.mu.Unlock()
+		return nil
+	}
+	// Metrics without samples are left out, so that they are queried again
+	// after a restart.
+	times := maps.Clone(s.lastTimes)
+	maps.DeleteFunc(times, func(_ string, t time.Time) bool { return t.IsZero() })
+	b, err := json.Marshal(state{Labels: s.config.stateLabels(), LastTimes: times})
+	s.stateDirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(s.config.StateFile, b)
+	}
+	if err != nil {
+		// Try again on the next flush.
+		s.mu.Lock()
+		s.stateDirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to path.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
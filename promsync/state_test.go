@@ -0,0 +1,100 @@
+package promsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		age         time.Duration
+		content     string
+		wantQueries int32
+		wantWrites  int32
+	}{
+		{name: "restart", labels: map[string]string{"job": "test"}},
+		{name: "labels changed", labels: map[string]string{"job": "other"}, wantQueries: 1, wantWrites: 1},
+		{name: "stale", labels: map[string]string{"job": "test"}, age: 2 * time.Hour, wantQueries: 1, wantWrites: 1},
+		{name: "corrupted", labels: map[string]string{"job": "test"}, content: "{", wantQueries: 1, wantWrites: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries, writes atomic.Int32
+			apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queries.Add(1)
+				emptyQueryHandler(w, r)
+			}))
+			defer apiServer.Close()
+			writeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writes.Add(1)
+			}))
+			defer writeServer.Close()
+
+			path := filepath.Join(t.TempDir(), "state.json")
+			newSyncer := func(labels map[string]string) *Syncer {
+				s, err := New(Config{
+					PrometheusEndpoint: apiServer.URL,
+					RemoteWriteURL:     writeServer.URL,
+					MetricPrefix:       "test_",
+					Labels:             labels,
+					StateFile:          path,
+				})
+				require.NoError(t, err)
+				return s
+			}
+
+			ctx := context.Background()
+			ts := time.Now().Add(-time.Minute).Truncate(time.Second)
+			s := newSyncer(map[string]string{"job": "test"})
+			require.NoError(t, s.ReportMetric(ctx, "co2_ppm", ts, 400))
+			require.NoError(t, s.Flush(ctx))
+			require.FileExists(t, path)
+
+			if tt.age > 0 {
+				old := time.Now().Add(-tt.age)
+				require.NoError(t, os.Chtimes(path, old, old))
+			}
+			if tt.content != "" {
+				require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+			}
+			queries.Store(0)
+			writes.Store(0)
+
+			s = newSyncer(tt.labels)
+			require.NoError(t, s.ReportMetric(ctx, "co2_ppm", ts, 400))
+			assert.Equal(t, tt.wantQueries, queries.Load(), "queries")
+			assert.Equal(t, tt.wantWrites, writes.Load(), "writes")
+		})
+	}
+}
+
+func TestStateFile_NoSamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s := createTestSyncerWithMocks(t, emptyQueryHandler, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s.config.StateFile, s.config.StateMaxAge = path, time.Hour
+
+	ctx := context.Background()
+	_, err := s.Plan(ctx, "humidity_percent", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, s.ReportMetric(ctx, "co2_ppm", time.Now(), 400))
+	require.NoError(t, s.Flush(ctx))
+
+	// Metrics without samples are queried again after a restart.
+	times, err := loadState(s.config)
+	require.NoError(t, err)
+	assert.Contains(t, times, "test_co2_ppm")
+	assert.NotContains(t, times, "test_humidity_percent")
+}
@@ -2,11 +2,16 @@ package promsync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
+	"net/http"
 	"net/url"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/castai/promwrite"
@@ -17,23 +22,182 @@ import (
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// ErrFutureTimestamp is returned by ReportMetric for values with a timestamp
+// too far in the future.
+var ErrFutureTimestamp = errors.New("timestamp too far in the future")
+
+// ErrNonFinite is returned by ReportMetric for NaN and infinite values, which
+// would break aggregations of the series.
+var ErrNonFinite = errors.New("value is not finite")
+
 // Config holds configuration for the Prometheus syncer.
 type Config struct {
 	// PrometheusEndpoint is the base URL of the Prometheus instance (e.g., "http://localhost:9090/")
 	PrometheusEndpoint string
 
+	// RemoteWriteURL, if set, overrides the remote write URL, which defaults
+	// to PrometheusEndpoint with /api/v1/write appended.
+	RemoteWriteURL string
+
 	// MetricPrefix is the prefix to use for all metric names (e.g., "aranet4_")
 	MetricPrefix string
 
+	// AdditionalPrefixes are extra prefixes under which every metric is also
+	// written (e.g., during a migration to a new prefix). Each prefix is
+	// deduplicated independently, and each one multiplies the number of
+	// written samples.
+	AdditionalPrefixes []string
+
 	// Labels are additional labels to add to all metrics.
 	// Common labels include "job", "instance", etc.
 	Labels map[string]string
 
+	// ExtraLabels are free-form labels to add to all metrics. They must not
+	// use any of the names in Labels.
+	ExtraLabels map[string]string
+
 	// DryRun, if true, will log metrics instead of writing them to Prometheus.
+	// It has no side effects: the same samples are logged again when reported
+	// again, and would still be written by a later write that is not a dry run.
 	DryRun bool
+
+	// LogSamples, if true, logs every written sample at info level.
+	LogSamples bool
+
+	// Registerer registers the metrics of the syncer itself (default
+	// prometheus.DefaultRegisterer). Syncers for different devices should
+	// use registerers wrapped with the device labels, so that each of them
+	// has its own metrics.
+	Registerer prometheus.Registerer
+
+	// DedupResolution is the precision used to compare sample timestamps with
+	// the last reported time: time.Second (the default) or time.Millisecond.
+	// Timestamps are truncated to this resolution before comparing, so a
+	// sample in the same second (or millisecond) as the last one is treated
+	// as a duplicate. Millisecond resolution requires a backend whose
+	// timestamp() function preserves sub-second precision, like Prometheus.
+	DedupResolution time.Duration
+
+	// DedupMatchLabels, if set, restricts the query for the last reported
+	// time to these labels (e.g. "device_addr"), so that series written
+	// before other labels changed are still found. The metric name is always
+	// matched. If more than one series matches, the latest timestamp is used.
+	// Defaults to all labels.
+	DedupMatchLabels []string
+
+	// DedupBestEffort, if true, keeps writing when querying the last reported
+	// time of a metric fails, e.g. with a write-only endpoint: metrics written
+	// since startup are still deduplicated using the last times kept in
+	// memory, while others are written as on a cold start. Writes of such
+	// metrics rejected because the samples are out of order or duplicates,
+	// as happens when history already written before a restart is written
+	// again, are then treated as written rather than failing.
+	DedupBestEffort bool
+
+	// LookbackDelta is how far back the last reported time of a metric is
+	// looked up (default DefaultLookbackDelta). If the last sample of a
+	// metric is older than that, it is not found, and all history stored on
+	// the device is written again.
+	LookbackDelta time.Duration
+
+	// MaxFutureSkew is how far ahead of the local clock a timestamp may be
+	// for ReportMetric to accept it (default DefaultMaxFutureSkew).
+	MaxFutureSkew time.Duration
+
+	// DedupConcurrency is the number of queries Warmup runs at a time
+	// (default 1).
+	DedupConcurrency int
+
+	// SigV4, if set, signs all requests with AWS Signature Version 4 for
+	// Amazon Managed Service for Prometheus.
+	SigV4 *SigV4Config
+
+	// AsyncWriters, if positive, makes ReportMetric queue writes instead of
+	// sending them, with up to this many write requests in flight. Writes of
+	// different metrics are sent concurrently, while writes of the same
+	// metric are sent in order. Flush must be called to wait for queued
+	// writes and get their errors.
+	AsyncWriters int
+
+	// BatchSize, if positive, makes ReportMetric and ReportMetrics buffer
+	// samples instead of writing them, and Flush write them in requests of up
+	// to this many samples. It can't be used together with AsyncWriters.
+	BatchSize int
+
+	// WriteRetries is the number of times a failed remote write request is
+	// retried (default 0). Requests rejected with a client error are not
+	// retried.
+	WriteRetries int
+
+	// RetryBackoff is the delay before the first retry of a failed remote
+	// write request (default 1s). It doubles with every retry.
+	RetryBackoff time.Duration
+
+	// WriteTimeout is the timeout of a single remote write request (default
+	// 30s), so that a stuck connection fails the write rather than blocking
+	// the refresh until it times out.
+	WriteTimeout time.Duration
+
+	// StateFile, if set, is a file that Flush saves the last reported times
+	// to, and New loads them from, so that a restart doesn't need to query
+	// Prometheus for the last time of every metric again. Times saved with
+	// different labels are ignored.
+	StateFile string
+
+	// StateMaxAge is how old StateFile may be for its times to be used
+	// (default 1h). Older times are queried from Prometheus again, in case
+	// something else wrote the metrics in the meantime.
+	StateMaxAge time.Duration
+
+	// CredentialHelper, if set, runs a command to get a bearer token for all
+	// requests. It can't be used together with SigV4.
+	CredentialHelper *CredentialHelperConfig
+
+	// BasicAuthUser, if set, authenticates all requests with HTTP basic auth,
+	// using BasicAuthPassword or the content of BasicAuthPasswordFile (read
+	// once, without a trailing newline) as the password. It can't be used
+	// together with other authentication methods.
+	BasicAuthUser         string
+	BasicAuthPassword     string
+	BasicAuthPasswordFile string
+
+	// BearerToken, if set, is sent as a bearer token with all requests.
+	// BearerTokenFile is an alternative, read on every request so that a
+	// rotated token is picked up without a restart. Neither can be used
+	// together with other authentication methods.
+	BearerToken     string
+	BearerTokenFile string
+
+	// TenantID, if set, is sent as the X-Scope-OrgID header with all
+	// requests, for multi-tenant backends like Grafana Mimir and Cortex.
+	TenantID string
+
+	// TLSCACertFile, if set, is a PEM file with the CA certificates used to
+	// verify the Prometheus server certificate instead of the system ones.
+	TLSCACertFile string
+
+	// TLSClientCertFile and TLSClientKeyFile, if set, are PEM files with a
+	// client certificate and its key, presented to Prometheus for mutual TLS.
+	// They must be set together.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+
+	// TLSInsecureSkipVerify, if true, disables verification of the
+	// Prometheus server certificate.
+	TLSInsecureSkipVerify bool
+
+	// IdleConnTimeout is how long idle connections to Prometheus are kept
+	// open for reuse (default 90s). With long refresh intervals connections
+	// go cold anyway, so there is little point in raising it above the time
+	// a single refresh takes.
+	IdleConnTimeout time.Duration
+
+	// RemoteWriteVersionHeader, if set, overrides the value of the
+	// X-Prometheus-Remote-Write-Version header sent with write requests
+	// (promwrite sends "0.1.0" by default).
+	RemoteWriteVersionHeader string
 }
 
 // Syncer writes metrics to Prometheus using Remote Write API, attempting to avoid
@@ -46,8 +210,34 @@ type Syncer struct {
 	// metricWrites is a counter of metric write attempts.
 	metricWrites *prometheus.CounterVec
 
-	// lastTimes is a map of metric name to the last time it was written.
+	// writeRetries is a counter of retried remote write requests.
+	writeRetries prometheus.Counter
+
+	// lastWrite is a gauge of the last time each metric was written.
+	lastWrite *prometheus.GaugeVec
+
+	// dedupQueryFailures is a counter of failed last time queries ignored
+	// with DedupBestEffort.
+	dedupQueryFailures prometheus.Counter
+
+	// clockSkew is a gauge of the last measured clock skew.
+	clockSkew prometheus.Gauge
+
+	// async sends writes in the background if AsyncWriters is set.
+	async *asyncWriter
+
+	// batch buffers writes until Flush if BatchSize is set.
+	batch *batcher
+
+	// mu guards lastTimes, which can be reset from the web server.
+	mu sync.Mutex
+	// lastTimes is a map of prefixed metric name to the last time it was written.
 	lastTimes map[string]time.Time
+	// stateDirty is whether lastTimes changed since StateFile was saved.
+	stateDirty bool
+	// undeduped is the set of prefixed metric names written without
+	// deduplication with DedupBestEffort, until a write of them succeeds.
+	undeduped map[string]bool
 }
 
 // New creates a new Prometheus syncer with the given configuration.
@@ -56,6 +246,31 @@ func New(config Config) (*Syncer, error) {
 		return nil, fmt.Errorf("PrometheusEndpoint is required")
 	}
 
+	switch config.DedupResolution {
+	case 0:
+		config.DedupResolution = time.Second
+	case time.Second, time.Millisecond:
+	default:
+		return nil, fmt.Errorf("DedupResolution must be a second or a millisecond, got %v", config.DedupResolution)
+	}
+
+	for name := range config.ExtraLabels {
+		if _, ok := config.Labels[name]; ok {
+			return nil, fmt.Errorf("label %q is configured more than once", name)
+		}
+		if name == model.MetricNameLabel {
+			return nil, fmt.Errorf("label %q is reserved", name)
+		}
+	}
+
+	for _, name := range config.DedupMatchLabels {
+		_, inLabels := config.Labels[name]
+		_, inExtra := config.ExtraLabels[name]
+		if !inLabels && !inExtra && name != model.MetricNameLabel {
+			return nil, fmt.Errorf("dedup match label %q is not configured", name)
+		}
+	}
+
 	url, err := url.Parse(config.PrometheusEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL %q: %w", config.PrometheusEndpoint, err)
@@ -67,51 +282,365 @@ func New(config Config) (*Syncer, error) {
 		return nil, fmt.Errorf("URL %q has no scheme", config.PrometheusEndpoint)
 	}
 
-	client, err := api.NewClient(api.Config{Address: url.String()})
+	if config.AsyncWriters < 0 {
+		return nil, fmt.Errorf("AsyncWriters must not be negative")
+	}
+
+	if config.BatchSize < 0 {
+		return nil, fmt.Errorf("BatchSize must not be negative")
+	}
+	if config.BatchSize > 0 && config.AsyncWriters > 0 {
+		return nil, fmt.Errorf("BatchSize and AsyncWriters are mutually exclusive")
+	}
+
+	if config.DedupConcurrency < 0 {
+		return nil, fmt.Errorf("DedupConcurrency must not be negative")
+	}
+
+	if config.LookbackDelta < 0 {
+		return nil, fmt.Errorf("LookbackDelta must not be negative")
+	}
+	if config.LookbackDelta == 0 {
+		config.LookbackDelta = DefaultLookbackDelta
+	}
+
+	if config.MaxFutureSkew < 0 {
+		return nil, fmt.Errorf("MaxFutureSkew must not be negative")
+	}
+	if config.MaxFutureSkew == 0 {
+		config.MaxFutureSkew = DefaultMaxFutureSkew
+	}
+
+	if config.WriteRetries < 0 || config.RetryBackoff < 0 {
+		return nil, fmt.Errorf("WriteRetries and RetryBackoff must not be negative")
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	if config.WriteTimeout < 0 {
+		return nil, fmt.Errorf("WriteTimeout must not be negative")
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = 30 * time.Second
+	}
+
+	if config.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("IdleConnTimeout must not be negative")
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = 90 * time.Second
+	}
+
+	// Queries and writes go to the same host in quick succession, so a
+	// couple of idle connections (or one per async writer) are enough to
+	// avoid repeated handshakes.
+	pool := http.DefaultTransport.(*http.Transport).Clone()
+	pool.MaxIdleConnsPerHost = max(2, config.AsyncWriters)
+	pool.MaxIdleConns = 2 * pool.MaxIdleConnsPerHost
+	pool.IdleConnTimeout = config.IdleConnTimeout
+	if pool.TLSClientConfig, err = tlsConfig(&config); err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = pool
+	if config.TenantID != "" {
+		transport = &headerTransport{
+			base:    transport,
+			headers: map[string]string{"X-Scope-OrgID": config.TenantID},
+		}
+	}
+	var auth []string
+	if config.SigV4 != nil {
+		auth = append(auth, "SigV4")
+	}
+	if config.CredentialHelper != nil {
+		auth = append(auth, "CredentialHelper")
+	}
+	if config.BasicAuthUser != "" {
+		auth = append(auth, "BasicAuthUser")
+	}
+	if config.BearerToken != "" {
+		auth = append(auth, "BearerToken")
+	}
+	if config.BearerTokenFile != "" {
+		auth = append(auth, "BearerTokenFile")
+	}
+	if len(auth) > 1 {
+		return nil, fmt.Errorf("%s are mutually exclusive", strings.Join(auth, " and "))
+	}
+	if config.BasicAuthUser != "" {
+		password, err := basicAuthPassword(&config)
+		if err != nil {
+			return nil, err
+		}
+		transport = &headerTransport{
+			base:    transport,
+			headers: map[string]string{"Authorization": basicAuth(config.BasicAuthUser, password)},
+		}
+	} else if config.BasicAuthPassword != "" || config.BasicAuthPasswordFile != "" {
+		return nil, fmt.Errorf("BasicAuthUser is required with a basic auth password")
+	}
+	if config.BearerToken != "" {
+		transport = &headerTransport{
+			base:    transport,
+			headers: map[string]string{"Authorization": "Bearer " + config.BearerToken},
+		}
+	}
+	if config.BearerTokenFile != "" {
+		transport = &tokenFileTransport{base: transport, path: config.BearerTokenFile}
+	}
+	if config.CredentialHelper != nil {
+		transport, err = newCredentialTransport(config.CredentialHelper, transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure credential helper: %w", err)
+		}
+	}
+	if config.SigV4 != nil {
+		transport, err = newSigV4Transport(config.SigV4, transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure SigV4: %w", err)
+		}
+	}
+
+	client, err := api.NewClient(api.Config{Address: url.String(), RoundTripper: transport})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Prometheus client: %w", err)
 	}
 
 	writeURL := url.JoinPath("/api/v1/write")
-	slog.Debug("Prometheus syncer created", "write-url", writeURL.String(), "prefix", config.MetricPrefix, "labels", config.Labels)
+	if config.RemoteWriteURL != "" {
+		writeURL, err = url.Parse(config.RemoteWriteURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse URL %q: %w", config.RemoteWriteURL, err)
+		}
+	}
+	reg := config.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	slog.Debug("Prometheus syncer created", "write-url", writeURL.String(), "prefix", config.MetricPrefix, "additional-prefixes", config.AdditionalPrefixes, "labels", config.Labels, "extra-labels", config.ExtraLabels)
+
+	metricWrites := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: config.MetricPrefix + "prometheus_writes_total",
+		Help: "Total number of metric write attempts by status",
+	}, []string{"status"})
+	metricWrites, err = register(reg, metricWrites)
+	if err != nil {
+		return nil, err
+	}
+	writeRetries, err := register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: config.MetricPrefix + "prometheus_write_retries_total",
+		Help: "Total number of retried remote write requests",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	lastWrite, err := register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: config.MetricPrefix + "metric_last_write_time_seconds",
+		Help: "The last time each metric was successfully written",
+	}, []string{"metric"}))
+	if err != nil {
+		return nil, err
+	}
+	dedupQueryFailures, err := register(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Name: config.MetricPrefix + "prometheus_dedup_query_failures_total",
+		Help: "Total number of failed queries for the last written time ignored with best effort deduplication",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	clockSkew, err := register(reg, prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: config.MetricPrefix + "prometheus_clock_skew_seconds",
+		Help: "How far the Prometheus clock was ahead of the local clock when last measured",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	writeTransport := transport
+	if config.RemoteWriteVersionHeader != "" {
+		writeTransport = &headerTransport{
+			base:    writeTransport,
+			headers: map[string]string{"X-Prometheus-Remote-Write-Version": config.RemoteWriteVersionHeader},
+		}
+	}
+	writeClient := &http.Client{Timeout: config.WriteTimeout, Transport: writeTransport}
 
-	return &Syncer{
-		write:     promwrite.NewClient(writeURL.String()),
+	s := &Syncer{
+		write:     promwrite.NewClient(writeURL.String(), promwrite.HttpClient(writeClient)),
 		api:       client,
 		config:    &config,
 		lastTimes: make(map[string]time.Time),
+		undeduped: make(map[string]bool),
+
+		metricWrites:       metricWrites,
+		writeRetries:       writeRetries,
+		lastWrite:          lastWrite,
+		dedupQueryFailures: dedupQueryFailures,
+		clockSkew:          clockSkew,
+	}
+	if config.AsyncWriters > 0 {
+		s.async = newAsyncWriter(config.AsyncWriters, s.send)
+	}
+	if config.BatchSize > 0 {
+		s.batch = newBatcher(config.BatchSize)
+	}
+	if config.StateFile != "" {
+		if s.config.StateMaxAge == 0 {
+			s.config.StateMaxAge = time.Hour
+		}
+		// The times are only a cache, so a broken file is not fatal.
+		saved, err := loadState(s.config)
+		if err != nil {
+			slog.Warn("failed to load state file", "file", config.StateFile, "error", err)
+		}
+		maps.Copy(s.lastTimes, saved)
+	}
+	return s, nil
+}
 
-		metricWrites: promauto.NewCounterVec(prometheus.CounterOpts{
-			Name: config.MetricPrefix + "prometheus_writes_total",
-			Help: "Total number of metric write attempts by status",
-		}, []string{"status"}),
-	}, nil
+// register registers a collector, or returns the existing one if it is already
+// registered: multiple syncers with the same prefix and registerer share their
+// metrics.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return c, fmt.Errorf("failed to register metrics: %w", err)
+		}
+		return are.ExistingCollector.(T), nil
+	}
+	return c, nil
+}
+
+// ClockSkew returns how far the clock of Prometheus is ahead of the local
+// clock, by comparing the result of a time() query with the local time halfway
+// through the request. Prometheus evaluates queries with its own clock when
+// no time is given, and rejects samples too far in the future of it.
+func (s *Syncer) ClockSkew(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	v, _, err := v1.NewAPI(s.api).Query(ctx, "time()", time.Time{})
+	if err != nil {
+		return 0, fmt.Errorf("querying time: %w", err)
+	}
+	local := start.Add(time.Since(start) / 2)
+	scalar, ok := v.(*model.Scalar)
+	if !ok {
+		return 0, fmt.Errorf("query time() returned %v, not a scalar", v.Type())
+	}
+	remote := time.UnixMilli(int64(math.Round(float64(scalar.Value) * 1000)))
+	skew := remote.Sub(local)
+	s.clockSkew.Set(skew.Seconds())
+	return skew, nil
+}
+
+// Check verifies that Prometheus can be queried and accepts remote write
+// requests, by running a trivial query and sending a write request with no
+// samples. It does not write any data, even if DryRun is false.
+func (s *Syncer) Check(ctx context.Context) error {
+	if _, _, err := v1.NewAPI(s.api).Query(ctx, "vector(1)", time.Now()); err != nil {
+		return fmt.Errorf("querying Prometheus: %w", err)
+	}
+	if _, err := s.write.WriteProto(ctx, &prompb.WriteRequest{}); err != nil {
+		return fmt.Errorf("sending empty remote write request: %w", err)
+	}
+	return nil
 }
 
-// lastTime returns the last time a metric was reported.
-func (s *Syncer) lastTime(ctx context.Context, metric string) (time.Time, error) {
-	last, ok := s.lastTimes[metric]
+// lastTime returns the last time a metric was reported under the given prefix.
+func (s *Syncer) lastTime(ctx context.Context, prefix, metric string) (time.Time, error) {
+	key := prefix + metric
+	s.mu.Lock()
+	last, ok := s.lastTimes[key]
+	s.mu.Unlock()
 	if ok {
 		return last, nil
 	}
 
-	api := v1.NewAPI(s.api)
-	query := fmt.Sprintf("timestamp(%s)", s.labelSet(metric).String())
-	// aranet4 stores data locally for up to 30 days.
-	// https://forum.aranet.com/aranet-home-devices-aranet4-aranet2-aranet-radiation-aranet-radon/how-long-does-the-aranet4-device-store-historic-data/
-	v, warn, err := api.Query(ctx, query, time.Now(), v1.WithLookbackDelta(30*24*time.Hour))
+	last, err := QueryLastTime(ctx, s.api, s.lastTimeQuery(prefix, metric), s.config.LookbackDelta)
+	if err != nil && s.config.DedupBestEffort {
+		// Not cached, so the query is retried on the next report.
+		slog.Warn("querying last written time failed, writing without deduplication", "metric", key, "error", err)
+		s.dedupQueryFailures.Inc()
+		s.mu.Lock()
+		s.undeduped[key] = true
+		s.mu.Unlock()
+		return time.Time{}, nil
+	}
 	if err != nil {
-		return time.Time{}, fmt.Errorf("querying metric %q: %w", metric, err)
+		return time.Time{}, fmt.Errorf("querying metric %q: %w", key, err)
+	}
+	// A metric without samples is cached too, so that it isn't queried
+	// again for every record until it is first written.
+	slog.Debug("last time", "metric", key, "last", last)
+	s.mu.Lock()
+	s.lastTimes[key] = last
+	s.mu.Unlock()
+	return last, nil
+}
+
+// Warmup queries the last reported times of the given metrics under every
+// prefix, running up to DedupConcurrency queries at a time, so that a cold
+// start doesn't wait for one query per metric in turn. Times that are already
+// known are not queried again.
+func (s *Syncer) Warmup(ctx context.Context, names []string) error {
+	sem := make(chan struct{}, max(1, s.config.DedupConcurrency))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, prefix := range s.prefixes() {
+		for _, name := range names {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if err := ctx.Err(); err != nil {
+				wg.Wait()
+				return err
+			}
+			wg.Go(func() {
+				defer func() { <-sem }()
+				if _, err := s.lastTime(ctx, prefix, name); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			})
+		}
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// DefaultLookbackDelta is how far back QueryLastTime looks for the last sample
+// by default: aranet4 stores data locally for up to 30 days.
+// https://forum.aranet.com/aranet-home-devices-aranet4-aranet2-aranet-radiation-aranet-radon/how-long-does-the-aranet4-device-store-historic-data/
+const DefaultLookbackDelta = 30 * 24 * time.Hour
+
+// DefaultMaxFutureSkew is how far ahead of the local clock timestamps may be
+// by default.
+const DefaultMaxFutureSkew = time.Hour
+
+// QueryLastTime runs a query for the timestamp of the last sample of a series,
+// like timestamp(metric{label="value"}), looking back as far as lookback, and
+// returns the result. It returns the zero time if no series matches. It is
+// exported for sinks writing to other backends that implement the Prometheus
+// query API.
+func QueryLastTime(ctx context.Context, client api.Client, query string, lookback time.Duration) (time.Time, error) {
+	v, warn, err := v1.NewAPI(client).Query(ctx, query, time.Now(), v1.WithLookbackDelta(lookback))
+	if err != nil {
+		return time.Time{}, err
 	}
 	if warn != nil {
-		slog.Warn("warning querying metric", "metric", metric, "query", query, "warn", warn)
+		slog.Warn("warning querying metric", "query", query, "warn", warn)
 	}
 	if v == nil {
 		return time.Time{}, fmt.Errorf("no value returned for query %s", query)
 	}
 	slog.Debug("query result", "query", query, "value_type", v.Type(), "value", v)
 	if v.Type() != model.ValVector {
-		return time.Time{}, fmt.Errorf("query %s returned non-vector value", metric)
+		return time.Time{}, fmt.Errorf("query %s returned non-vector value", query)
 	}
 	vec := v.(model.Vector)
 	if len(vec) == 0 {
@@ -121,79 +650,442 @@ func (s *Syncer) lastTime(ctx context.Context, metric string) (time.Time, error)
 	if len(vec) > 1 {
 		return time.Time{}, fmt.Errorf("multiple time series matched query %s: %+v", query, vec)
 	}
-	ts := float64(vec[0].Value)
-	last = time.Unix(int64(ts), int64(ts*1000000000)%1000000000)
-	slog.Debug("last time", "metric", metric, "value", ts, "last", last)
-	s.lastTimes[metric] = last
-	return last, nil
+	// Samples are stored with millisecond precision; rounding avoids float
+	// errors pushing the time just below a millisecond boundary.
+	return time.UnixMilli(int64(math.Round(float64(vec[0].Value) * 1000))), nil
+}
+
+// lastWriteTime returns the last reported time of a metric with the given
+// prefix, including writes that are queued or buffered but not sent yet.
+func (s *Syncer) lastWriteTime(ctx context.Context, prefix, metric string) (time.Time, error) {
+	if s.batch != nil {
+		if buffered := s.batch.bufferedTime(prefix + metric); !buffered.IsZero() {
+			return buffered, nil
+		}
+	}
+	if s.async != nil {
+		// Queued writes are always newer than the last reported time.
+		if queued := s.async.queuedTime(prefix + metric); !queued.IsZero() {
+			return queued, nil
+		}
+	}
+	return s.lastTime(ctx, prefix, metric)
+}
+
+// lastTimeQuery returns the query for the timestamp of the last sample of a
+// metric with the given prefix.
+func (s *Syncer) lastTimeQuery(prefix, metric string) string {
+	ll := s.prefixedLabelSet(prefix, metric)
+	if len(s.config.DedupMatchLabels) == 0 {
+		return fmt.Sprintf("timestamp(%s)", ll.String())
+	}
+	ll = slices.DeleteFunc(ll, func(l labels.Label) bool {
+		return l.Name != model.MetricNameLabel && !slices.Contains(s.config.DedupMatchLabels, l.Name)
+	})
+	return fmt.Sprintf("max(timestamp(%s))", ll.String())
+}
+
+// ResetLastTimes forgets the last reported times of a metric under all
+// prefixes, or of all metrics if name is empty, so that they are queried from
+// Prometheus again on the next write. It returns the number of times cleared.
+func (s *Syncer) ResetLastTimes(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stateDirty = true
+	if name == "" {
+		n := len(s.lastTimes)
+		clear(s.lastTimes)
+		return n
+	}
+	n := 0
+	for _, prefix := range s.prefixes() {
+		if _, ok := s.lastTimes[prefix+name]; ok {
+			delete(s.lastTimes, prefix+name)
+			n++
+		}
+	}
+	return n
+}
+
+// isNewer returns whether ts is after last at the configured dedup resolution.
+func (s *Syncer) isNewer(ts, last time.Time) bool {
+	res := s.config.DedupResolution
+	return ts.Truncate(res).After(last.Truncate(res))
+}
+
+// prefixes returns all prefixes metrics are written under.
+func (s *Syncer) prefixes() []string {
+	return append([]string{s.config.MetricPrefix}, s.config.AdditionalPrefixes...)
+}
+
+// Actions returned by Plan.
+const (
+	PlanWrite         = "write"
+	PlanSkipDuplicate = "skip-duplicate"
+	PlanSkipFuture    = "skip-future"
+)
+
+// Plan returns what ReportMetric would do with a metric value without writing
+// it: PlanWrite if it would be written under at least one prefix,
+// PlanSkipFuture if its timestamp is too far in the future, or
+// PlanSkipDuplicate otherwise. Last reported times are not advanced.
+func (s *Syncer) Plan(ctx context.Context, name string, ts time.Time) (string, error) {
+	if ts.IsZero() {
+		return "", fmt.Errorf("cannot report metric %q with zero timestamp", name)
+	}
+	if ts.After(time.Now().Add(s.config.MaxFutureSkew)) {
+		return PlanSkipFuture, nil
+	}
+	for _, prefix := range s.prefixes() {
+		last, err := s.lastWriteTime(ctx, prefix, name)
+		if err != nil {
+			return "", fmt.Errorf("getting last time for metric %q: %w", prefix+name, err)
+		}
+		if s.isNewer(ts, last) {
+			return PlanWrite, nil
+		}
+	}
+	return PlanSkipDuplicate, nil
 }
 
-// ReportMetric writes a metric to Prometheus.
+// ReportMetric writes a metric to Prometheus, once for every configured prefix.
 func (s *Syncer) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	w := &write{ctx: ctx, req: &prompb.WriteRequest{}, ts: ts}
+	if err := s.add(w, name, value); err != nil {
+		return err
+	}
+	return s.submit(name, w)
+}
+
+// ReportMetrics writes several metrics with the same timestamp, like all
+// values of a measurement, in a single request. Each metric is deduplicated
+// separately, and none are written if any of them is invalid. With
+// AsyncWriters, metrics are queued separately instead.
+func (s *Syncer) ReportMetrics(ctx context.Context, ts time.Time, values map[string]float64) error {
+	names := slices.Sorted(maps.Keys(values))
+	if s.async != nil {
+		// Writes are queued by metric to keep them in order, so they
+		// can't be combined.
+		for _, name := range names {
+			if err := s.ReportMetric(ctx, name, ts, values[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := &write{ctx: ctx, req: &prompb.WriteRequest{}, ts: ts}
+	for _, name := range names {
+		if err := s.add(w, name, values[name]); err != nil {
+			return err
+		}
+	}
+	return s.submit("", w)
+}
+
+// add validates a sample and adds it to w under every prefix it is newer than
+// the last reported time for.
+func (s *Syncer) add(w *write, name string, value float64) error {
+	ts := w.ts
 	if ts.IsZero() {
 		s.metricWrites.WithLabelValues("error").Inc()
 		return fmt.Errorf("cannot report metric %q with zero timestamp", name)
 	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		s.metricWrites.WithLabelValues("non_finite").Inc()
+		return fmt.Errorf("metric %q value %v: %w", name, value, ErrNonFinite)
+	}
 	now := time.Now()
-	if ts.After(now.Add(time.Hour)) {
+	if ts.After(now.Add(s.config.MaxFutureSkew)) {
 		s.metricWrites.WithLabelValues("error").Inc()
-		return fmt.Errorf("timestamp %v for metric %q is too far in the future (more than 1 hour ahead of now)", ts, name)
+		return fmt.Errorf("timestamp %v for metric %q is more than %v ahead of now: %w", ts, name, s.config.MaxFutureSkew, ErrFutureTimestamp)
 	}
 
-	last, err := s.lastTime(ctx, name)
-	if err != nil {
-		s.metricWrites.WithLabelValues("error").Inc()
-		return fmt.Errorf("getting last time for metric %q: %w", name, err)
+	for _, prefix := range s.prefixes() {
+		last, err := s.lastWriteTime(w.ctx, prefix, name)
+		if err != nil {
+			s.metricWrites.WithLabelValues("error").Inc()
+			return fmt.Errorf("getting last time for metric %q: %w", prefix+name, err)
+		}
+		if !s.isNewer(ts, last) {
+			slog.Debug("skipping value with timestamp before last reported", "metric", prefix+name, "ts", ts, "last", last)
+			s.metricWrites.WithLabelValues("skipped").Inc()
+			continue
+		}
+		w.req.Timeseries = append(w.req.Timeseries, prompb.TimeSeries{
+			Labels: prompb.FromLabels(s.prefixedLabelSet(prefix, name), nil),
+			Samples: []prompb.Sample{
+				{
+					Value:     value,
+					Timestamp: ts.UnixNano() / int64(time.Millisecond),
+				},
+			},
+		})
+		w.keys = append(w.keys, prefix+name)
+		w.names = append(w.names, name)
+		w.values = append(w.values, value)
+	}
+	return nil
+}
+
+// submit sends a write, queues it under the given metric name with
+// AsyncWriters, or buffers it with BatchSize. Writes without any time series
+// are dropped.
+func (s *Syncer) submit(name string, w *write) error {
+	if len(w.keys) == 0 {
+		return nil
+	}
+	if s.config.DryRun {
+		// Nothing is written, so last reported times are not advanced.
+		slog.Info("dry run, skipping write", "request", w.req)
+		s.metricWrites.WithLabelValues("skipped").Add(float64(len(w.keys)))
+		s.metricWrites.WithLabelValues("success").Add(float64(len(w.keys)))
+		return nil
+	}
+	if s.batch != nil {
+		s.batch.add(w)
+		return nil
 	}
-	if !ts.After(last) {
-		slog.Debug("skipping value with timestamp before last reported", "metric", name, "ts", ts, "last", last)
-		s.metricWrites.WithLabelValues("skipped").Inc()
+	if s.async != nil {
+		if !s.async.enqueue(name, w) {
+			// Reported by Flush along with the failed write.
+			s.metricWrites.WithLabelValues("error").Add(float64(len(w.keys)))
+		}
 		return nil
 	}
+	return s.send(w)
+}
 
-	req := &prompb.WriteRequest{
-		Timeseries: []prompb.TimeSeries{
-			{
-				Labels: s.labelsProto(name),
-				Samples: []prompb.Sample{
-					{
-						Value:     value,
-						Timestamp: ts.UnixNano() / int64(time.Millisecond),
-					},
-				},
-			},
-		},
+// ReportWithLabels writes a single sample of a metric with additional labels,
+// once for every configured prefix. It is meant for events like a battery
+// change, which are reported at the current time, so samples are neither
+// deduplicated nor queued with AsyncWriters.
+func (s *Syncer) ReportWithLabels(ctx context.Context, name string, extra map[string]string, ts time.Time, value float64) error {
+	req := &prompb.WriteRequest{}
+	for _, prefix := range s.prefixes() {
+		ll := s.prefixedLabelSet(prefix, name)
+		for n, v := range extra {
+			if ll.Has(n) {
+				return fmt.Errorf("label %q is configured more than once", n)
+			}
+			ll = append(ll, labels.Label{Name: n, Value: v})
+		}
+		slices.SortFunc(ll, func(a, b labels.Label) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  prompb.FromLabels(ll, nil),
+			Samples: []prompb.Sample{{Value: value, Timestamp: ts.UnixMilli()}},
+		})
 	}
+	n := float64(len(req.Timeseries))
 	if s.config.DryRun {
 		slog.Info("dry run, skipping write", "request", req)
-		s.metricWrites.WithLabelValues("skipped").Inc()
-	} else {
-		if _, err := s.write.WriteProto(ctx, req); err != nil {
-			s.metricWrites.WithLabelValues("error").Inc()
-			return fmt.Errorf("sending request %+v: %w", req, err)
+		s.metricWrites.WithLabelValues("skipped").Add(n)
+		return nil
+	}
+	if err := s.writeProto(ctx, req); err != nil {
+		s.metricWrites.WithLabelValues("error").Add(n)
+		return fmt.Errorf("sending request %+v: %w", req, err)
+	}
+	s.metricWrites.WithLabelValues("success").Add(n)
+	return nil
+}
+
+// Flush writes samples buffered with BatchSize, or waits for writes queued
+// with AsyncWriters to be sent, and returns the errors of any failed writes.
+// It then saves the last reported times to StateFile, if set.
+func (s *Syncer) Flush(ctx context.Context) error {
+	var err error
+	if s.batch != nil {
+		err = s.sendBatches(ctx, s.batch.take())
+	} else if s.async != nil {
+		err = s.async.wait()
+	}
+	if s.config.StateFile != "" {
+		if err := s.saveState(); err != nil {
+			slog.Warn("failed to save state file", "file", s.config.StateFile, "error", err)
 		}
 	}
-	s.metricWrites.WithLabelValues("success").Inc()
-	s.lastTimes[name] = ts
+	return err
+}
+
+// Abort ends a failed refresh: it waits for writes still queued with
+// AsyncWriters and forgets the ones that failed, so that they are reported
+// again on the next refresh rather than skipped as duplicates, and their
+// errors don't fail its Flush.
+func (s *Syncer) Abort() {
+	if s.async == nil {
+		return
+	}
+	if err := s.async.wait(); err != nil {
+		slog.Warn("writes of failed refresh failed", "error", err)
+	}
+}
+
+// sendBatches sends batches of buffered writes, one request per batch. If a
+// batch fails, it and all later batches are dropped, to be reported again on
+// the next refresh, so that no gaps are left behind the last reported times.
+func (s *Syncer) sendBatches(ctx context.Context, batches [][]*write) error {
+	for i, batch := range batches {
+		req := &prompb.WriteRequest{}
+		for _, w := range batch {
+			req.Timeseries = append(req.Timeseries, w.req.Timeseries...)
+		}
+		var keys []string
+		for _, w := range batch {
+			keys = append(keys, w.keys...)
+		}
+		err := s.writeProto(ctx, req)
+		if err != nil && s.alreadyWritten(err, keys) {
+			for _, w := range batch {
+				s.ignored(w)
+			}
+			continue
+		}
+		if err != nil {
+			dropped := 0
+			for _, batch := range batches[i:] {
+				for _, w := range batch {
+					dropped += len(w.keys)
+				}
+			}
+			s.metricWrites.WithLabelValues("error").Add(float64(dropped))
+			return fmt.Errorf("sending batch of %d samples (dropped %d): %w", len(req.Timeseries), dropped, err)
+		}
+		for _, w := range batch {
+			s.written(w)
+		}
+	}
+	return nil
+}
+
+// send sends a write request and advances the last reported times of its
+// metrics if it succeeds.
+func (s *Syncer) send(w *write) error {
+	err := s.writeProto(w.ctx, w.req)
+	if err != nil && s.alreadyWritten(err, w.keys) {
+		s.ignored(w)
+		return nil
+	}
+	if err != nil {
+		s.metricWrites.WithLabelValues("error").Add(float64(len(w.keys)))
+		return fmt.Errorf("sending request %+v: %w", w.req, err)
+	}
+	s.written(w)
 	return nil
 }
 
+// writeProto sends a remote write request, retrying failures up to
+// WriteRetries times with exponential backoff. Client errors are not retried,
+// since the same request would be rejected again, except for 429 Too Many
+// Requests.
+func (s *Syncer) writeProto(ctx context.Context, req *prompb.WriteRequest) error {
+	backoff := s.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		_, err := s.write.WriteProto(ctx, req)
+		if err == nil || attempt > s.config.WriteRetries || !retryable(err) {
+			return err
+		}
+		slog.Warn("remote write failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		s.writeRetries.Inc()
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (not retried: %w)", err, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// retryable returns whether a failed remote write may succeed if retried.
+func retryable(err error) bool {
+	var writeErr *promwrite.WriteError
+	if errors.As(err, &writeErr) {
+		status := writeErr.StatusCode()
+		return status/100 != 4 || status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// alreadyWritten returns whether a failed write of the given prefixed metric
+// names was rejected because their samples were already written. Without a
+// query to deduplicate against, DedupBestEffort writes samples that were
+// already written before a restart again, which Prometheus rejects as out of
+// order or duplicates, while still ingesting the rest of the request. Other
+// rejections, such as samples older than the head block, lose data and are
+// not ignored, nor are rejections of metrics that were deduplicated.
+func (s *Syncer) alreadyWritten(err error, keys []string) bool {
+	var writeErr *promwrite.WriteError
+	if !errors.As(err, &writeErr) || writeErr.StatusCode() != http.StatusBadRequest {
+		return false
+	}
+	msg := writeErr.Error()
+	if !strings.Contains(msg, "out of order") && !strings.Contains(msg, "duplicate sample") {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if !s.undeduped[key] {
+			return false
+		}
+	}
+	slog.Warn("samples written without deduplication rejected as already written, ignoring", "samples", len(keys), "error", err)
+	return true
+}
+
+// ignored records a write rejected as already written, advancing the last
+// reported times of its metrics so that it is not sent again.
+func (s *Syncer) ignored(w *write) {
+	s.metricWrites.WithLabelValues("already_written").Add(float64(len(w.keys)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range w.keys {
+		s.lastTimes[key] = w.ts
+	}
+	s.stateDirty = true
+}
+
+// written records a successfully sent write, advancing the last reported
+// times of its metrics.
+func (s *Syncer) written(w *write) {
+	s.metricWrites.WithLabelValues("success").Add(float64(len(w.keys)))
+	for _, name := range w.names {
+		s.lastWrite.WithLabelValues(name).SetToCurrentTime()
+	}
+	if s.config.LogSamples {
+		for i, key := range w.keys {
+			slog.Info("wrote sample", "metric", key, "value", w.values[i], "ts", w.ts.Format(time.RFC3339))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range w.keys {
+		s.lastTimes[key] = w.ts
+		delete(s.undeduped, key)
+	}
+	s.stateDirty = true
+}
+
 // labelSet returns the full label set for a metric.
 func (s *Syncer) labelSet(metricName string) labels.Labels {
+	return s.prefixedLabelSet(s.config.MetricPrefix, metricName)
+}
+
+// prefixedLabelSet returns the full label set for a metric with the given prefix.
+func (s *Syncer) prefixedLabelSet(prefix, metricName string) labels.Labels {
 	ll := labels.Labels{
-		{Name: "__name__", Value: s.config.MetricPrefix + metricName},
+		{Name: "__name__", Value: prefix + metricName},
 	}
 	// Add additional labels, and sort by name.
 	for name, value := range s.config.Labels {
 		ll = append(ll, labels.Label{Name: name, Value: value})
 	}
+	for name, value := range s.config.ExtraLabels {
+		ll = append(ll, labels.Label{Name: name, Value: value})
+	}
 	slices.SortFunc(ll, func(a, b labels.Label) int {
 		return strings.Compare(a.Name, b.Name)
 	})
 	return ll
 }
-
-// labelsProto returns the full label set for a metric as a protobuf.
-func (s *Syncer) labelsProto(metricName string) []prompb.Label {
-	return prompb.FromLabels(s.labelSet(metricName), nil)
-}
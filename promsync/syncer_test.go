@@ -1,15 +1,25 @@
 package promsync
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/castai/promwrite"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,6 +40,16 @@ func TestNew(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "batches with async writers",
+			config: Config{
+				PrometheusEndpoint: "http://localhost:9090",
+				BatchSize:          500,
+				AsyncWriters:       2,
+			},
+			wantErr: true,
+			errMsg:  "mutually exclusive",
+		},
 		{
 			name: "missing endpoint",
 			config: Config{
@@ -57,6 +77,38 @@ func TestNew(t *testing.T) {
 			wantErr: true,
 			errMsg:  "has no host",
 		},
+		{
+			name: "conflicting extra label",
+			config: Config{
+				PrometheusEndpoint: "http://localhost:9090",
+				MetricPrefix:       "test_",
+				Labels:             map[string]string{"job": "test", "instance": "host"},
+				ExtraLabels:        map[string]string{"instance": "foo", "room": "kitchen"},
+			},
+			wantErr: true,
+			errMsg:  `label "instance" is configured more than once`,
+		},
+		{
+			name: "reserved extra label",
+			config: Config{
+				PrometheusEndpoint: "http://localhost:9090",
+				MetricPrefix:       "test_",
+				ExtraLabels:        map[string]string{"__name__": "foo"},
+			},
+			wantErr: true,
+			errMsg:  "is reserved",
+		},
+		{
+			name: "unknown dedup match label",
+			config: Config{
+				PrometheusEndpoint: "http://localhost:9090",
+				MetricPrefix:       "test_",
+				Labels:             map[string]string{"job": "test"},
+				DedupMatchLabels:   []string{"device_addr"},
+			},
+			wantErr: true,
+			errMsg:  `dedup match label "device_addr" is not configured`,
+		},
 		{
 			name: "URL without scheme",
 			config: Config{
@@ -145,6 +197,84 @@ func TestReportMetric_Validation(t *testing.T) {
 			}
 		})
 	}
+
+	err = syncer.ReportMetric(ctx, "test_metric", now.Add(2*time.Hour), 1.0)
+	require.ErrorIs(t, err, ErrFutureTimestamp)
+}
+
+func TestReportMetric_MaxFutureSkew(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		emptyQueryHandler(w, r)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		skew    time.Duration
+		ahead   time.Duration
+		wantErr string
+	}{
+		{name: "default accepts", ahead: 30 * time.Minute},
+		{name: "default rejects", ahead: 2 * time.Hour, wantErr: "more than 1h0m0s ahead of now"},
+		{name: "custom accepts", skew: 3 * time.Hour, ahead: 2 * time.Hour},
+		{name: "custom rejects", skew: 5 * time.Minute, ahead: 10 * time.Minute, wantErr: "more than 5m0s ahead of now"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer, err := New(Config{
+				PrometheusEndpoint: server.URL,
+				MetricPrefix:       "test_",
+				MaxFutureSkew:      tt.skew,
+			})
+			require.NoError(t, err)
+
+			err = syncer.ReportMetric(context.Background(), "test_metric", time.Now().Add(tt.ahead), 1.0)
+			if tt.wantErr != "" {
+				require.ErrorIs(t, err, ErrFutureTimestamp)
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	_, err := New(Config{PrometheusEndpoint: "http://localhost:9090", MaxFutureSkew: -time.Hour})
+	require.ErrorContains(t, err, "MaxFutureSkew must not be negative")
+}
+
+func TestReportMetric_NonFinite(t *testing.T) {
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     []interface{}{},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	writeCount := 0
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCount++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+	ctx := context.Background()
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		err := syncer.ReportMetric(ctx, "test_metric", time.Now(), value)
+		require.ErrorIs(t, err, ErrNonFinite, "value %v", value)
+	}
+	assert.Equal(t, 0, writeCount, "Non-finite values should not be written")
+
+	// The series is not poisoned: a finite value is still written.
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", time.Now(), 1.0))
+	assert.Equal(t, 1, writeCount)
 }
 
 func TestReportMetric_ColdStart(t *testing.T) {
@@ -188,6 +318,173 @@ func TestReportMetric_ColdStart(t *testing.T) {
 	assert.Equal(t, 1, writeCount, "Write should be called once on cold start")
 }
 
+func TestReportMetric_ColdStartWithWarnings(t *testing.T) {
+	// Some backends (e.g. Thanos with partial responses) always attach warnings.
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"status":   "success",
+			"warnings": []string{"partial response: store unavailable"},
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     []interface{}{},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	writeCount := 0
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCount++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var logs bytes.Buffer
+	oldLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(oldLogger) })
+
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+
+	err := syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 42.0)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, writeCount, "Write should be called on cold start despite warnings")
+	assert.Contains(t, logs.String(), "warning querying metric")
+	assert.Contains(t, logs.String(), "partial response: store unavailable")
+}
+
+func TestReportMetric_LogSamples(t *testing.T) {
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     []interface{}{},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var logs bytes.Buffer
+	oldLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(oldLogger) })
+
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+	syncer.config.LogSamples = true
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now, 42.5))
+	assert.Contains(t, logs.String(), "msg=\"wrote sample\" metric=test_test_metric value=42.5")
+
+	// Skipped duplicates are not logged.
+	logs.Reset()
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now, 42.5))
+	assert.NotContains(t, logs.String(), "wrote sample")
+}
+
+func TestReportMetric_LastWriteTime(t *testing.T) {
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, ts := range decodeWriteRequest(t, r).Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" && l.Value == "test_last_write_failing" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+
+	ctx := context.Background()
+	start := time.Now()
+	require.NoError(t, syncer.ReportMetric(ctx, "last_write_ok", start.Add(-time.Hour), 1))
+	require.Error(t, syncer.ReportMetric(ctx, "last_write_failing", start.Add(-time.Hour), 1))
+
+	// The write time is recorded, not the sample time.
+	assert.InDelta(t, float64(start.Unix()), testutil.ToFloat64(syncer.lastWrite.WithLabelValues("last_write_ok")), 5)
+	assert.Equal(t, 0.0, testutil.ToFloat64(syncer.lastWrite.WithLabelValues("last_write_failing")))
+}
+
+func TestCheck(t *testing.T) {
+	var queries []string
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		queries = append(queries, r.Form.Get("query"))
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     []interface{}{},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	writeStatus := http.StatusNoContent
+	var written []*prompb.WriteRequest
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		written = append(written, decodeWriteRequest(t, r))
+		w.WriteHeader(writeStatus)
+	})
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+
+	ctx := context.Background()
+	require.NoError(t, syncer.Check(ctx))
+	assert.Equal(t, []string{"vector(1)"}, queries)
+	require.Len(t, written, 1)
+	assert.Empty(t, written[0].Timeseries, "Check should not write any samples")
+
+	writeStatus = http.StatusUnauthorized
+	require.ErrorContains(t, syncer.Check(ctx), "remote write")
+}
+
+func TestClockSkew(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		result  any
+		wantErr string
+	}{
+		{name: "ahead", offset: 10 * time.Minute},
+		{name: "behind", offset: -time.Hour},
+		{name: "not a scalar", result: map[string]any{"resultType": "vector", "result": []any{}}, wantErr: "not a scalar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, r.ParseForm())
+				assert.Equal(t, "time()", r.Form.Get("query"))
+				assert.Empty(t, r.Form.Get("time"), "query must be evaluated at the Prometheus time")
+				data := tt.result
+				if data == nil {
+					now := float64(time.Now().Add(tt.offset).UnixMilli()) / 1000
+					data = map[string]any{"resultType": "scalar", "result": []any{now, fmt.Sprint(now)}}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+			})
+			syncer := createTestSyncerWithMocks(t, apiHandler, http.NotFound)
+
+			skew, err := syncer.ClockSkew(context.Background())
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.offset.Seconds(), skew.Seconds(), 1)
+			assert.InDelta(t, tt.offset.Seconds(), testutil.ToFloat64(syncer.clockSkew), 1)
+		})
+	}
+}
+
 func TestReportMetric_DuplicateDetection(t *testing.T) {
 	// Mock API server that returns a previous timestamp
 	previousTime := time.Now().Add(-1 * time.Hour)
@@ -254,6 +551,296 @@ func TestReportMetric_DuplicateDetection(t *testing.T) {
 	assert.Equal(t, 2, writeCount, "Should write newer timestamp")
 }
 
+func TestReportMetrics(t *testing.T) {
+	var requests []*prompb.WriteRequest
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, decodeWriteRequest(t, r))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+	success := testutil.ToFloat64(syncer.metricWrites.WithLabelValues("success"))
+	skipped := testutil.ToFloat64(syncer.metricWrites.WithLabelValues("skipped"))
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, syncer.ReportMetric(ctx, "batch_humidity", now, 40))
+	requests = nil
+
+	require.NoError(t, syncer.ReportMetrics(ctx, now, map[string]float64{
+		"batch_co2":         600,
+		"batch_humidity":    40,
+		"batch_temperature": 21.5,
+	}))
+	require.Len(t, requests, 1, "all new metrics are written in one request")
+	var got []string
+	for _, ts := range requests[0].Timeseries {
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				got = append(got, fmt.Sprintf("%s %v %d", l.Value, ts.Samples[0].Value, ts.Samples[0].Timestamp))
+			}
+		}
+	}
+	assert.Equal(t, []string{
+		fmt.Sprintf("test_batch_co2 600 %d", now.UnixMilli()),
+		fmt.Sprintf("test_batch_temperature 21.5 %d", now.UnixMilli()),
+	}, got)
+	assert.Equal(t, 3.0, testutil.ToFloat64(syncer.metricWrites.WithLabelValues("success"))-success)
+	assert.Equal(t, 1.0, testutil.ToFloat64(syncer.metricWrites.WithLabelValues("skipped"))-skipped)
+	assert.Equal(t, now, syncer.lastTimes["test_batch_co2"])
+
+	// Nothing is written if any value is invalid.
+	requests = nil
+	err := syncer.ReportMetrics(ctx, now.Add(time.Minute), map[string]float64{"batch_co2": 610, "batch_temperature": math.NaN()})
+	require.ErrorIs(t, err, ErrNonFinite)
+	assert.Empty(t, requests)
+	assert.Equal(t, now, syncer.lastTimes["test_batch_co2"])
+}
+
+func TestReportMetrics_Batched(t *testing.T) {
+	var requests []int
+	fail := false
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, len(decodeWriteRequest(t, r).Timeseries))
+		if fail && len(requests) == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+	syncer.batch = newBatcher(5)
+
+	ctx := context.Background()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	report := func() {
+		t.Helper()
+		for i := range 5 {
+			ts := base.Add(time.Duration(i) * time.Minute)
+			require.NoError(t, syncer.ReportMetrics(ctx, ts, map[string]float64{"batched_co2": 600, "batched_humidity": 40}))
+			// Buffered samples count as reported.
+			require.NoError(t, syncer.ReportMetric(ctx, "batched_co2", ts, 600))
+		}
+	}
+
+	report()
+	assert.Empty(t, requests, "nothing is written before Flush")
+	require.NoError(t, syncer.Flush(ctx))
+	assert.Equal(t, []int{4, 4, 2}, requests)
+	assert.Equal(t, base.Add(4*time.Minute), syncer.lastTimes["test_batched_co2"])
+
+	// A failed batch is dropped along with later ones, and written again
+	// when reported again.
+	requests, fail = nil, true
+	syncer.lastTimes["test_batched_co2"] = base.Add(-time.Minute)
+	syncer.lastTimes["test_batched_humidity"] = base.Add(-time.Minute)
+	report()
+	require.ErrorContains(t, syncer.Flush(ctx), "dropped 6")
+	assert.Equal(t, []int{4, 4}, requests)
+	assert.Equal(t, base.Add(time.Minute), syncer.lastTimes["test_batched_co2"])
+
+	requests, fail = nil, false
+	report()
+	require.NoError(t, syncer.Flush(ctx))
+	assert.Equal(t, []int{4, 2}, requests)
+}
+
+func TestReportWithLabels(t *testing.T) {
+	var written []string
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, ts := range decodeWriteRequest(t, r).Timeseries {
+			var ll []string
+			for _, l := range ts.Labels {
+				ll = append(ll, l.Name+"="+l.Value)
+			}
+			written = append(written, strings.Join(ll, ","))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+	syncer.config.AdditionalPrefixes = []string{"new_"}
+
+	ts := time.Now()
+	require.NoError(t, syncer.ReportWithLabels(context.Background(), "event", map[string]string{"event": "moved"}, ts, 1))
+	// Events are not deduplicated.
+	require.NoError(t, syncer.ReportWithLabels(context.Background(), "event", map[string]string{"event": "moved"}, ts, 1))
+	assert.Equal(t, []string{
+		"__name__=test_event,event=moved,instance=test-instance,job=test",
+		"__name__=new_event,event=moved,instance=test-instance,job=test",
+		"__name__=test_event,event=moved,instance=test-instance,job=test",
+		"__name__=new_event,event=moved,instance=test-instance,job=test",
+	}, written)
+
+	err := syncer.ReportWithLabels(context.Background(), "event", map[string]string{"job": "other"}, ts, 1)
+	require.ErrorContains(t, err, `label "job" is configured more than once`)
+}
+
+func TestResetLastTimes(t *testing.T) {
+	queryCount := 0
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queryCount++
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     []interface{}{},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+	writeCount := 0
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCount++
+		w.WriteHeader(http.StatusNoContent)
+	})
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, syncer.ReportMetric(ctx, "co2", now, 400))
+	require.NoError(t, syncer.ReportMetric(ctx, "humidity", now, 40))
+	assert.Equal(t, 2, queryCount)
+
+	assert.Equal(t, 0, syncer.ResetLastTimes("unknown"))
+	assert.Equal(t, 1, syncer.ResetLastTimes("co2"))
+
+	// Only the reset metric is queried again, and since the mock Prometheus
+	// has no data for it, the same sample is written again.
+	require.NoError(t, syncer.ReportMetric(ctx, "co2", now, 400))
+	require.NoError(t, syncer.ReportMetric(ctx, "humidity", now, 40))
+	assert.Equal(t, 3, queryCount)
+	assert.Equal(t, 3, writeCount)
+
+	assert.Equal(t, 2, syncer.ResetLastTimes(""))
+	assert.Empty(t, syncer.lastTimes)
+}
+
+func TestReportMetric_AdditionalPrefixes(t *testing.T) {
+	// The old prefix already has data, the new one is empty.
+	previousTime := time.Now().Add(-1 * time.Hour)
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := []interface{}{}
+		if strings.Contains(r.FormValue("query"), "test_metric") {
+			result = append(result, map[string]interface{}{
+				"metric": map[string]interface{}{},
+				"value":  []interface{}{float64(previousTime.Unix()), fmt.Sprintf("%d", previousTime.Unix())},
+			})
+		}
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result":     result,
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	var written []string
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := decodeWriteRequest(t, r)
+		for _, ts := range req.Timeseries {
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" {
+					written = append(written, l.Value)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+	syncer.config.AdditionalPrefixes = []string{"new_"}
+
+	ctx := context.Background()
+
+	// Older than the last sample under the primary prefix: only written under the new one.
+	err := syncer.ReportMetric(ctx, "metric", previousTime.Add(-time.Minute), 1.0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new_metric"}, written)
+
+	// Newer than both: written under both prefixes.
+	err = syncer.ReportMetric(ctx, "metric", time.Now(), 2.0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"new_metric", "test_metric", "new_metric"}, written)
+}
+
+func TestPlan(t *testing.T) {
+	previousTime := time.Now().Add(-1 * time.Hour)
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"resultType": "vector",
+				"result": []interface{}{
+					map[string]interface{}{
+						"metric": map[string]interface{}{},
+						"value":  []interface{}{float64(previousTime.Unix()), fmt.Sprintf("%d", previousTime.Unix())},
+					},
+				},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	writeCount := 0
+	writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeCount++
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+	ctx := context.Background()
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		ts   time.Time
+		want string
+	}{
+		{name: "older", ts: previousTime.Add(-time.Minute), want: PlanSkipDuplicate},
+		{name: "same", ts: previousTime.Truncate(time.Second), want: PlanSkipDuplicate},
+		{name: "newer", ts: now, want: PlanWrite},
+		{name: "future", ts: now.Add(2 * time.Hour), want: PlanSkipFuture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, err := syncer.Plan(ctx, "test_metric", tt.ts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, action)
+		})
+	}
+
+	// Planning does not write anything or advance the last reported time.
+	assert.Equal(t, 0, writeCount)
+	action, err := syncer.Plan(ctx, "test_metric", now)
+	require.NoError(t, err)
+	assert.Equal(t, PlanWrite, action)
+}
+
+func TestPlan_NoSamples(t *testing.T) {
+	var queries atomic.Int32
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		emptyQueryHandler(w, r)
+	})
+	syncer := createTestSyncerWithMocks(t, apiHandler, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// A metric that was never written is only queried once.
+	ctx := context.Background()
+	now := time.Now()
+	for i := range 3 {
+		action, err := syncer.Plan(ctx, "test_metric", now.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, PlanWrite, action)
+	}
+	assert.Equal(t, int32(1), queries.Load())
+}
+
 func TestReportMetric_DryRun(t *testing.T) {
 	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/api/v1/query" {
@@ -301,6 +888,14 @@ func TestReportMetric_DryRun(t *testing.T) {
 	err = syncer.ReportMetric(ctx, "test_metric", now, 42.0)
 	require.NoError(t, err)
 	assert.Equal(t, 0, writeCount, "Dry run should not call write")
+	assert.True(t, syncer.lastTimes["test_test_metric"].IsZero(), "Dry run should not advance the last reported time")
+
+	// Once dry run is disabled, the same sample is written.
+	syncer.config.DryRun = false
+	err = syncer.ReportMetric(ctx, "test_metric", now, 42.0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, writeCount, "Sample reported in dry run should be written later")
+	assert.Equal(t, now, syncer.lastTimes["test_test_metric"])
 }
 
 func TestReportMetric_ErrorHandling(t *testing.T) {
@@ -402,6 +997,296 @@ func TestReportMetric_ErrorHandling(t *testing.T) {
 	}
 }
 
+func TestReportMetric_DedupBestEffort(t *testing.T) {
+	apiHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	var written []int64
+	writeHandler := func(w http.ResponseWriter, r *http.Request) {
+		for _, ts := range decodeWriteRequest(t, r).Timeseries {
+			written = append(written, ts.Samples[0].Timestamp)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+	syncer.config.DedupBestEffort = true
+	failures := testutil.ToFloat64(syncer.dedupQueryFailures)
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now, 42.0))
+	// Deduplicated using the last time kept in memory, without another query.
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now, 42.0))
+	require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now.Add(time.Minute), 43.0))
+
+	assert.Equal(t, []int64{now.UnixMilli(), now.Add(time.Minute).UnixMilli()}, written)
+	assert.Equal(t, 1.0, testutil.ToFloat64(syncer.dedupQueryFailures)-failures)
+}
+
+func TestReportMetric_DedupBestEffortOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		bestEffort bool
+		queryFails bool
+		body       string
+		wantErr    bool
+	}{
+		{name: "out of order", bestEffort: true, queryFails: true, body: "out of order sample"},
+		{name: "duplicate", bestEffort: true, queryFails: true, body: "duplicate sample for timestamp"},
+		{name: "too old", bestEffort: true, queryFails: true, body: "out of bounds", wantErr: true},
+		{name: "other client error", bestEffort: true, queryFails: true, body: "invalid labels", wantErr: true},
+		{name: "deduplicated", bestEffort: true, body: "out of order sample", wantErr: true},
+		{name: "without best effort", body: "out of order sample", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiHandler := emptyQueryHandler
+			if tt.queryFails {
+				apiHandler = func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}
+			writes := 0
+			writeHandler := func(w http.ResponseWriter, r *http.Request) {
+				writes++
+				http.Error(w, tt.body, http.StatusBadRequest)
+			}
+			syncer := createTestSyncerWithMocks(t, apiHandler, writeHandler)
+			syncer.config.DedupBestEffort = tt.bestEffort
+			syncer.config.WriteRetries = 0
+			success := testutil.ToFloat64(syncer.metricWrites.WithLabelValues("success"))
+			ignored := testutil.ToFloat64(syncer.metricWrites.WithLabelValues("already_written"))
+
+			ctx := context.Background()
+			now := time.Now().Truncate(time.Second)
+			err := syncer.ReportMetric(ctx, "test_metric", now, 42.0)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, ignored, testutil.ToFloat64(syncer.metricWrites.WithLabelValues("already_written")))
+				return
+			}
+			require.NoError(t, err)
+			// Treated as written, so not written again, but not counted as
+			// a successful write.
+			require.NoError(t, syncer.ReportMetric(ctx, "test_metric", now, 42.0))
+			assert.Equal(t, 1, writes)
+			assert.Equal(t, ignored+1, testutil.ToFloat64(syncer.metricWrites.WithLabelValues("already_written")))
+			assert.Equal(t, success, testutil.ToFloat64(syncer.metricWrites.WithLabelValues("success")))
+		})
+	}
+}
+
+func TestReportMetric_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "succeeds after retries", statuses: []int{503, 500, 204}, wantRequests: 3},
+		{name: "retries too many requests", statuses: []int{429, 204}, wantRequests: 2},
+		{name: "gives up", statuses: []int{503, 503, 503, 204}, wantRequests: 3, wantErr: true},
+		{name: "client error is permanent", statuses: []int{400, 204}, wantRequests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[requests])
+				requests++
+			})
+			syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+			syncer.config.WriteRetries = 2
+			syncer.config.RetryBackoff = time.Millisecond
+			retries := testutil.ToFloat64(syncer.writeRetries)
+
+			err := syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 42)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantRequests, requests)
+			assert.Equal(t, float64(tt.wantRequests-1), testutil.ToFloat64(syncer.writeRetries)-retries)
+		})
+	}
+
+	t.Run("context cancelled", func(t *testing.T) {
+		writeHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+		syncer := createTestSyncerWithMocks(t, emptyQueryHandler, writeHandler)
+		syncer.config.WriteRetries = 5
+		syncer.config.RetryBackoff = time.Hour
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := syncer.ReportMetric(ctx, "test_metric", time.Now(), 42)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestReportMetric_WriteTimeout(t *testing.T) {
+	apiServer := httptest.NewServer(emptyQueryHandler)
+	t.Cleanup(apiServer.Close)
+	// The write server never responds.
+	writeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The request context is only canceled once the body has been read.
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(writeServer.Close)
+
+	syncer, err := New(Config{
+		PrometheusEndpoint: apiServer.URL,
+		RemoteWriteURL:     writeServer.URL + "/api/v1/write",
+		MetricPrefix:       "test_",
+		WriteTimeout:       100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 42.0)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second, "write should time out quickly")
+	assert.True(t, syncer.lastTimes["test_test_metric"].IsZero(), "last time must not be advanced")
+}
+
+func TestReportMetric_RemoteWriteVersionHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{name: "default", want: "0.1.0"},
+		{name: "override", override: "0.1.1", want: "0.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/write" {
+					got = r.Header.Values("X-Prometheus-Remote-Write-Version")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				response := map[string]interface{}{
+					"status": "success",
+					"data": map[string]interface{}{
+						"resultType": "vector",
+						"result":     []interface{}{},
+					},
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(response)
+			}))
+			defer server.Close()
+
+			syncer, err := New(Config{
+				PrometheusEndpoint:       server.URL,
+				MetricPrefix:             "test_",
+				RemoteWriteVersionHeader: tt.override,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1.0))
+			assert.Equal(t, []string{tt.want}, got)
+		})
+	}
+}
+
+func TestReportMetric_LookbackDelta(t *testing.T) {
+	tests := []struct {
+		name     string
+		lookback time.Duration
+		want     string
+	}{
+		{name: "default", want: "720h0m0s"},
+		{name: "custom", lookback: 7 * 24 * time.Hour, want: "168h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/v1/write" {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				require.NoError(t, r.ParseForm())
+				got = r.Form.Get("lookback_delta")
+				emptyQueryHandler(w, r)
+			}))
+			defer server.Close()
+
+			syncer, err := New(Config{
+				PrometheusEndpoint: server.URL,
+				MetricPrefix:       "test_",
+				LookbackDelta:      tt.lookback,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1.0))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := New(Config{PrometheusEndpoint: "http://localhost:9090", LookbackDelta: -time.Hour})
+	require.ErrorContains(t, err, "LookbackDelta must not be negative")
+}
+
+func TestIsNewer(t *testing.T) {
+	last := time.Date(2025, 1, 1, 12, 0, 0, 400*int(time.Millisecond), time.UTC)
+	tests := []struct {
+		name       string
+		resolution time.Duration
+		ts         time.Time
+		want       bool
+	}{
+		{name: "seconds, same second", resolution: time.Second, ts: last.Add(500 * time.Millisecond), want: false},
+		{name: "seconds, next second", resolution: time.Second, ts: last.Add(600 * time.Millisecond), want: true},
+		{name: "seconds, earlier", resolution: time.Second, ts: last.Add(-time.Second), want: false},
+		{name: "milliseconds, same millisecond", resolution: time.Millisecond, ts: last.Add(500 * time.Microsecond), want: false},
+		{name: "milliseconds, next millisecond", resolution: time.Millisecond, ts: last.Add(time.Millisecond), want: true},
+		{name: "milliseconds, same second", resolution: time.Millisecond, ts: last.Add(500 * time.Millisecond), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer := &Syncer{config: &Config{DedupResolution: tt.resolution}}
+			assert.Equal(t, tt.want, syncer.isNewer(tt.ts, last))
+		})
+	}
+}
+
+func TestNew_DedupResolution(t *testing.T) {
+	syncer, err := New(Config{PrometheusEndpoint: "http://localhost:9090"})
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, syncer.config.DedupResolution)
+
+	_, err = New(Config{PrometheusEndpoint: "http://localhost:9090", DedupResolution: time.Minute})
+	require.ErrorContains(t, err, "DedupResolution")
+}
+
+func TestNew_Registerer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	var syncers []*Syncer
+	for _, addr := range []string{"AA:BB", "CC:DD"} {
+		syncer, err := New(Config{
+			PrometheusEndpoint: "http://localhost:9090",
+			Registerer:         prometheus.WrapRegistererWith(prometheus.Labels{"device_addr": addr}, reg),
+		})
+		require.NoError(t, err)
+		syncers = append(syncers, syncer)
+	}
+
+	// Each syncer has its own metrics, rather than sharing the first one's.
+	syncers[0].writeRetries.Inc()
+	assert.Equal(t, 1.0, testutil.ToFloat64(syncers[0].writeRetries))
+	assert.Equal(t, 0.0, testutil.ToFloat64(syncers[1].writeRetries))
+	n, err := testutil.GatherAndCount(reg, "prometheus_write_retries_total")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
 func TestLabelSet(t *testing.T) {
 	config := Config{
 		MetricPrefix: "test_",
@@ -410,6 +1295,9 @@ func TestLabelSet(t *testing.T) {
 			"instance": "test-instance",
 			"device":   "test-device",
 		},
+		ExtraLabels: map[string]string{
+			"room": "kitchen",
+		},
 	}
 
 	syncer := &Syncer{config: &config}
@@ -422,6 +1310,7 @@ func TestLabelSet(t *testing.T) {
 	require.Equal(t, "test-job", labels.Get("job"))
 	require.Equal(t, "test-instance", labels.Get("instance"))
 	require.Equal(t, "test-device", labels.Get("device"))
+	require.Equal(t, "kitchen", labels.Get("room"))
 
 	// Verify labels are sorted
 	labelNames := make([]string, len(labels))
@@ -434,8 +1323,116 @@ func TestLabelSet(t *testing.T) {
 	}
 }
 
+// slowQueryHandler answers every query with last as the timestamp after a
+// delay, recording the number of queries and the most run at the same time.
+func slowQueryHandler(last time.Time, delay time.Duration, queries, maxInFlight *atomic.Int32) http.HandlerFunc {
+	var inFlight atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		ts := float64(last.Unix())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data": map[string]any{"resultType": "vector", "result": []any{
+				map[string]any{"metric": map[string]any{}, "value": []any{ts, fmt.Sprint(ts)}},
+			}},
+		})
+	}
+}
+
+var warmupMetrics = []string{"co2_ppm", "humidity_percent", "pressure_hpa", "temperature_celsius", "battery_level_percent"}
+
+func TestWarmup(t *testing.T) {
+	last := time.Unix(1700000000, 0)
+	var queries, maxInFlight atomic.Int32
+	syncer := createTestSyncerWithMocks(t, slowQueryHandler(last, 20*time.Millisecond, &queries, &maxInFlight), emptyQueryHandler)
+	syncer.config.DedupConcurrency = 2
+	syncer.config.AdditionalPrefixes = []string{"new_"}
+
+	ctx := context.Background()
+	require.NoError(t, syncer.Warmup(ctx, warmupMetrics))
+	assert.Equal(t, int32(10), queries.Load())
+	assert.Equal(t, int32(2), maxInFlight.Load())
+	assert.Len(t, syncer.lastTimes, 10)
+	assert.Equal(t, last, syncer.lastTimes["new_co2_ppm"])
+
+	// Known times are not queried again.
+	require.NoError(t, syncer.Warmup(ctx, warmupMetrics))
+	assert.Equal(t, int32(10), queries.Load())
+
+	syncer.ResetLastTimes("")
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, syncer.Warmup(ctx, warmupMetrics), context.Canceled)
+}
+
+func BenchmarkWarmup(b *testing.B) {
+	var queries, maxInFlight atomic.Int32
+	apiHandler := slowQueryHandler(time.Now().Add(-time.Hour), 5*time.Millisecond, &queries, &maxInFlight)
+	for _, concurrency := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			syncer := createTestSyncerWithMocks(b, apiHandler, emptyQueryHandler)
+			syncer.config.DedupConcurrency = concurrency
+			ctx := context.Background()
+			for b.Loop() {
+				syncer.ResetLastTimes("")
+				if err := syncer.Warmup(ctx, warmupMetrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLastTimeQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		matchLabels []string
+		want        string
+	}{
+		{
+			name: "all labels",
+			want: `timestamp({__name__="test_co2_ppm", device_addr="AA:BB", job="test-job", room="kitchen"})`,
+		},
+		{
+			name:        "subset",
+			matchLabels: []string{"device_addr"},
+			want:        `max(timestamp({__name__="test_co2_ppm", device_addr="AA:BB"}))`,
+		},
+		{
+			name:        "extra label",
+			matchLabels: []string{"room", "device_addr"},
+			want:        `max(timestamp({__name__="test_co2_ppm", device_addr="AA:BB", room="kitchen"}))`,
+		},
+		{
+			name:        "metric name only",
+			matchLabels: []string{"__name__"},
+			want:        `max(timestamp({__name__="test_co2_ppm"}))`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncer := &Syncer{config: &Config{
+				Labels:           map[string]string{"job": "test-job", "device_addr": "AA:BB"},
+				ExtraLabels:      map[string]string{"room": "kitchen"},
+				DedupMatchLabels: tt.matchLabels,
+			}}
+			require.Equal(t, tt.want, syncer.lastTimeQuery("test_", "co2_ppm"))
+		})
+	}
+}
+
 // createTestSyncerWithMocks creates a syncer with mocked dependencies for testing
-func createTestSyncerWithMocks(t *testing.T, apiHandler http.HandlerFunc, writeHandler http.HandlerFunc) *Syncer {
+func createTestSyncerWithMocks(t testing.TB, apiHandler http.HandlerFunc, writeHandler http.HandlerFunc) *Syncer {
 	apiServer := httptest.NewServer(apiHandler)
 	writeServer := httptest.NewServer(writeHandler)
 	t.Cleanup(func() {
@@ -459,3 +1456,55 @@ func createTestSyncerWithMocks(t *testing.T, apiHandler http.HandlerFunc, writeH
 
 	return syncer
 }
+
+// decodeWriteRequest decodes a remote write request received by a mock server
+func decodeWriteRequest(t testing.TB, r *http.Request) *prompb.WriteRequest {
+	compressed, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	data, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+	var req prompb.WriteRequest
+	require.NoError(t, req.Unmarshal(data))
+	return &req
+}
+
+func TestNew_EndpointPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		writeURL  string
+		wantQuery string
+		wantWrite string
+	}{
+		{name: "no path", path: "", wantQuery: "/api/v1/query", wantWrite: "/api/v1/write"},
+		{name: "trailing slash", path: "/", wantQuery: "/api/v1/query", wantWrite: "/api/v1/write"},
+		{name: "path prefix", path: "/prometheus", wantQuery: "/prometheus/api/v1/query", wantWrite: "/prometheus/api/v1/write"},
+		{name: "path prefix with trailing slash", path: "/prometheus/", wantQuery: "/prometheus/api/v1/query", wantWrite: "/prometheus/api/v1/write"},
+		{name: "repeated slashes", path: "/prometheus//", wantQuery: "/prometheus/api/v1/query", wantWrite: "/prometheus/api/v1/write"},
+		{name: "nested path prefix", path: "/a/b/", wantQuery: "/a/b/api/v1/query", wantWrite: "/a/b/api/v1/write"},
+		{name: "remote write URL override", path: "/prometheus/", writeURL: "/mimir/api/v1/push", wantQuery: "/prometheus/api/v1/query", wantWrite: "/mimir/api/v1/push"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				if strings.HasSuffix(r.URL.Path, "/query") {
+					emptyQueryHandler(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			config := Config{PrometheusEndpoint: server.URL + tt.path, MetricPrefix: "test_"}
+			if tt.writeURL != "" {
+				config.RemoteWriteURL = server.URL + tt.writeURL
+			}
+			syncer, err := New(config)
+			require.NoError(t, err)
+			require.NoError(t, syncer.ReportMetric(context.Background(), "metric", time.Now(), 1))
+			assert.Equal(t, []string{tt.wantQuery, tt.wantWrite}, paths)
+		})
+	}
+}
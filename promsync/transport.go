@@ -0,0 +1,98 @@
+package promsync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// headerTransport is an http.RoundTripper that sets fixed headers on every
+// request, replacing any values already present.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// tokenFileTransport is an http.RoundTripper that sets a bearer token read
+// from a file on every request.
+type tokenFileTransport struct {
+	base http.RoundTripper
+	path string
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, err := os.ReadFile(t.path)
+	if err != nil {
+		return nil, fmt.Errorf("reading bearer token: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return nil, fmt.Errorf("bearer token file %s is empty", t.path)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// basicAuth returns the value of the Authorization header for HTTP basic auth.
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// basicAuthPassword returns the configured basic auth password, reading it
+// from BasicAuthPasswordFile if set.
+func basicAuthPassword(config *Config) (string, error) {
+	if config.BasicAuthPasswordFile == "" {
+		return config.BasicAuthPassword, nil
+	}
+	if config.BasicAuthPassword != "" {
+		return "", fmt.Errorf("BasicAuthPassword and BasicAuthPasswordFile are mutually exclusive")
+	}
+	b, err := os.ReadFile(config.BasicAuthPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("reading basic auth password: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// tlsConfig returns the TLS configuration for connections to Prometheus, or
+// nil to use the defaults if no TLS options are set.
+func tlsConfig(config *Config) (*tls.Config, error) {
+	if config.TLSCACertFile == "" && config.TLSClientCertFile == "" && config.TLSClientKeyFile == "" && !config.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+	if (config.TLSClientCertFile == "") != (config.TLSClientKeyFile == "") {
+		return nil, fmt.Errorf("TLSClientCertFile and TLSClientKeyFile must be set together")
+	}
+	c := &tls.Config{InsecureSkipVerify: config.TLSInsecureSkipVerify}
+	if config.TLSCACertFile != "" {
+		pem, err := os.ReadFile(config.TLSCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in %s", config.TLSCACertFile)
+		}
+	}
+	if config.TLSClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSClientCertFile, config.TLSClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
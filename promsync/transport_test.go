@@ -0,0 +1,239 @@
+package promsync
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordHeaders returns a server answering queries with an empty vector and
+// accepting writes, and a function returning the values of the given header
+// sent with each request, by path.
+func recordHeaders(t *testing.T, header string) (*httptest.Server, func() map[string][]string) {
+	t.Helper()
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.URL.Path] = append(got[r.URL.Path], r.Header.Get(header))
+		mu.Unlock()
+		if r.URL.Path == "/api/v1/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		emptyQueryHandler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() map[string][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+// writeFile writes content to a new file in a temporary directory and returns its path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestNew_BasicAuth(t *testing.T) {
+	want := basicAuth("user", "secret")
+	tests := []struct {
+		name    string
+		config  Config
+		want    string
+		wantErr string
+	}{
+		{name: "password", config: Config{BasicAuthUser: "user", BasicAuthPassword: "secret"}, want: want},
+		{name: "password file", config: Config{BasicAuthUser: "user", BasicAuthPasswordFile: writeFile(t, "secret\n")}, want: want},
+		{name: "missing file", config: Config{BasicAuthUser: "user", BasicAuthPasswordFile: "/nonexistent"}, wantErr: "reading basic auth password"},
+		{name: "password and file", config: Config{BasicAuthUser: "user", BasicAuthPassword: "a", BasicAuthPasswordFile: "b"}, wantErr: "mutually exclusive"},
+		{name: "no user", config: Config{BasicAuthPassword: "secret"}, wantErr: "BasicAuthUser is required"},
+		{name: "with credential helper", config: Config{BasicAuthUser: "user", CredentialHelper: &CredentialHelperConfig{Command: []string{"true"}}}, wantErr: "CredentialHelper and BasicAuthUser are mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, got := recordHeaders(t, "Authorization")
+			tt.config.PrometheusEndpoint = server.URL
+			tt.config.MetricPrefix = "test_"
+			syncer, err := New(tt.config)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1))
+			assert.Equal(t, map[string][]string{
+				"/api/v1/query": {tt.want},
+				"/api/v1/write": {tt.want},
+			}, got())
+		})
+	}
+}
+
+func TestNew_BearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		want    string
+		wantErr string
+	}{
+		{name: "token", config: Config{BearerToken: "secret"}, want: "Bearer secret"},
+		{name: "token file", config: Config{BearerTokenFile: writeFile(t, "secret\n")}, want: "Bearer secret"},
+		{name: "token and file", config: Config{BearerToken: "a", BearerTokenFile: "b"}, wantErr: "BearerToken and BearerTokenFile are mutually exclusive"},
+		{name: "with basic auth", config: Config{BearerToken: "a", BasicAuthUser: "user"}, wantErr: "BasicAuthUser and BearerToken are mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, got := recordHeaders(t, "Authorization")
+			tt.config.PrometheusEndpoint = server.URL
+			tt.config.MetricPrefix = "test_"
+			syncer, err := New(tt.config)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1))
+			assert.Equal(t, map[string][]string{
+				"/api/v1/query": {tt.want},
+				"/api/v1/write": {tt.want},
+			}, got())
+		})
+	}
+}
+
+func TestTokenFileTransport_Rotation(t *testing.T) {
+	server, got := recordHeaders(t, "Authorization")
+	path := writeFile(t, "old")
+	client := &http.Client{Transport: &tokenFileTransport{base: http.DefaultTransport, path: path}}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, os.WriteFile(path, []byte("new"), 0o600))
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, []string{"Bearer old", "Bearer new"}, got()["/"])
+
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	_, err = client.Get(server.URL)
+	require.ErrorContains(t, err, "is empty")
+}
+
+func TestNew_TenantID(t *testing.T) {
+	server, got := recordHeaders(t, "X-Scope-OrgID")
+	syncer, err := New(Config{
+		PrometheusEndpoint: server.URL,
+		MetricPrefix:       "test_",
+		TenantID:           "tenant-1",
+		BearerToken:        "secret",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1))
+	assert.Equal(t, map[string][]string{
+		"/api/v1/query": {"tenant-1"},
+		"/api/v1/write": {"tenant-1"},
+	}, got())
+}
+
+// clientCert writes a self-signed client certificate and its key to PEM files
+// and returns their paths.
+func clientCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile = writeFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func TestNew_TLS(t *testing.T) {
+	var mu sync.Mutex
+	var clientCerts []int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		clientCerts = append(clientCerts, len(r.TLS.PeerCertificates))
+		mu.Unlock()
+		if r.URL.Path == "/api/v1/write" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		emptyQueryHandler(w, r)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	ca := writeFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	cert, key := clientCert(t)
+
+	tests := []struct {
+		name          string
+		config        Config
+		wantCerts     int
+		wantErr       string
+		wantReportErr string
+	}{
+		{name: "no options", wantReportErr: "certificate"},
+		{name: "CA", config: Config{TLSCACertFile: ca}},
+		{name: "skip verify", config: Config{TLSInsecureSkipVerify: true}},
+		{name: "client certificate", config: Config{TLSCACertFile: ca, TLSClientCertFile: cert, TLSClientKeyFile: key}, wantCerts: 1},
+		{name: "cert without key", config: Config{TLSClientCertFile: cert}, wantErr: "must be set together"},
+		{name: "invalid CA", config: Config{TLSCACertFile: key}, wantErr: "no CA certificates found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clientCerts = nil
+			mu.Unlock()
+			tt.config.PrometheusEndpoint = server.URL
+			tt.config.MetricPrefix = "test_"
+			syncer, err := New(tt.config)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			err = syncer.ReportMetric(context.Background(), "test_metric", time.Now(), 1)
+			if tt.wantReportErr != "" {
+				require.ErrorContains(t, err, tt.wantReportErr)
+				return
+			}
+			require.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, []int{tt.wantCerts, tt.wantCerts}, clientCerts, "client certificates of query and write")
+		})
+	}
+}
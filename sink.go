@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/knyar/aranet4-prom-collector/datadogsink"
+	"github.com/knyar/aranet4-prom-collector/otlpsink"
+	"github.com/knyar/aranet4-prom-collector/promsync"
+	"github.com/knyar/aranet4-prom-collector/stdoutsink"
+	"github.com/knyar/aranet4-prom-collector/vmsink"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink is a destination for metrics read from Aranet4.
+type Sink interface {
+	// ReportMetric reports a single metric value with the given timestamp.
+	ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error
+}
+
+// batchReporter is implemented by sinks that can report several metrics with
+// the same timestamp at once.
+type batchReporter interface {
+	ReportMetrics(ctx context.Context, ts time.Time, values map[string]float64) error
+}
+
+// flusher is implemented by sinks that buffer metrics and need to be flushed
+// at the end of each refresh.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// aborter is implemented by sinks that write in the background or buffer
+// points until Flush, and need to be told when a refresh fails.
+type aborter interface {
+	Abort()
+}
+
+// dedupResetter is implemented by sinks that keep track of the last reported
+// time of each metric.
+type dedupResetter interface {
+	// ResetLastTimes forgets the last reported time of a metric, or of all
+	// metrics if name is empty, and returns the number of times cleared.
+	ResetLastTimes(name string) int
+}
+
+// warmer is implemented by sinks that can look up the last reported times of
+// metrics ahead of the first refresh.
+type warmer interface {
+	Warmup(ctx context.Context, names []string) error
+}
+
+// checker is implemented by sinks that can verify their configuration
+// without writing any data.
+type checker interface {
+	Check(ctx context.Context) error
+}
+
+// labeledReporter is implemented by sinks that can report metrics with labels
+// beyond the configured ones.
+type labeledReporter interface {
+	ReportWithLabels(ctx context.Context, name string, labels map[string]string, ts time.Time, value float64) error
+}
+
+// clockSkewer is implemented by sinks that can measure how far their clock is
+// ahead of the local clock.
+type clockSkewer interface {
+	ClockSkew(ctx context.Context) (time.Duration, error)
+}
+
+// discardSink drops all metrics, for only exposing readings on /metrics with
+// -expose-readings.
+type discardSink struct{}
+
+func (discardSink) ReportMetric(context.Context, string, time.Time, float64) error {
+	return nil
+}
+
+// labelSchemes are the names of the built-in labels for each -label-scheme.
+var labelSchemes = map[string]struct{ job, instance, device string }{
+	"prometheus": {job: "job", instance: "instance", device: "device_addr"},
+	// OpenTelemetry resource semantic conventions.
+	"otel": {job: "service.name", instance: "service.instance.id", device: "device.id"},
+}
+
+// builtinLabels returns the labels added to all metrics of the device with the
+// given address, named according to the -label-scheme flag.
+func builtinLabels(addr string) (map[string]string, error) {
+	scheme, ok := labelSchemes[*labelScheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown label scheme %q", *labelScheme)
+	}
+	return map[string]string{
+		scheme.job:      *jobName,
+		scheme.instance: *instanceName,
+		scheme.device:   addr,
+	}, nil
+}
+
+// deviceRegisterer returns the registerer for the metrics of the collector and
+// sink of the device with the given address. With several devices, their
+// metrics carry the device label to keep them apart.
+func deviceRegisterer(addr string) prometheus.Registerer {
+	reg := prometheus.DefaultRegisterer
+	if len(deviceAddrs) > 1 {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{labelSchemes[*labelScheme].device: addr}, reg)
+	}
+	return reg
+}
+
+// isFutureTimestamp returns whether a sink rejected a value because its
+// timestamp is too far in the future.
+func isFutureTimestamp(err error) bool {
+	return errors.Is(err, promsync.ErrFutureTimestamp) || errors.Is(err, datadogsink.ErrFutureTimestamp)
+}
+
+// newSink creates the sink selected by the -sink flag.
+func newSink(labels map[string]string, reg prometheus.Registerer) (Sink, error) {
+	switch *sinkType {
+	case "prometheus":
+		var resolution time.Duration
+		switch *dedupRes {
+		case "seconds":
+			resolution = time.Second
+		case "milliseconds":
+			resolution = time.Millisecond
+		default:
+			return nil, fmt.Errorf("invalid dedup resolution %q", *dedupRes)
+		}
+		var sigV4 *promsync.SigV4Config
+		if *awsSigV4 {
+			sigV4 = &promsync.SigV4Config{Region: *awsRegion}
+		}
+		var credentialHelper *promsync.CredentialHelperConfig
+		if *credHelper != "" {
+			credentialHelper = &promsync.CredentialHelperConfig{Command: strings.Fields(*credHelper)}
+		}
+		var additionalPrefixes []string
+		if *extraPrefix != "" {
+			additionalPrefixes = strings.Split(*extraPrefix, ",")
+		}
+		// Async writers already overlap requests for different metrics,
+		// and need them written separately to keep each metric in order.
+		batch := *batchSize
+		if *asyncWriters > 0 {
+			batch = 0
+		}
+		var matchLabels []string
+		if *dedupLabels != "" {
+			matchLabels = strings.Split(*dedupLabels, ",")
+		}
+		state := *stateFile
+		if state != "" && len(deviceAddrs) > 1 {
+			// Each device is deduplicated separately, so it needs its own file.
+			addr := strings.ReplaceAll(labels[labelSchemes[*labelScheme].device], ":", "")
+			ext := filepath.Ext(state)
+			state = strings.TrimSuffix(state, ext) + "-" + addr + ext
+		}
+		maxAge := *stateMaxAge
+		if maxAge == 0 {
+			// Survive a restart or a couple of failed refreshes.
+			maxAge = 3 * *interval
+		}
+		return promsync.New(promsync.Config{
+			PrometheusEndpoint: *promEndpoint,
+			RemoteWriteURL:     *rwURL,
+			MetricPrefix:       *metricPrefix,
+			AdditionalPrefixes: additionalPrefixes,
+			Labels:             labels,
+			ExtraLabels:        extraLabels,
+			DryRun:             *dryRun,
+			LogSamples:         *logSamples,
+			Registerer:         reg,
+			DedupResolution:    resolution,
+			DedupMatchLabels:   matchLabels,
+			DedupBestEffort:    *bestEffort,
+			LookbackDelta:      *lookback,
+			MaxFutureSkew:      *futureSkew,
+			DedupConcurrency:   *dedupConc,
+			IdleConnTimeout:    *idleTimeout,
+			WriteTimeout:       *writeTimeout,
+			WriteRetries:       *writeRetries,
+			StateFile:          state,
+			StateMaxAge:        maxAge,
+			AsyncWriters:       *asyncWriters,
+			BatchSize:          batch,
+			SigV4:              sigV4,
+			CredentialHelper:   credentialHelper,
+
+			BasicAuthUser:         *promUser,
+			BasicAuthPasswordFile: *promPassFile,
+			BearerTokenFile:       *promToken,
+			TenantID:              *promTenant,
+
+			TLSCACertFile:         *promCAFile,
+			TLSClientCertFile:     *promCertFile,
+			TLSClientKeyFile:      *promKeyFile,
+			TLSInsecureSkipVerify: *promInsecure,
+
+			RemoteWriteVersionHeader: *rwVersion,
+		})
+	case "datadog":
+		tags, err := mergeLabels(labels)
+		if err != nil {
+			return nil, err
+		}
+		return datadogsink.New(datadogsink.Config{
+			Endpoint:     *datadogURL,
+			APIKey:       *datadogAPIKey,
+			MetricPrefix: *metricPrefix,
+			Labels:       tags,
+			DryRun:       *dryRun,
+			LogSamples:   *logSamples,
+		})
+	case "victoriametrics":
+		all, err := mergeLabels(labels)
+		if err != nil {
+			return nil, err
+		}
+		return vmsink.New(vmsink.Config{
+			Endpoint:      *vmURL,
+			MetricPrefix:  *metricPrefix,
+			Labels:        all,
+			DryRun:        *dryRun,
+			LogSamples:    *logSamples,
+			LookbackDelta: *lookback,
+		})
+	case "none":
+		return discardSink{}, nil
+	case "stdout":
+		all, err := mergeLabels(labels)
+		if err != nil {
+			return nil, err
+		}
+		return stdoutsink.New(stdoutsink.Config{
+			MetricPrefix: *metricPrefix,
+			Labels:       all,
+		})
+	default:
+		return nil, fmt.Errorf("unknown sink %q", *sinkType)
+	}
+}
+
+// newOTLPSink creates the sink for -otlp-endpoint, with the labels of the
+// device as resource attributes.
+func newOTLPSink(addr string) (*otlpsink.Sink, error) {
+	labels, err := builtinLabels(addr)
+	if err == nil {
+		labels, err = mergeLabels(labels)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels: %w", err)
+	}
+	return otlpsink.New(otlpsink.Config{
+		Endpoint:     *otlpURL,
+		MetricPrefix: *metricPrefix,
+		Labels:       labels,
+		DryRun:       *dryRun,
+		LogSamples:   *logSamples,
+	})
+}
+
+// mergeLabels returns the built-in labels together with the -label flags, for
+// sinks without a separate notion of extra labels.
+func mergeLabels(labels map[string]string) (map[string]string, error) {
+	all := maps.Clone(labels)
+	for name, value := range extraLabels {
+		if _, ok := all[name]; ok {
+			return nil, fmt.Errorf("label %q is configured more than once", name)
+		}
+		all[name] = value
+	}
+	return all, nil
+}
@@ -0,0 +1,115 @@
+// Package stdoutsink writes metrics in the Prometheus text exposition format,
+// e.g. for vmagent or a file-based scraper to pick up.
+package stdoutsink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNonFinite is returned by ReportMetric for NaN and infinite values.
+var ErrNonFinite = errors.New("value is not finite")
+
+// Config holds configuration for the stdout sink.
+type Config struct {
+	// Writer is where metrics are written (default os.Stdout).
+	Writer io.Writer
+
+	// MetricPrefix is the prefix to use for all metric names (e.g., "aranet4_")
+	MetricPrefix string
+
+	// Labels are labels to add to all metrics.
+	Labels map[string]string
+}
+
+// Sink buffers metrics and writes them to a writer in the text exposition
+// format when Flush is called, with one metric family per metric and an
+// explicit timestamp on every sample.
+type Sink struct {
+	w      io.Writer
+	config *Config
+	labels []*dto.LabelPair
+
+	// pending is a map of metric name to samples not yet written.
+	pending map[string][]*dto.Metric
+
+	// lastTimes is a map of metric name to the time of its last written
+	// sample, so that history read again on every refresh is only written once.
+	lastTimes map[string]time.Time
+}
+
+// New creates a new stdout sink with the given configuration.
+func New(config Config) (*Sink, error) {
+	w := config.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	var labels []*dto.LabelPair
+	for _, name := range slices.Sorted(maps.Keys(config.Labels)) {
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(config.Labels[name])})
+	}
+	return &Sink{
+		w:         w,
+		config:    &config,
+		labels:    labels,
+		pending:   make(map[string][]*dto.Metric),
+		lastTimes: make(map[string]time.Time),
+	}, nil
+}
+
+// ReportMetric buffers a metric value to be written on the next Flush.
+// Values not newer than the last written one (at millisecond precision, as
+// used by the exposition format) are skipped.
+func (s *Sink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if ts.IsZero() {
+		return fmt.Errorf("cannot report metric %q with zero timestamp", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("metric %q value %v: %w", name, value, ErrNonFinite)
+	}
+
+	last := s.lastTimes[name]
+	if ms := s.pending[name]; len(ms) > 0 {
+		last = time.UnixMilli(ms[len(ms)-1].GetTimestampMs())
+	}
+	if !ts.Truncate(time.Millisecond).After(last) {
+		return nil
+	}
+
+	s.pending[name] = append(s.pending[name], &dto.Metric{
+		Label:       s.labels,
+		Gauge:       &dto.Gauge{Value: proto.Float64(value)},
+		TimestampMs: proto.Int64(ts.UnixMilli()),
+	})
+	return nil
+}
+
+// Flush writes all buffered samples, one metric family per metric name.
+func (s *Sink) Flush(ctx context.Context) error {
+	for _, name := range slices.Sorted(maps.Keys(s.pending)) {
+		ms := s.pending[name]
+		mf := &dto.MetricFamily{
+			Name:   proto.String(s.config.MetricPrefix + name),
+			Help:   proto.String("Aranet4 " + name + " reported by aranet4-prom-collector."),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: ms,
+		}
+		if _, err := expfmt.MetricFamilyToText(s.w, mf); err != nil {
+			return fmt.Errorf("writing metric %q: %w", name, err)
+		}
+		s.lastTimes[name] = time.UnixMilli(ms[len(ms)-1].GetTimestampMs())
+		delete(s.pending, name)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package stdoutsink
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlush(t *testing.T) {
+	var buf bytes.Buffer
+	sink, err := New(Config{
+		Writer:       &buf,
+		MetricPrefix: "aranet4_",
+		Labels:       map[string]string{"job": "aranet4", "service.name": "air"},
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	ts := time.UnixMilli(1700000000123)
+	require.NoError(t, sink.ReportMetric(ctx, "temperature_celsius", ts, 21.5))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts, 600))
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts, 601), "duplicates are skipped")
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts.Add(time.Minute), 650))
+	require.NoError(t, sink.Flush(ctx))
+
+	assert.Equal(t, `# HELP aranet4_co2_ppm Aranet4 co2_ppm reported by aranet4-prom-collector.
+# TYPE aranet4_co2_ppm gauge
+aranet4_co2_ppm{job="aranet4","service.name"="air"} 600 1700000000123
+aranet4_co2_ppm{job="aranet4","service.name"="air"} 650 1700000060123
+# HELP aranet4_temperature_celsius Aranet4 temperature_celsius reported by aranet4-prom-collector.
+# TYPE aranet4_temperature_celsius gauge
+aranet4_temperature_celsius{job="aranet4","service.name"="air"} 21.5 1700000000123
+`, buf.String())
+
+	// Samples already written are not written again.
+	buf.Reset()
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts.Add(time.Minute), 650))
+	require.NoError(t, sink.Flush(ctx))
+	assert.Empty(t, buf.String())
+}
+
+func TestReportMetric_Validation(t *testing.T) {
+	sink, err := New(Config{Writer: &bytes.Buffer{}})
+	require.NoError(t, err)
+
+	err = sink.ReportMetric(context.Background(), "co2_ppm", time.Time{}, 1)
+	require.ErrorContains(t, err, "zero timestamp")
+	err = sink.ReportMetric(context.Background(), "co2_ppm", time.Now(), math.NaN())
+	require.ErrorIs(t, err, ErrNonFinite)
+}
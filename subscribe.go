@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/rigado/ble"
+)
+
+// uuidCurrentReadings is the characteristic holding the latest measurement.
+const uuidCurrentReadings = "f0cd3001-95da-4f4b-9ac8-aa55d312af0c"
+
+// errNotifyUnsupported is returned by subscribeOnce if the device does not
+// notify about new measurements.
+var errNotifyUnsupported = errors.New("device does not support notifications for current readings")
+
+// subscribe keeps a connection to the device open, reporting each new
+// measurement when the device notifies about it, and reconnects when the
+// connection drops. It only returns if the device does not support
+// notifications, in which case the caller should fall back to polling.
+func (c *collector) subscribe() {
+	failures := 0
+	for {
+		connected, err := c.subscribeOnce()
+		if errors.Is(err, errNotifyUnsupported) {
+			slog.Warn("subscription not supported, falling back to polling", "error", err)
+			return
+		}
+		if connected {
+			failures = 0
+		}
+		failures++
+		slog.Error("subscription ended, reconnecting", "error", err, "consecutive_failures", failures)
+		if *maxFails > 0 && failures >= *maxFails {
+			slog.Error("too many consecutive failures; exiting", "max-consecutive-failures", *maxFails)
+			os.Exit(1)
+		}
+		// Back off on repeated failures, but never wait longer than a
+		// polling interval.
+		time.Sleep(min(time.Duration(failures)*10*time.Second, *interval))
+	}
+}
+
+// subscribeOnce connects to the device, backfills history and then reports
+// the latest measurement on every notification until the connection drops.
+// It returns whether the subscription was established.
+func (c *collector) subscribeOnce() (subscribed bool, _ error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	device, disconnect, err := c.connectAny(ctx)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer disconnect()
+
+	client := device.Client()
+	char := client.Profile().FindCharacteristic(&ble.Characteristic{UUID: ble.MustParse(uuidCurrentReadings)})
+	if char == nil || char.Property&ble.CharNotify == 0 {
+		return false, errNotifyUnsupported
+	}
+	notified := make(chan struct{}, 1)
+	err = client.Subscribe(char, false, func(uint, []byte) {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return false, fmt.Errorf("subscribing to current readings: %w", err)
+	}
+	slog.Info("subscribed to device notifications", "device-addr", c.addr)
+
+	read := func(history bool) func(context.Context) (*aranet4.Data, []aranet4.Data, error) {
+		return func(context.Context) (*aranet4.Data, []aranet4.Data, error) {
+			return c.readDevice(device, history && !*onlyLatest)
+		}
+	}
+
+	// Fill the gap since the last refresh, then only report new measurements,
+	// reading history again when a refresh is requested.
+	err = c.refreshWith(read(true))
+	c.writeHeartbeat(err)
+	c.writeDeviceUp(err)
+	if err != nil {
+		return true, err
+	}
+	for {
+		select {
+		case <-client.Disconnected():
+			return true, errors.New("device disconnected")
+		case <-notified:
+			slog.Debug("new measurement notified")
+			err = c.refreshWith(read(false))
+		case <-c.refreshChan:
+			err = c.refreshWith(read(true))
+		}
+		c.writeHeartbeat(err)
+		c.writeDeviceUp(err)
+		if err != nil {
+			return true, err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tailColumns is the format of a row of the table printed by tail.
+const tailColumns = "%-25s  %9s  %9s  %12s  %14s  %11s\n"
+
+// tail prints the latest measurement to w on every interval until ctx is
+// canceled, without writing anything to a sink. Failed reads are logged and
+// retried on the next interval.
+func tail(ctx context.Context, w io.Writer) error {
+	c := newCollectorWithRegistry(nil, prometheus.NewRegistry())
+	c.addr = deviceAddrs[0]
+	_, err := fmt.Fprintf(w, tailColumns, "TIME", "CO2 (ppm)", "TEMP (°C)", "HUMIDITY (%)", "PRESSURE (hPa)", "BATTERY (%)")
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, *timeout)
+		data, err := c.readLatest(readCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Error("failed to read device", "error", err)
+		} else if err := printReading(w, data); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readLatest reads only the latest measurement from Aranet4.
+func (c *collector) readLatest(ctx context.Context) (*aranet4.Data, error) {
+	device, disconnect, err := c.connectAny(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+	latest, _, err := c.readDevice(device, false)
+	return latest, err
+}
+
+// printReading prints a measurement as a row of the tail table.
+func printReading(w io.Writer, data *aranet4.Data) error {
+	battery := "-"
+	if data.Battery > -1 {
+		battery = strconv.Itoa(data.Battery)
+	}
+	_, err := fmt.Fprintf(w, tailColumns, data.Time.Format(time.RFC3339), strconv.Itoa(data.CO2),
+		strconv.FormatFloat(data.T, 'f', 1, 64), strconv.FormatFloat(data.H, 'f', 0, 64),
+		strconv.FormatFloat(data.P, 'f', 1, 64), battery)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// celsiusToFahrenheit converts a temperature from degrees Celsius to degrees Fahrenheit.
+func celsiusToFahrenheit(c float64) float64 {
+	return c*9/5 + 32
+}
+
+// hpaToMmHg converts a pressure from hectopascals to millimetres of mercury.
+func hpaToMmHg(p float64) float64 {
+	return p * 100 / 133.322387415
+}
+
+// hpaToInHg converts a pressure from hectopascals to inches of mercury.
+func hpaToInHg(p float64) float64 {
+	return p * 100 / 3386.389
+}
+
+// temperatureMetrics maps -temperature-unit values to the names of the
+// temperature metrics reported.
+var temperatureMetrics = map[string][]string{
+	"celsius":    {"temperature_celsius"},
+	"fahrenheit": {"temperature_fahrenheit"},
+	"both":       {"temperature_celsius", "temperature_fahrenheit"},
+}
+
+// pressureMetrics maps -pressure-unit values to the name of the pressure
+// metric reported.
+var pressureMetrics = map[string]string{
+	"hpa":  "pressure_hpa",
+	"mmhg": "pressure_mmhg",
+	"inhg": "pressure_inhg",
+}
+
+// conversions are metrics reported in another unit than the device measures
+// in, by name. They are derived from the value of base after its correction.
+var conversions = map[string]struct {
+	base    string
+	convert func(float64) float64
+}{
+	"temperature_fahrenheit": {base: "temperature_celsius", convert: celsiusToFahrenheit},
+	"pressure_mmhg":          {base: "pressure_hpa", convert: hpaToMmHg},
+	"pressure_inhg":          {base: "pressure_hpa", convert: hpaToInHg},
+	"dew_point_fahrenheit":   {base: "dew_point_celsius", convert: celsiusToFahrenheit},
+}
+
+// withUnits returns the metrics with temperature_celsius (and
+// dew_point_celsius) and pressure_hpa replaced by the metrics for the given
+// temperature unit and comma-separated list of pressure units.
+func withUnits(metrics []metric, temperature, pressure string) ([]metric, error) {
+	temps, ok := temperatureMetrics[temperature]
+	if !ok {
+		return nil, fmt.Errorf("unknown temperature unit %q", temperature)
+	}
+	var pressures []string
+	for unit := range strings.SplitSeq(pressure, ",") {
+		name, ok := pressureMetrics[strings.ToLower(strings.TrimSpace(unit))]
+		if !ok {
+			return nil, fmt.Errorf("unknown pressure unit %q", unit)
+		}
+		if slices.Contains(pressures, name) {
+			return nil, fmt.Errorf("pressure unit %q is configured more than once", unit)
+		}
+		pressures = append(pressures, name)
+	}
+	var dewPoints []string
+	for _, name := range temps {
+		dewPoints = append(dewPoints, "dew_point_"+strings.TrimPrefix(name, "temperature_"))
+	}
+	replacements := map[string][]string{
+		"temperature_celsius": temps,
+		"pressure_hpa":        pressures,
+		"dew_point_celsius":   dewPoints,
+	}
+
+	var out []metric
+	for _, m := range metrics {
+		names, ok := replacements[m.name]
+		if !ok {
+			out = append(out, m)
+			continue
+		}
+		for _, name := range names {
+			out = append(out, convertedMetric(m, name))
+		}
+	}
+	return out, nil
+}
+
+// convertedMetric returns the metric with the given name derived from base,
+// which is base itself if name is not a conversion.
+func convertedMetric(base metric, name string) metric {
+	conv, ok := conversions[name]
+	if !ok {
+		return base
+	}
+	m := base
+	m.name = name
+	m.base = conv.base
+	m.convert = conv.convert
+	return m
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCelsiusToFahrenheit(t *testing.T) {
+	tests := []struct {
+		celsius, want float64
+	}{
+		{celsius: 0, want: 32},
+		{celsius: 100, want: 212},
+		{celsius: -40, want: -40},
+		{celsius: 21.5, want: 70.7},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.want, celsiusToFahrenheit(tt.celsius), 1e-9, "%g°C", tt.celsius)
+	}
+}
+
+func TestPressureConversions(t *testing.T) {
+	tests := []struct {
+		name    string
+		convert func(float64) float64
+		hpa     float64
+		want    float64
+	}{
+		{name: "mmhg standard", convert: hpaToMmHg, hpa: 1013.25, want: 760},
+		{name: "mmhg zero", convert: hpaToMmHg, hpa: 0, want: 0},
+		{name: "mmhg low", convert: hpaToMmHg, hpa: 980, want: 735.06},
+		{name: "inhg standard", convert: hpaToInHg, hpa: 1013.25, want: 29.921},
+		{name: "inhg zero", convert: hpaToInHg, hpa: 0, want: 0},
+		{name: "inhg high", convert: hpaToInHg, hpa: 1030, want: 30.416},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, tt.convert(tt.hpa), 0.01)
+		})
+	}
+}
+
+func TestWithUnits(t *testing.T) {
+	tests := []struct {
+		name        string
+		temperature string
+		pressure    string
+		want        []string
+		wantErr     string
+	}{
+		{name: "default", temperature: "celsius", pressure: "hpa", want: []string{"co2_ppm", "humidity_percent", "pressure_hpa", "temperature_celsius"}},
+		{name: "fahrenheit", temperature: "fahrenheit", pressure: "hpa", want: []string{"co2_ppm", "humidity_percent", "pressure_hpa", "temperature_fahrenheit"}},
+		{name: "both temperatures", temperature: "both", pressure: "hpa", want: []string{"co2_ppm", "humidity_percent", "pressure_hpa", "temperature_celsius", "temperature_fahrenheit"}},
+		{name: "inhg", temperature: "celsius", pressure: "inHg", want: []string{"co2_ppm", "humidity_percent", "pressure_inhg", "temperature_celsius"}},
+		{name: "all pressures", temperature: "celsius", pressure: "hpa, mmhg,inhg", want: []string{"co2_ppm", "humidity_percent", "pressure_hpa", "pressure_mmhg", "pressure_inhg", "temperature_celsius"}},
+		{name: "unknown temperature", temperature: "kelvin", pressure: "hpa", wantErr: "unknown temperature unit"},
+		{name: "unknown pressure", temperature: "celsius", pressure: "psi", wantErr: "unknown pressure unit"},
+		{name: "duplicate pressure", temperature: "celsius", pressure: "hpa,hpa", wantErr: "more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := withUnits(recordMetrics, tt.temperature, tt.pressure)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, metricNames(metrics))
+		})
+	}
+}
+
+func TestReportMetrics_Units(t *testing.T) {
+	setFlag(t, reportRaw, true)
+	corrections["temperature_celsius"] = correction{scale: 1, offset: -1}
+	t.Cleanup(func() { delete(corrections, "temperature_celsius") })
+	metrics, err := withUnits(recordMetrics, "both", "hpa,mmhg")
+	require.NoError(t, err)
+
+	c, sink := newTestCollector(t, aranet4.Data{}, nil)
+	ts := time.Now().Truncate(time.Second)
+	data := aranet4.Data{CO2: 600, T: 21, H: 40, P: 1000, Battery: 60, Time: ts}
+	require.NoError(t, c.reportMetrics(context.Background(), &data, metrics))
+
+	// The correction applies before converting.
+	assert.ElementsMatch(t, []sample{
+		{name: "co2_ppm", ts: ts, value: 600},
+		{name: "humidity_percent", ts: ts, value: 40},
+		{name: "pressure_hpa", ts: ts, value: 1000},
+		{name: "pressure_mmhg", ts: ts, value: hpaToMmHg(1000)},
+		{name: "temperature_celsius_raw", ts: ts, value: 21},
+		{name: "temperature_celsius", ts: ts, value: 20},
+		{name: "temperature_fahrenheit_raw", ts: ts, value: celsiusToFahrenheit(21)},
+		{name: "temperature_fahrenheit", ts: ts, value: 68},
+	}, sink.samples)
+}
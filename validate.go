@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux"
+)
+
+// validate checks that the sink is reachable and accepts writes, and that each
+// device can be discovered via at least one adapter, without writing any data
+// or connecting to the devices. It returns whether all checks passed.
+func validate(sink Sink, addrs []string) bool {
+	ok := true
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if c, isChecker := sink.(checker); isChecker {
+		if err := c.Check(ctx); err != nil {
+			slog.Error("sink check failed", "sink", *sinkType, "error", err)
+			ok = false
+		} else {
+			slog.Info("sink check passed", "sink", *sinkType)
+		}
+	} else {
+		slog.Warn("sink does not support checks, skipping", "sink", *sinkType)
+	}
+
+	for _, addr := range addrs {
+		if !validateDevice(addr) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// validateDevice checks that the device can be discovered via at least one
+// adapter.
+func validateDevice(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var errs []error
+	for _, id := range hciSocketIDs {
+		err := discoverDevice(ctx, id, addr)
+		if err == nil {
+			slog.Info("device discovered", "device-addr", addr, "hci-socket-id", id)
+			return true
+		}
+		errs = append(errs, err)
+	}
+	slog.Error("device check failed", "device-addr", addr, "error", errors.Join(errs...))
+	return false
+}
+
+// discoverDevice opens the given adapter and scans until the device is seen.
+// The device only advertises periodically, so a scan that does not see it is
+// retried up to -scan-retries times.
+func discoverDevice(ctx context.Context, id int, addr string) error {
+	d, err := linux.NewDevice(ble.OptTransportHCISocket(id))
+	if err != nil {
+		return fmt.Errorf("can't init device hci-socket-id=%d: %w", id, err)
+	}
+	ble.SetDefaultDevice(d)
+	defer d.Stop()
+
+	for attempt := 1; ; attempt++ {
+		slog.Info("scanning for device", "device-addr", addr, "hci-socket-id", id, "attempt", attempt, "scan-timeout", *scanTimeout)
+		found, seen, err := scanFor(ctx, *scanTimeout, addr)
+		if found {
+			return nil
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("scanning via hci-socket-id=%d: %w", id, err)
+		}
+		slog.Info("device not seen", "hci-socket-id", id, "attempt", attempt, "devices_seen", seen)
+		if attempt > *scanRetries || ctx.Err() != nil {
+			return fmt.Errorf("device not seen via hci-socket-id=%d in %d scans of %v", id, attempt, *scanTimeout)
+		}
+	}
+}
+
+// scanFor scans with the default device until the device with address target
+// is seen or the timeout expires. It returns whether the device was seen, and
+// the other devices seen, as addresses with the advertised name if there is one.
+func scanFor(ctx context.Context, timeout time.Duration, target string) (found bool, seen []string, _ error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var mu sync.Mutex
+	names := make(map[string]string)
+	err := ble.Scan(ctx, false, func(a ble.Advertisement) {
+		addr := a.Addr().String()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.EqualFold(addr, target) {
+			found = true
+			cancel()
+			return
+		}
+		if name := a.LocalName(); name != "" || names[addr] == "" {
+			names[addr] = name
+		}
+	}, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, addr := range slices.Sorted(maps.Keys(names)) {
+		if name := names[addr]; name != "" {
+			addr += " (" + name + ")"
+		}
+		seen = append(seen, addr)
+	}
+	return found, seen, err
+}
@@ -0,0 +1,240 @@
+// Package vmsink writes metrics to VictoriaMetrics using its JSON line import
+// API, which is cheaper than remote write for backfilling history.
+package vmsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/knyar/aranet4-prom-collector/promsync"
+)
+
+// ErrNonFinite is returned by ReportMetric for NaN and infinite values.
+var ErrNonFinite = errors.New("value is not finite")
+
+// Config holds configuration for the VictoriaMetrics sink.
+type Config struct {
+	// Endpoint is the base URL of VictoriaMetrics (e.g., "http://localhost:8428/").
+	// It is used both for importing data and for querying the last written
+	// samples through the Prometheus query API.
+	Endpoint string
+
+	// MetricPrefix is the prefix to use for all metric names (e.g., "aranet4_")
+	MetricPrefix string
+
+	// Labels are labels to add to all metrics.
+	Labels map[string]string
+
+	// DryRun, if true, will log metrics instead of importing them.
+	DryRun bool
+
+	// LogSamples, if true, logs every imported sample at info level.
+	LogSamples bool
+
+	// LookbackDelta is how far back the last imported sample of a metric is
+	// looked up (default promsync.DefaultLookbackDelta).
+	LookbackDelta time.Duration
+}
+
+// Sink buffers metrics and imports them into VictoriaMetrics when Flush is
+// called, with one JSON line per metric, so that a whole refresh is sent in a
+// single request. Like the Prometheus syncer, it queries the timestamp of the
+// last sample of each metric to avoid importing duplicates.
+type Sink struct {
+	client    *http.Client
+	api       api.Client
+	importURL string
+	config    *Config
+
+	// pending is a map of metric name to samples not yet imported.
+	pending map[string]*line
+
+	// lastTimes is a map of metric name to the last time it was imported.
+	lastTimes map[string]time.Time
+}
+
+// line is a single line of the JSON line import format.
+// https://docs.victoriametrics.com/victoriametrics/single-server-victoriametrics/#how-to-import-data-in-json-line-format
+type line struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// New creates a new VictoriaMetrics sink with the given configuration.
+func New(config Config) (*Sink, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("Endpoint is required")
+	}
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL %q: %w", config.Endpoint, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("URL %q has no host", config.Endpoint)
+	}
+	if _, ok := config.Labels[model.MetricNameLabel]; ok {
+		return nil, fmt.Errorf("label %q is reserved", model.MetricNameLabel)
+	}
+	if config.LookbackDelta < 0 {
+		return nil, fmt.Errorf("LookbackDelta must not be negative")
+	}
+	if config.LookbackDelta == 0 {
+		config.LookbackDelta = promsync.DefaultLookbackDelta
+	}
+
+	client, err := api.NewClient(api.Config{Address: u.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create query client: %w", err)
+	}
+	importURL := u.JoinPath("/api/v1/import")
+	slog.Debug("VictoriaMetrics sink created", "url", importURL.String(), "prefix", config.MetricPrefix, "labels", config.Labels)
+
+	return &Sink{
+		client:    &http.Client{Timeout: time.Minute},
+		api:       client,
+		importURL: importURL.String(),
+		config:    &config,
+		pending:   make(map[string]*line),
+		lastTimes: make(map[string]time.Time),
+	}, nil
+}
+
+// ReportMetric buffers a metric value to be imported on the next Flush.
+// Values not newer than the last imported one are skipped.
+func (s *Sink) ReportMetric(ctx context.Context, name string, ts time.Time, value float64) error {
+	if ts.IsZero() {
+		return fmt.Errorf("cannot report metric %q with zero timestamp", name)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("metric %q value %v: %w", name, value, ErrNonFinite)
+	}
+
+	last, err := s.lastTime(ctx, name)
+	if err != nil {
+		return fmt.Errorf("getting last time for metric %q: %w", s.config.MetricPrefix+name, err)
+	}
+	if !ts.Truncate(time.Second).After(last.Truncate(time.Second)) {
+		slog.Debug("skipping value with timestamp before last reported", "metric", name, "ts", ts, "last", last)
+		return nil
+	}
+
+	l := s.pending[name]
+	if l == nil {
+		l = &line{Metric: s.labelSet(name)}
+		s.pending[name] = l
+	}
+	l.Values = append(l.Values, value)
+	l.Timestamps = append(l.Timestamps, ts.UnixMilli())
+	return nil
+}
+
+// lastTime returns the time of the last sample of a metric, including samples
+// not imported yet, querying VictoriaMetrics if it is not known.
+func (s *Sink) lastTime(ctx context.Context, name string) (time.Time, error) {
+	if l := s.pending[name]; l != nil {
+		return time.UnixMilli(l.Timestamps[len(l.Timestamps)-1]), nil
+	}
+	if last, ok := s.lastTimes[name]; ok {
+		return last, nil
+	}
+	query := fmt.Sprintf("timestamp(%s)", labels.FromMap(s.labelSet(name)).String())
+	last, err := promsync.QueryLastTime(ctx, s.api, query, s.config.LookbackDelta)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !last.IsZero() {
+		s.lastTimes[name] = last
+	}
+	return last, nil
+}
+
+// labelSet returns the full label set of a metric, including its name.
+func (s *Sink) labelSet(name string) map[string]string {
+	ll := maps.Clone(s.config.Labels)
+	if ll == nil {
+		ll = make(map[string]string)
+	}
+	ll[model.MetricNameLabel] = s.config.MetricPrefix + name
+	return ll
+}
+
+// Flush imports all buffered samples in a single request.
+func (s *Sink) Flush(ctx context.Context) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, name := range slices.Sorted(maps.Keys(s.pending)) {
+		if err := enc.Encode(s.pending[name]); err != nil {
+			return fmt.Errorf("encoding metric %q: %w", name, err)
+		}
+	}
+
+	if s.config.DryRun {
+		// Nothing was imported, so last imported times are not advanced.
+		slog.Info("dry run, skipping VictoriaMetrics import", "payload", strings.TrimSpace(body.String()))
+		clear(s.pending)
+		return nil
+	}
+	if err := s.send(ctx, body.Bytes()); err != nil {
+		return err
+	}
+
+	for name, l := range s.pending {
+		if s.config.LogSamples {
+			for i, ts := range l.Timestamps {
+				slog.Info("imported sample", "metric", s.config.MetricPrefix+name, "value", l.Values[i], "ts", time.UnixMilli(ts).Format(time.RFC3339))
+			}
+		}
+		s.lastTimes[name] = time.UnixMilli(l.Timestamps[len(l.Timestamps)-1])
+	}
+	clear(s.pending)
+	return nil
+}
+
+// Check verifies that VictoriaMetrics can be queried, without importing data.
+func (s *Sink) Check(ctx context.Context) error {
+	if _, err := promsync.QueryLastTime(ctx, s.api, "timestamp(vector(1))", s.config.LookbackDelta); err != nil {
+		return fmt.Errorf("querying VictoriaMetrics: %w", err)
+	}
+	return nil
+}
+
+// send posts JSON lines to the import endpoint.
+func (s *Sink) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.importURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sending request: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
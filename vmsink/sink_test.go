@@ -0,0 +1,165 @@
+package vmsink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{
+			name:   "valid config",
+			config: Config{Endpoint: "http://localhost:8428/", MetricPrefix: "test_"},
+		},
+		{
+			name:    "missing endpoint",
+			config:  Config{},
+			wantErr: "Endpoint is required",
+		},
+		{
+			name:    "URL without host",
+			config:  Config{Endpoint: "http://"},
+			wantErr: "has no host",
+		},
+		{
+			name:    "negative lookback",
+			config:  Config{Endpoint: "http://localhost:8428/", LookbackDelta: -time.Hour},
+			wantErr: "LookbackDelta",
+		},
+		{
+			name:    "reserved label",
+			config:  Config{Endpoint: "http://localhost:8428/", Labels: map[string]string{"__name__": "foo"}},
+			wantErr: "is reserved",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := New(tt.config)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				require.Nil(t, sink)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, sink)
+			}
+		})
+	}
+}
+
+// newTestServer returns a VictoriaMetrics mock whose queries return last as
+// the timestamp of every series, recording query strings and import bodies.
+func newTestServer(t *testing.T, last time.Time, queries, imports *[]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/query":
+			assert.NoError(t, r.ParseForm())
+			*queries = append(*queries, r.Form.Get("query"))
+			result := []any{}
+			if !last.IsZero() {
+				ts := float64(last.Unix())
+				result = append(result, map[string]any{"metric": map[string]any{}, "value": []any{ts, fmt.Sprint(ts)}})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"status": "success",
+				"data":   map[string]any{"resultType": "vector", "result": result},
+			})
+		case "/api/v1/import":
+			body, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			*imports = append(*imports, string(body))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFlush(t *testing.T) {
+	last := time.Unix(1700000000, 0)
+	var queries, imports []string
+	srv := newTestServer(t, last, &queries, &imports)
+	sink, err := New(Config{Endpoint: srv.URL, MetricPrefix: "test_", Labels: map[string]string{"job": "aranet4"}})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, ts := range []time.Time{last.Add(-time.Minute), last, last.Add(time.Minute), last.Add(2 * time.Minute)} {
+		require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", ts, 600))
+	}
+	require.NoError(t, sink.ReportMetric(ctx, "temperature_celsius", last.Add(time.Minute), 21.5))
+	require.NoError(t, sink.Flush(ctx))
+
+	assert.Equal(t, []string{
+		`timestamp({__name__="test_co2_ppm", job="aranet4"})`,
+		`timestamp({__name__="test_temperature_celsius", job="aranet4"})`,
+	}, queries)
+	require.Len(t, imports, 1)
+	assert.Equal(t, strings.Join([]string{
+		`{"metric":{"__name__":"test_co2_ppm","job":"aranet4"},"values":[600,600],"timestamps":[1700000060000,1700000120000]}`,
+		`{"metric":{"__name__":"test_temperature_celsius","job":"aranet4"},"values":[21.5],"timestamps":[1700000060000]}`,
+		``,
+	}, "\n"), imports[0])
+
+	// Imported samples are not imported again, and queries are not repeated.
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", last.Add(2*time.Minute), 600))
+	require.NoError(t, sink.Flush(ctx))
+	assert.Len(t, imports, 1)
+	assert.Len(t, queries, 2)
+}
+
+func TestLookbackDelta(t *testing.T) {
+	for _, tt := range []struct {
+		lookback time.Duration
+		want     string
+	}{
+		{lookback: 0, want: "720h0m0s"},
+		{lookback: 7 * 24 * time.Hour, want: "168h0m0s"},
+	} {
+		var lookbacks []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, r.ParseForm())
+			lookbacks = append(lookbacks, r.Form.Get("lookback_delta"))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{
+				"status": "success",
+				"data":   map[string]any{"resultType": "vector", "result": []any{}},
+			})
+		}))
+		t.Cleanup(srv.Close)
+		sink, err := New(Config{Endpoint: srv.URL, LookbackDelta: tt.lookback})
+		require.NoError(t, err)
+
+		require.NoError(t, sink.ReportMetric(context.Background(), "co2_ppm", time.Now(), 600))
+		assert.Equal(t, []string{tt.want}, lookbacks)
+	}
+}
+
+func TestFlush_DryRun(t *testing.T) {
+	var queries, imports []string
+	srv := newTestServer(t, time.Time{}, &queries, &imports)
+	sink, err := New(Config{Endpoint: srv.URL, MetricPrefix: "test_", DryRun: true})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, sink.ReportMetric(ctx, "co2_ppm", time.Now(), 600))
+	require.NoError(t, sink.Flush(ctx))
+	assert.Empty(t, imports)
+	assert.Empty(t, sink.lastTimes, "dry run must not advance last imported times")
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"embed"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //go:embed index.html
@@ -63,11 +73,124 @@ func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDeviceInfo serves the device metadata from the last successful read as JSON.
+func (c *collector) handleDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := c.deviceInfo.Load()
+	if info == nil {
+		http.Error(w, "Service Unavailable: device has not been read yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		slog.Error("failed to encode device info", "error", err)
+	}
+}
+
+// handleHealthz reports that the web server is up, for liveness checks.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler returns a handler for readiness checks, failing with 503
+// unless all devices were refreshed successfully within -ready-max-age. The
+// body lists the last success time and age of each device.
+func readyzHandler(devices []*collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxAge := *readyAge
+		if maxAge == 0 {
+			maxAge = 2 * *interval
+		}
+		ready := true
+		var body strings.Builder
+		for _, c := range devices {
+			last := c.lastSuccess.Load()
+			if last.IsZero() {
+				ready = false
+				fmt.Fprintf(&body, "%s: not refreshed yet\n", c.addr)
+				continue
+			}
+			// Refreshes are paused outside of active hours, so that time
+			// doesn't count.
+			age := activeHours.activeBetween(last, time.Now())
+			if age > maxAge {
+				ready = false
+			}
+			fmt.Fprintf(&body, "%s: last success %s, age %s (max %s)\n", c.addr, last.Format(time.RFC3339), age.Round(time.Second), maxAge)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, body.String())
+	})
+}
+
+// handleResetDedup handles POST requests to forget the last reported times
+// used for deduplication, for a single metric if the metric form value is set.
+func (c *collector) handleResetDedup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resetter, ok := c.sink.(dedupResetter)
+	if !ok {
+		http.Error(w, "Not Implemented: sink does not support resetting deduplication", http.StatusNotImplemented)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request: failed to parse form", http.StatusBadRequest)
+		return
+	}
+	metric := r.FormValue("metric")
+	n := resetter.ResetLastTimes(metric)
+	slog.Warn("deduplication state reset via web interface", "metric", metric, "cleared", n, "client", clientIP(r))
+	fmt.Fprintf(w, "cleared %d last reported times\n", n)
+}
+
+// handleAnnotation handles POST requests to record a device event, like a
+// battery change, as an event metric with the event name as a label. Only the
+// events configured with -events are accepted, to bound the number of series.
+func (c *collector) handleAnnotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reporter, ok := c.sink.(labeledReporter)
+	if !ok {
+		http.Error(w, "Not Implemented: sink does not support events", http.StatusNotImplemented)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request: failed to parse form", http.StatusBadRequest)
+		return
+	}
+	event := r.FormValue("event")
+	allowed := strings.Split(*eventNames, ",")
+	if !slices.Contains(allowed, event) {
+		http.Error(w, fmt.Sprintf("Bad Request: event must be one of %s", strings.Join(allowed, ", ")), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *timeout)
+	defer cancel()
+	if err := reporter.ReportWithLabels(ctx, "event", map[string]string{"event": event}, time.Now(), 1); err != nil {
+		slog.Error("failed to record event", "event", event, "error", err)
+		http.Error(w, "Internal Server Error: failed to record event", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("event recorded via web interface", "event", event, "client", clientIP(r))
+	fmt.Fprintf(w, "recorded event %s\n", event)
+}
+
 // handleRefreshPost handles POST requests to trigger a refresh.
 func (c *collector) handleRefreshPost(w http.ResponseWriter, r *http.Request) {
 	select {
 	case c.refreshChan <- true:
-		slog.Info("refresh triggered via web interface")
+		slog.Info("refresh triggered via web interface", "client", clientIP(r))
 	default:
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -92,7 +215,7 @@ func (c *collector) handlePasskeyPost(w http.ResponseWriter, r *http.Request) {
 	if pkChan != nil {
 		select {
 		case pkChan <- passkey:
-			slog.Info("passkey received via web interface")
+			slog.Info("passkey received via web interface", "client", clientIP(r))
 			// Redirect back to the status page
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 		case <-time.After(5 * time.Second):
@@ -104,6 +227,163 @@ func (c *collector) handlePasskeyPost(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// clientIP returns the address of the client that made a request. Forwarding
+// headers are only used if the request came from a trusted proxy, in which case
+// the last untrusted address in X-Forwarded-For is returned.
+func clientIP(r *http.Request) string {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !trustedProxies.contains(addr) {
+		return host
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// Anything before an invalid entry can't be trusted.
+				break
+			}
+			host = hop.String()
+			if !trustedProxies.contains(hop) {
+				break
+			}
+		}
+		return host
+	}
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.String()
+	}
+	return host
+}
+
+// instrumentHandler counts requests handled by h in requests, labelled by the
+// mux pattern matching the request, the method and the response status. Both
+// patterns and methods are bounded, so probing the server with random paths
+// does not create new series.
+func instrumentHandler(mux *http.ServeMux, requests *prometheus.CounterVec, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "other"
+		}
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost:
+		default:
+			method = "other"
+		}
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		requests.WithLabelValues(pattern, method, strconv.Itoa(sw.status)).Inc()
+	})
+}
+
+// statusResponseWriter records the status code of a response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusResponseWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// gzipHandler compresses responses for clients that accept gzip encoding.
+// Responses that are already encoded (e.g. by promhttp) and event streams are
+// passed through unchanged.
+func gzipHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter decides whether to compress a response when its headers
+// are written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	compress := h.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") &&
+		code != http.StatusNoContent && code != http.StatusNotModified
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so that streaming responses are not buffered.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
 // formatDuration formats a duration into a human-readable string.
 func formatDuration(d time.Duration) string {
 	if d < time.Minute {
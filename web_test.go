@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knyar/aranet4-ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/api/device/info", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests"}, []string{"path", "method", "status"})
+	handler := instrumentHandler(mux, requests, mux)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/", nil),
+		httptest.NewRequest(http.MethodPost, "/", nil),
+		httptest.NewRequest(http.MethodGet, "/wp-login.php", nil),
+		httptest.NewRequest(http.MethodGet, "/random/path", nil),
+		httptest.NewRequest("PROPFIND", "/", nil),
+		httptest.NewRequest(http.MethodGet, "/api/device/info", nil),
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("/", "GET", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("/", "POST", "200")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(requests.WithLabelValues("/", "GET", "404")), "Unknown paths should be reported under the catch-all route")
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("/", "other", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("/api/device/info", "GET", "503")))
+	assert.Equal(t, 5, testutil.CollectAndCount(requests))
+}
+
+func TestClientIP(t *testing.T) {
+	var proxies prefixesFlag
+	require.NoError(t, proxies.Set("10.0.0.0/8, 192.168.1.1/32"))
+	setFlag(t, &trustedProxies, proxies)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.5:1234",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted proxy",
+			remoteAddr: "203.0.113.5:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed forwarded for",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 192.168.1.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "invalid forwarded for",
+			remoteAddr: "10.1.2.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "garbage, 10.0.0.1"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "real ip",
+			remoteAddr: "[::ffff:10.1.2.3]:1234",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.1.2.3:1234",
+			want:       "10.1.2.3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, clientIP(r))
+		})
+	}
+}
+
+// eventSink is a fakeSink that also records events.
+type eventSink struct {
+	fakeSink
+	events []map[string]string
+}
+
+func (s *eventSink) ReportWithLabels(ctx context.Context, name string, labels map[string]string, ts time.Time, value float64) error {
+	s.events = append(s.events, labels)
+	return nil
+}
+
+func TestHandleAnnotation(t *testing.T) {
+	sink := &eventSink{}
+	c := newCollectorWithRegistry(sink, prometheus.NewRegistry())
+	post := func(event string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/annotation", strings.NewReader(url.Values{"event": {event}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		c.handleAnnotation(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, post("moved").Code)
+	w := post("exploded")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "battery_replaced, moved, calibrated")
+	assert.Equal(t, []map[string]string{{"event": "moved"}}, sink.events)
+
+	w = httptest.NewRecorder()
+	c.handleAnnotation(w, httptest.NewRequest(http.MethodGet, "/api/annotation", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// Sinks without labeled metrics can't record events.
+	c = newCollectorWithRegistry(&fakeSink{}, prometheus.NewRegistry())
+	assert.Equal(t, http.StatusNotImplemented, post("moved").Code)
+}
+
+// postForm posts a form to the status page of c.
+func postForm(c *collector, values url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	return w
+}
+
+func TestServeHTTP_Refresh(t *testing.T) {
+	c := newCollectorWithRegistry(&fakeSink{}, prometheus.NewRegistry())
+
+	// Without the loop waiting for a refresh, the request is dropped.
+	w := postForm(c, url.Values{"action": {"refresh"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	refreshed := make(chan bool)
+	go func() { refreshed <- <-c.refreshChan }()
+	assert.Eventually(t, func() bool {
+		assert.Equal(t, http.StatusSeeOther, postForm(c, url.Values{"action": {"refresh"}}).Code)
+		select {
+		case <-refreshed:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusBadRequest, postForm(c, url.Values{"action": {"explode"}}).Code)
+}
+
+func TestServeHTTP_BeforeFirstRefresh(t *testing.T) {
+	c, err := newCollector(&fakeSink{}, "AA:BB:CC:DD:EE:FF", prometheus.NewRegistry())
+	require.NoError(t, err)
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Pairing happens during the first refresh, so the prompt must be
+	// shown before any data was read.
+	got := make(chan int)
+	go func() { got <- c.passkeyFromWeb(context.Background()) }()
+	require.Eventually(t, func() bool { return c.passkeyChan.Load() != nil }, time.Second, time.Millisecond)
+
+	w := get(c, "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "No data yet")
+	assert.Contains(t, w.Body.String(), "Bluetooth Pairing Required")
+	assert.Equal(t, http.StatusSeeOther, postForm(c, url.Values{"action": {"passkey"}, "passkey": {"123456"}}).Code)
+	assert.Equal(t, 123456, <-got)
+
+	w = get(http.HandlerFunc(c.handleDeviceInfo), "/api/device/info")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "not been read yet")
+	assert.Equal(t, http.StatusOK, get(http.HandlerFunc(handleHealthz), "/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get(readyzHandler([]*collector{c}), "/readyz").Code)
+}
+
+func TestServeHTTP_Passkey(t *testing.T) {
+	c := newCollectorWithRegistry(&fakeSink{}, prometheus.NewRegistry())
+
+	w := postForm(c, url.Values{"action": {"passkey"}, "passkey": {"123456"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "no passkey request pending")
+
+	got := make(chan int)
+	go func() { got <- c.passkeyFromWeb(context.Background()) }()
+	require.Eventually(t, func() bool { return c.passkeyChan.Load() != nil }, time.Second, time.Millisecond)
+
+	assert.Equal(t, http.StatusBadRequest, postForm(c, url.Values{"action": {"passkey"}, "passkey": {"abc"}}).Code)
+	assert.Equal(t, http.StatusSeeOther, postForm(c, url.Values{"action": {"passkey"}, "passkey": {"123456"}}).Code)
+	assert.Equal(t, 123456, <-got)
+	assert.Nil(t, c.passkeyChan.Load())
+}
+
+func TestReadyz(t *testing.T) {
+	setFlag(t, interval, time.Hour)
+	device := func(addr string, age time.Duration) *collector {
+		c, _ := newTestCollector(t, aranet4.Data{}, nil)
+		c.addr = addr
+		if age > 0 {
+			c.lastSuccess.Store(time.Now().Add(-age))
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		devices  []*collector
+		want     int
+		wantBody []string
+	}{
+		{name: "recent", devices: []*collector{device("A", time.Minute)}, want: http.StatusOK, wantBody: []string{"A: last success", "age 1m0s (max 2h0m0s)"}},
+		{name: "stale", devices: []*collector{device("A", 3*time.Hour)}, want: http.StatusServiceUnavailable, wantBody: []string{"age 3h0m0s"}},
+		{name: "custom max age", maxAge: 30 * time.Second, devices: []*collector{device("A", time.Minute)}, want: http.StatusServiceUnavailable, wantBody: []string{"(max 30s)"}},
+		{name: "never refreshed", devices: []*collector{device("A", 0)}, want: http.StatusServiceUnavailable, wantBody: []string{"A: not refreshed yet"}},
+		{name: "one device stale", devices: []*collector{device("A", time.Minute), device("B", 3*time.Hour)}, want: http.StatusServiceUnavailable, wantBody: []string{"A: last success", "B: last success"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, readyAge, tt.maxAge)
+			w := httptest.NewRecorder()
+			readyzHandler(tt.devices).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			assert.Equal(t, tt.want, w.Code)
+			for _, s := range tt.wantBody {
+				assert.Contains(t, w.Body.String(), s)
+			}
+		})
+	}
+
+	t.Run("outside active hours", func(t *testing.T) {
+		// Inactive from 3 hours ago until 30 minutes ago.
+		now := time.Now()
+		var hours activeHoursFlag
+		require.NoError(t, hours.Set(now.Add(-30*time.Minute).Format("15:04")+"-"+now.Add(-3*time.Hour).Format("15:04")))
+		setFlag(t, &activeHours, hours)
+		w := httptest.NewRecorder()
+		readyzHandler([]*collector{device("A", 3*time.Hour)}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "age 30m")
+	})
+}